@@ -14,61 +14,143 @@
 
 package cachehash
 
-import "container/list"
+import (
+	"container/list"
+	"time"
+)
+
+// entryOverhead is roughly the memory taken up by an entry besides its key
+// and value: the map entry, the list element and the key-value pair
+const entryOverhead = 128
+
+// Sizer is implemented by keys and values that know roughly how many bytes of
+// memory they take up. Strings count their length, other keys and values
+// count nothing beyond the overhead of their entry.
+type Sizer interface {
+	Size() int64
+}
+
+// Stats counts the lookups and removals of a cache, and what it holds
+type Stats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+}
+
+func (s *Stats) add(o Stats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.Entries += o.Entries
+	s.Bytes += o.Bytes
+}
 
 type CacheHash struct {
 	h       map[interface{}]*list.Element
 	l       *list.List
 	len     int
 	maxLen  int
+	size    int64
+	maxSize int64
+	stats   Stats
 	ejectCB func(interface{}, interface{})
 }
 
 type keyValue struct {
-	Key   interface{}
-	Value interface{}
+	Key       interface{}
+	Value     interface{}
+	ExpiresAt time.Time
+	Size      int64
 }
 
+func (kv *keyValue) expired(now time.Time) bool {
+	return !kv.ExpiresAt.IsZero() && !now.Before(kv.ExpiresAt)
+}
+
+func sizeOf(v interface{}) int64 {
+	switch s := v.(type) {
+	case Sizer:
+		return s.Size()
+	case string:
+		return int64(len(s))
+	}
+	return 0
+}
+
+// Init sets up the cache for at most maxLen entries
 func (c *CacheHash) Init(maxLen int) {
 	c.l = list.New()
 	c.l = c.l.Init()
 	c.h = make(map[interface{}]*list.Element)
 	c.len = 0
 	c.maxLen = maxLen
+	c.size = 0
+	c.maxSize = 0
+	c.stats = Stats{}
+}
+
+// InitSize sets up the cache for entries that take up at most maxSize bytes
+// of memory in total, as estimated from their Size
+func (c *CacheHash) InitSize(maxSize int64) {
+	c.Init(0)
+	c.maxSize = maxSize
+}
+
+func (c *CacheHash) full() bool {
+	if c.maxLen > 0 && c.len > c.maxLen {
+		return true
+	}
+	// the entry that was just added stays, even if it is larger than the
+	// whole cache
+	return c.maxSize > 0 && c.size > c.maxSize && c.len > 1
+}
+
+func (c *CacheHash) remove(e *list.Element) keyValue {
+	kv := e.Value.(keyValue)
+	delete(c.h, kv.Key)
+	c.l.Remove(e)
+	c.len--
+	c.size -= kv.Size
+	return kv
 }
 
 func (c *CacheHash) Eject() {
 	if c.len == 0 {
 		return
 	}
-	e := c.l.Back()
-	kv := e.Value.(keyValue)
+	kv := c.remove(c.l.Back())
+	c.stats.Evictions++
 	if c.ejectCB != nil {
 		c.ejectCB(kv.Key, kv.Value)
 	}
-	delete(c.h, kv.Key)
-	c.l.Remove(e)
-	c.len--
 }
 
 func (c *CacheHash) Add(k interface{}, v interface{}) bool {
+	return c.AddExpiring(k, v, time.Time{})
+}
+
+// AddExpiring adds k, which is removed from the cache at expiresAt. Entries
+// with a zero expiresAt do not expire.
+func (c *CacheHash) AddExpiring(k interface{}, v interface{}, expiresAt time.Time) bool {
+	kv := keyValue{Key: k, Value: v, ExpiresAt: expiresAt, Size: entryOverhead + sizeOf(k) + sizeOf(v)}
 	e, ok := c.h[k]
 	if ok {
-		kv := e.Value.(keyValue)
-		kv.Key = k
-		kv.Value = v
+		c.size -= e.Value.(keyValue).Size
+		e.Value = kv
 		c.l.MoveToFront(e)
 	} else {
-		if c.len >= c.maxLen {
-			c.Eject()
-		}
-		var kv keyValue
-		kv.Key = k
-		kv.Value = v
 		e = c.l.PushFront(kv)
 		c.len++
 		c.h[k] = e
 	}
+	c.size += kv.Size
+	for c.full() {
+		c.Eject()
+	}
 	return ok
 }
 
@@ -90,26 +172,44 @@ func (c *CacheHash) Last() (interface{}, interface{}) {
 	return kv.Key, kv.Value
 }
 
-func (c *CacheHash) Get(k interface{}) (interface{}, bool) {
+// lookup returns the entry of k, removing it if it has expired
+func (c *CacheHash) lookup(k interface{}) (*list.Element, bool) {
 	e, ok := c.h[k]
+	if !ok {
+		return nil, false
+	}
+	if kv := e.Value.(keyValue); !kv.ExpiresAt.IsZero() && kv.expired(time.Now()) {
+		c.remove(e)
+		c.stats.Expirations++
+		return nil, false
+	}
+	return e, true
+}
+
+func (c *CacheHash) Get(k interface{}) (interface{}, bool) {
+	e, ok := c.lookup(k)
 	if ok {
+		c.stats.Hits++
 		c.l.MoveToFront(e)
 		kv := e.Value.(keyValue)
 		return kv.Value, ok
 	}
+	c.stats.Misses++
 	return nil, ok
 }
 
 func (c *CacheHash) GetNoMove(k interface{}) (interface{}, bool) {
-	e, ok := c.h[k]
+	e, ok := c.lookup(k)
 	if ok {
+		c.stats.Hits++
 		return e.Value.(keyValue).Value, ok
 	}
+	c.stats.Misses++
 	return nil, ok
 }
 
 func (c *CacheHash) Has(k interface{}) bool {
-	_, ok := c.h[k]
+	_, ok := c.lookup(k)
 	return ok
 }
 
@@ -118,17 +218,53 @@ func (c *CacheHash) Delete(k interface{}) (interface{}, bool) {
 	if ok != true {
 		return nil, false
 	}
-	kv := e.Value.(keyValue)
-	delete(c.h, k)
-	c.l.Remove(e)
-	c.len--
+	kv := c.remove(e)
 	return kv.Value, true
 }
 
+// Expire removes the entries that have expired by now and returns how many
+// there were
+func (c *CacheHash) Expire(now time.Time) int {
+	n := 0
+	for e := c.l.Front(); e != nil; {
+		next := e.Next()
+		if kv := e.Value.(keyValue); kv.expired(now) {
+			c.remove(e)
+			n++
+		}
+		e = next
+	}
+	c.stats.Expirations += uint64(n)
+	return n
+}
+
+// Each calls f with every entry that has not expired, from the least to the
+// most recently used, and the time it expires at
+func (c *CacheHash) Each(f func(k interface{}, v interface{}, expiresAt time.Time)) {
+	now := time.Now()
+	for e := c.l.Back(); e != nil; e = e.Prev() {
+		if kv := e.Value.(keyValue); !kv.expired(now) {
+			f(kv.Key, kv.Value, kv.ExpiresAt)
+		}
+	}
+}
+
 func (c *CacheHash) Len() int {
 	return c.len
 }
 
+// Size returns the estimated memory taken up by the entries
+func (c *CacheHash) Size() int64 {
+	return c.size
+}
+
+func (c *CacheHash) Stats() Stats {
+	s := c.stats
+	s.Entries = c.len
+	s.Bytes = c.size
+	return s
+}
+
 func (c *CacheHash) RegisterCB(newCB func(interface{}, interface{})) {
 	c.ejectCB = newCB
 }
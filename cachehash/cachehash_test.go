@@ -16,7 +16,11 @@ package cachehash
 
 import (
 	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAddOne(t *testing.T) {
@@ -113,3 +117,187 @@ func TestEject(t *testing.T) {
 		t.Error("Ejected element not removed from hash")
 	}
 }
+
+func TestAddReplacesValue(t *testing.T) {
+	ch := new(CacheHash)
+	ch.Init(5)
+	ch.Add("key1", "value1")
+	ch.Add("key2", "value2")
+	if ok := ch.Add("key1", "value3"); !ok {
+		t.Error("Add does not report existing element")
+	}
+	if k, v := ch.First(); k != "key1" || v != "value3" {
+		t.Error("Add does not replace value of existing element")
+	}
+}
+
+func TestShardedConcurrentUpdate(t *testing.T) {
+	ch := new(ShardedCacheHash)
+	ch.Init(100, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ch.Update(j%10, func(v interface{}, ok bool) (interface{}, time.Time) {
+					if !ok {
+						return 1, time.Time{}
+					}
+					return v.(int) + 1, time.Time{}
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if ch.Len() != 10 {
+		t.Errorf("expected 10 elements, got %d", ch.Len())
+	}
+	for k := 0; k < 10; k++ {
+		if v, ok := ch.Get(k); !ok || v != 500 {
+			t.Errorf("key %d: expected 500 updates, got %v", k, v)
+		}
+	}
+}
+
+func TestShardedEject(t *testing.T) {
+	ch := new(ShardedCacheHash)
+	ch.Init(64, 4)
+	for i := 0; i < 1000; i++ {
+		ch.Add(fmt.Sprintf("key%d", i), i)
+	}
+	if ch.Len() > 64 {
+		t.Errorf("length not respected: %d", ch.Len())
+	}
+	if v, ok := ch.Get("key999"); !ok || v != 999 {
+		t.Error("most recent element ejected")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ch := new(CacheHash)
+	ch.Init(5)
+	now := time.Now()
+	ch.AddExpiring("key1", "value1", now.Add(-time.Second))
+	ch.AddExpiring("key2", "value2", now.Add(time.Hour))
+	ch.AddExpiring("key3", "value3", now.Add(-time.Second))
+	ch.Add("key4", "value4")
+	if _, ok := ch.Get("key1"); ok {
+		t.Error("Get returns expired element")
+	}
+	if n := ch.Expire(now); n != 1 || ch.Len() != 2 {
+		t.Errorf("Expire removed %d elements, leaving %d", n, ch.Len())
+	}
+	if n := ch.Expire(now.Add(2 * time.Hour)); n != 1 || !ch.Has("key4") {
+		t.Error("Expire removes elements without expiry")
+	}
+	stats := ch.Stats()
+	if stats.Expirations != 3 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	ch := new(CacheHash)
+	ch.InitSize(3 * (entryOverhead + 10))
+	for i := 0; i < 5; i++ {
+		ch.Add(fmt.Sprintf("key%d", i), "value")
+	}
+	if ch.Len() != 3 || ch.Size() != 3*(entryOverhead+4+5) {
+		t.Errorf("size not respected: %d elements of %d bytes", ch.Len(), ch.Size())
+	}
+	if stats := ch.Stats(); stats.Evictions != 2 {
+		t.Errorf("expected 2 evictions, got %d", stats.Evictions)
+	}
+	// an element larger than the cache pushes out all others
+	ch.Add("big", string(make([]byte, 1000)))
+	if ch.Len() != 1 || !ch.Has("big") {
+		t.Error("large element not kept on its own")
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	ch := new(ShardedCacheHash)
+	ch.Init(100, 4)
+	for i := 0; i < 10; i++ {
+		ch.AddExpiring(i, i, time.Now().Add(10*time.Millisecond))
+	}
+	ch.StartSweeper(5 * time.Millisecond)
+	defer ch.Close()
+	for deadline := time.Now().Add(5 * time.Second); ch.Len() > 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("sweeper left %d expired elements", ch.Len())
+		}
+	}
+	if stats := ch.Stats(); stats.Expirations != 10 || stats.Hits != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// lockedCacheHash is a CacheHash behind a single lock, the way it was shared
+// before it was sharded
+type lockedCacheHash struct {
+	sync.Mutex
+	CacheHash
+}
+
+func (c *lockedCacheHash) Get(k interface{}) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.CacheHash.Get(k)
+}
+
+func (c *lockedCacheHash) Add(k interface{}, v interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.CacheHash.Add(k, v)
+}
+
+type cache interface {
+	Get(interface{}) (interface{}, bool)
+	Add(interface{}, interface{}) bool
+}
+
+// benchmarkCache runs lookups from a growing number of goroutines on a cache
+// holding half of the keys, adding the keys that miss
+func benchmarkCache(b *testing.B, c cache) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("name%d.example.com", i)
+		if i%2 == 0 {
+			c.Add(keys[i], i)
+		}
+	}
+	for _, goroutines := range []int{1, 16, 256, 1024} {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			p := goroutines / runtime.GOMAXPROCS(0)
+			if p < 1 {
+				p = 1
+			}
+			b.SetParallelism(p)
+			var seed uint32
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&seed, 7919))
+				for pb.Next() {
+					k := keys[i%len(keys)]
+					if _, ok := c.Get(k); !ok {
+						c.Add(k, i)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkLockedCacheHash(b *testing.B) {
+	c := new(lockedCacheHash)
+	c.Init(8000)
+	benchmarkCache(b, c)
+}
+
+func BenchmarkShardedCacheHash(b *testing.B) {
+	c := new(ShardedCacheHash)
+	c.Init(8000, DefaultShards)
+	benchmarkCache(b, c)
+}
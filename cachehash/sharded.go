@@ -0,0 +1,243 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cachehash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// DefaultShards is the number of shards of a ShardedCacheHash, unless given
+// otherwise
+const DefaultShards = 64
+
+// Hasher is implemented by keys that compute their own hash. Other keys are
+// hashed by their string form.
+type Hasher interface {
+	Hash() uint64
+}
+
+type shard struct {
+	sync.Mutex
+	CacheHash
+}
+
+// ShardedCacheHash is an LRU cache that is safe for concurrent use. Keys are
+// spread over shards, each a CacheHash behind its own lock, so goroutines
+// looking up different keys rarely wait on each other. Eviction is least
+// recently used within a shard, which approximates LRU over the whole cache.
+//
+// Values are shared between all goroutines that get them and must not be
+// modified once added. Use Update to change the value of a key.
+type ShardedCacheHash struct {
+	shards []shard
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Init sets up the cache for maxLen entries in total, split over the given
+// number of shards. There are never more shards than entries.
+func (c *ShardedCacheHash) Init(maxLen int, shards int) {
+	if shards > maxLen {
+		shards = maxLen
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	c.shards = make([]shard, shards)
+	for i := range c.shards {
+		c.shards[i].Init((maxLen + shards - 1) / shards)
+	}
+}
+
+// InitSize sets up the cache for entries that take up at most maxSize bytes
+// of memory in total, split over the given number of shards
+func (c *ShardedCacheHash) InitSize(maxSize int64, shards int) {
+	if shards < 1 {
+		shards = 1
+	}
+	c.shards = make([]shard, shards)
+	for i := range c.shards {
+		c.shards[i].InitSize((maxSize + int64(shards) - 1) / int64(shards))
+	}
+}
+
+func hashKey(k interface{}) uint64 {
+	switch key := k.(type) {
+	case Hasher:
+		return key.Hash()
+	case string:
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64()
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, k)
+	return h.Sum64()
+}
+
+func (c *ShardedCacheHash) shard(k interface{}) *shard {
+	return &c.shards[hashKey(k)%uint64(len(c.shards))]
+}
+
+// Add sets the value of k and returns whether k was already present
+func (c *ShardedCacheHash) Add(k interface{}, v interface{}) bool {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.CacheHash.Add(k, v)
+}
+
+// AddExpiring sets the value of k until expiresAt and returns whether k was
+// already present
+func (c *ShardedCacheHash) AddExpiring(k interface{}, v interface{}, expiresAt time.Time) bool {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.CacheHash.AddExpiring(k, v, expiresAt)
+}
+
+// Update atomically sets the value of k to the value returned by f(v, ok),
+// where v and ok are what Get would have returned, until the expiry returned
+// by f. f runs while the shard of k is locked, so it must be quick and must
+// not use the cache.
+func (c *ShardedCacheHash) Update(k interface{}, f func(interface{}, bool) (interface{}, time.Time)) {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	var v interface{}
+	e, ok := s.CacheHash.lookup(k)
+	if ok {
+		v = e.Value.(keyValue).Value
+	}
+	nv, expiresAt := f(v, ok)
+	s.CacheHash.AddExpiring(k, nv, expiresAt)
+}
+
+// Get returns the value of k and marks it as recently used
+func (c *ShardedCacheHash) Get(k interface{}) (interface{}, bool) {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.CacheHash.Get(k)
+}
+
+// GetNoMove returns the value of k without marking it as recently used
+func (c *ShardedCacheHash) GetNoMove(k interface{}) (interface{}, bool) {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.CacheHash.GetNoMove(k)
+}
+
+func (c *ShardedCacheHash) Has(k interface{}) bool {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.CacheHash.Has(k)
+}
+
+func (c *ShardedCacheHash) Delete(k interface{}) (interface{}, bool) {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.CacheHash.Delete(k)
+}
+
+// Len returns the number of entries in all shards. Shards are counted one
+// after the other, so the total may be off while the cache is in use.
+func (c *ShardedCacheHash) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		n += s.CacheHash.Len()
+		s.Unlock()
+	}
+	return n
+}
+
+// Each calls f with every entry that has not expired, and the time it expires
+// at, one shard after the other. f runs while the shard is locked, so it must
+// not use the cache.
+func (c *ShardedCacheHash) Each(f func(k interface{}, v interface{}, expiresAt time.Time)) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.CacheHash.Each(f)
+		s.Unlock()
+	}
+}
+
+// Stats adds up the statistics of all shards
+func (c *ShardedCacheHash) Stats() Stats {
+	var stats Stats
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		stats.add(s.CacheHash.Stats())
+		s.Unlock()
+	}
+	return stats
+}
+
+// Expire removes the entries that have expired from all shards, one shard at
+// a time, and returns how many there were
+func (c *ShardedCacheHash) Expire() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		n += s.CacheHash.Expire(time.Now())
+		s.Unlock()
+	}
+	return n
+}
+
+// StartSweeper removes expired entries every interval until Close is called.
+// Without it, expired entries are only removed when they are looked up or
+// pushed out by newer ones.
+func (c *ShardedCacheHash) StartSweeper(interval time.Duration) {
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.Expire()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the sweeper, if there is one
+func (c *ShardedCacheHash) Close() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop = nil
+}
@@ -0,0 +1,165 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the checkpoint file is rewritten while a scan runs
+const checkpointInterval = time.Second
+
+// Checkpoint records which inputs of a scan have been processed. Inputs are
+// numbered from zero in the order the input handler produces them. Lookups
+// finish out of order, so every input before Below is done, and Done holds
+// the ones after it that have finished as well. Inputs of other shards count
+// as done. Clean is only set by the last save of a scan whose output was
+// flushed and closed without error; until then, the output of inputs marked
+// done may still be buffered (e.g., in a compressed stream).
+type Checkpoint struct {
+	InputFile string `json:"input_file"`
+	Shard     int    `json:"shard"`
+	Shards    int    `json:"shards"`
+	Below     int    `json:"completed_below"`
+	Done      []int  `json:"completed"`
+	Clean     bool   `json:"clean"`
+}
+
+// input tagged with its position in the input stream
+type numberedInput struct {
+	Index int
+	Data  interface{}
+}
+
+type checkpointTracker struct {
+	sync.Mutex
+	path      string
+	inputFile string
+	shard     int
+	shards    int
+	below     int
+	done      map[int]bool
+	clean     bool
+}
+
+// LoadCheckpoint reads the checkpoint at path. A missing file is an empty
+// checkpoint, which is clean as there is no output to resume.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Checkpoint{Clean: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := new(Checkpoint)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newCheckpointTracker(path string, inputFile string, shard int, shards int, start *Checkpoint) *checkpointTracker {
+	t := &checkpointTracker{path: path, inputFile: inputFile, shard: shard, shards: shards, done: make(map[int]bool)}
+	if start != nil {
+		t.below = start.Below
+		for _, i := range start.Done {
+			t.done[i] = true
+		}
+		t.advance()
+	}
+	return t
+}
+
+func (t *checkpointTracker) advance() {
+	for t.done[t.below] {
+		delete(t.done, t.below)
+		t.below++
+	}
+}
+
+func (t *checkpointTracker) isDone(i int) bool {
+	t.Lock()
+	defer t.Unlock()
+	return i < t.below || t.done[i]
+}
+
+func (t *checkpointTracker) markDone(i int) {
+	t.Lock()
+	// inputs of other shards are marked again when a scan is resumed
+	if i >= t.below {
+		t.done[i] = true
+		t.advance()
+	}
+	t.Unlock()
+}
+
+// setClean marks whether the output covered by the checkpoint was flushed
+// and closed without error. It is called once the output handler is done.
+func (t *checkpointTracker) setClean(clean bool) {
+	t.Lock()
+	t.clean = clean
+	t.Unlock()
+}
+
+// save atomically replaces the checkpoint file
+func (t *checkpointTracker) save() error {
+	t.Lock()
+	c := Checkpoint{InputFile: t.inputFile, Shard: t.shard, Shards: t.shards, Below: t.below, Done: make([]int, 0, len(t.done)), Clean: t.clean}
+	for i := range t.done {
+		c.Done = append(c.Done, i)
+	}
+	t.Unlock()
+	sort.Ints(c.Done)
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// track marks inputs as done as their results are handed to the output
+// handler and periodically saves the checkpoint, until done is closed
+func (t *checkpointTracker) track(done <-chan int, wg *sync.WaitGroup) {
+	defer (*wg).Done()
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case i, ok := <-done:
+			if !ok {
+				if err := t.save(); err != nil {
+					log.Error("unable to save checkpoint: ", err.Error())
+				}
+				return
+			}
+			t.markDone(i)
+		case <-ticker.C:
+			if err := t.save(); err != nil {
+				log.Error("unable to save checkpoint: ", err.Error())
+			}
+		}
+	}
+}
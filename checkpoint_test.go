@@ -0,0 +1,235 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nameLookup answers every name with itself after a short random delay, so
+// that lookups finish out of order
+type nameLookup struct {
+	BaseLookup
+}
+
+func (l *nameLookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, Status, error) {
+	time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+	return name, nil, STATUS_NOERROR, nil
+}
+
+type nameRoutineFactory struct{}
+
+func (f nameRoutineFactory) MakeLookup() (Lookup, error) {
+	return new(nameLookup), nil
+}
+
+type nameModule struct {
+	BaseGlobalLookupFactory
+}
+
+func (m *nameModule) MakeRoutineFactory(threadID int) (RoutineLookupFactory, error) {
+	return nameRoutineFactory{}, nil
+}
+
+// sliceInput feeds names, and records whether FeedChannel returned. Its
+// Initialize fails with initErr.
+type sliceInput struct {
+	names    []string
+	returned bool
+	initErr  error
+}
+
+func (h *sliceInput) Initialize(conf *GlobalConf) error { return h.initErr }
+
+func (h *sliceInput) FeedChannel(in chan<- interface{}, wg *sync.WaitGroup, zonefileInput bool, stop <-chan struct{}) error {
+	defer close(in)
+	defer (*wg).Done()
+	defer func() { h.returned = true }()
+	for _, n := range h.names {
+		select {
+		case in <- n:
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+// recordingOutput collects the names of results, and closes stop once it
+// has seen stopAfter of them
+type recordingOutput struct {
+	names     []string
+	stopAfter int
+	stop      chan struct{}
+}
+
+func (h *recordingOutput) Initialize(conf *GlobalConf) error { return nil }
+
+func (h *recordingOutput) WriteResults(results <-chan Result, wg *sync.WaitGroup) error {
+	defer (*wg).Done()
+	for res := range results {
+		h.names = append(h.names, res.Name)
+		if len(h.names) == h.stopAfter {
+			close(h.stop)
+		}
+	}
+	return nil
+}
+
+func TestCheckpointTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scan.checkpoint")
+
+	if c, err := LoadCheckpoint(path); err != nil || !c.Clean || c.Below != 0 {
+		t.Errorf("expected a missing checkpoint to be empty and clean, got %+v %v", c, err)
+	}
+
+	tracker := newCheckpointTracker(path, "names.txt", 0, 1, nil)
+	for _, i := range []int{2, 0, 5} {
+		tracker.markDone(i)
+	}
+	if tracker.below != 1 || !tracker.isDone(2) || tracker.isDone(1) {
+		t.Errorf("unexpected progress: below %d, done %v", tracker.below, tracker.done)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"completed_below": 1000}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary checkpoint left behind: %v", err)
+	}
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Checkpoint{InputFile: "names.txt", Shard: 0, Shards: 1, Below: 1, Done: []int{2, 5}}
+	if !reflect.DeepEqual(*c, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *c)
+	}
+
+	resumed := newCheckpointTracker(path, "names.txt", 0, 1, c)
+	resumed.markDone(1)
+	if resumed.below != 3 || !resumed.isDone(5) || resumed.isDone(3) || resumed.isDone(4) {
+		t.Errorf("unexpected progress after resuming: below %d, done %v", resumed.below, resumed.done)
+	}
+}
+
+// scan runs a scan of names with the checkpoint at path, stopping it once
+// stopAfter results have been written, and returns the names written
+func scan(t *testing.T, conf *GlobalConf, names []string, stopAfter int) []string {
+	in := &sliceInput{names: names}
+	out := &recordingOutput{stopAfter: stopAfter, stop: make(chan struct{})}
+	RegisterInputHandler("checkpoint-test", in)
+	RegisterOutputHandler("checkpoint-test", out)
+	var g GlobalLookupFactory = new(nameModule)
+	if err := g.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoLookups(context.Background(), out.stop, &g, conf); err != nil {
+		t.Fatal(err)
+	}
+	if !in.returned {
+		t.Error("the scan returned before the input handler")
+	}
+	return out.names
+}
+
+func TestInitializeError(t *testing.T) {
+	in := &sliceInput{names: []string{"a.example"}, initErr: errors.New("no input")}
+	out := &recordingOutput{stopAfter: -1, stop: make(chan struct{})}
+	RegisterInputHandler("initialize-test", in)
+	RegisterOutputHandler("initialize-test", out)
+	conf := &GlobalConf{Threads: 1, Timeout: time.Second, InputHandler: "initialize-test", OutputHandler: "initialize-test"}
+	var g GlobalLookupFactory = new(nameModule)
+	if err := g.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoLookups(context.Background(), out.stop, &g, conf); err != in.initErr {
+		t.Errorf("expected the input handler's error, got %v", err)
+	}
+	if in.returned || len(out.names) != 0 {
+		t.Error("the scan started although the input handler could not be set up")
+	}
+}
+
+func TestResumeScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var names []string
+	for i := 0; i < 500; i++ {
+		names = append(names, fmt.Sprintf("name%d.example", i))
+	}
+	for _, shards := range []int{1, 3} {
+		path := filepath.Join(dir, fmt.Sprintf("shards%d.checkpoint", shards))
+		conf := &GlobalConf{
+			Threads:            16,
+			Timeout:            time.Second,
+			InputHandler:       "checkpoint-test",
+			OutputHandler:      "checkpoint-test",
+			CheckpointFilePath: path,
+			Shard:              1 % shards,
+			Shards:             shards,
+		}
+		seen := make(map[string]int)
+		first := scan(t, conf, names, 50)
+		if len(first) >= len(names)/shards {
+			t.Fatalf("%d shards: the scan was not interrupted", shards)
+		}
+		c, err := LoadCheckpoint(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Clean || c.Below+len(c.Done) < len(first) {
+			t.Errorf("%d shards: checkpoint %+v does not cover the %d results written", shards, c, len(first))
+		}
+		conf.Resume = true
+		second := scan(t, conf, names, -1)
+		for _, n := range append(first, second...) {
+			seen[n]++
+		}
+		for _, n := range names {
+			expected := 0
+			if inShard(conf, n) {
+				expected = 1
+			}
+			if seen[n] != expected {
+				t.Errorf("%d shards: %s was looked up %d times, expected %d", shards, n, seen[n], expected)
+			}
+		}
+		if c, err := LoadCheckpoint(path); err != nil || c.Below != len(names) || len(c.Done) != 0 {
+			t.Errorf("%d shards: expected every input to be done, got %+v %v", shards, c, err)
+		}
+	}
+}
@@ -14,16 +14,32 @@
 
 package zdns
 
-import "time"
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
 
 type GlobalConf struct {
 	Threads              int
 	Timeout              time.Duration
 	IterationTimeout     time.Duration
 	Retries              int
+	RateLimit            float64
+	PerServerRateLimit   float64
 	AlexaFormat          bool
+	TargetedInput        bool
 	IterativeResolution  bool
+	ValidateDNSSEC       bool
 	Trace                bool
+	RawResponse          bool
 	MaxDepth             int
 	CacheSize            int
 	GoMaxProcs           int
@@ -32,9 +48,25 @@ type GlobalConf struct {
 	PassedName           string
 	NameServersSpecified bool
 	NameServers          []string
+	ResolvConfPath       string
+
+	Transport             string
+	TLSServerName         string
+	TLSCAFile             string
+	TLSInsecureSkipVerify bool
+	TLSConfig             *tls.Config `json:"-"`
+	HTTPSMethod           string
+
+	EDNS               bool
+	UDPBufferSize      int
+	DNSSEC             bool
+	NSID               bool
+	ClientSubnetString string
+	ClientSubnet       *dns.EDNS0_SUBNET `json:"-"`
 
 	InputHandler  string
 	OutputHandler string
+	OutputFormat  string
 
 	InputFilePath    string
 	OutputFilePath   string
@@ -44,6 +76,40 @@ type GlobalConf struct {
 	LogFilePath      string
 	MetadataFilePath string
 
+	InputCompression  string
+	OutputCompression string
+
+	// the iterative cache: --cache-size is a number of entries or, with a
+	// unit, the memory it may take up. It is kept in CacheFilePath between
+	// runs.
+	CacheSizeString string
+	CacheBytes      int64
+	CacheFilePath   string
+
+	// where iterative resolution starts: the root servers listed in
+	// RootHintsFilePath, or RootServers, primed unless NoRootPriming is set.
+	// DNSSEC validation starts from the DS records in TrustAnchorsFilePath,
+	// or the root trust anchors.
+	RootHintsFilePath    string
+	RootIPv6             bool
+	NoRootPriming        bool
+	TrustAnchorsFilePath string
+
+	// splitting of output files, see iohandlers/file
+	OutputRotateSizeString string
+	OutputRotateSize       int64
+	OutputRotateInterval   time.Duration
+	OutputShards           int
+
+	CheckpointFilePath string
+	Resume             bool
+
+	// the part of the input looked up by this process, see inShard
+	Shard  int
+	Shards int
+
+	MetricsListenAddr string
+
 	NamePrefix string
 
 	Module        string
@@ -59,6 +125,11 @@ type Metadata struct {
 	NameServers []string       `json:"name_servers"`
 	Timeout     int            `json:"timeout"`
 	Retries     int            `json:"retries"`
+	Interrupted bool           `json:"interrupted,omitempty"`
+	Shard       int            `json:"shard"`
+	Shards      int            `json:"shards"`
+	Module      interface{}    `json:"module,omitempty"`
+	Output      interface{}    `json:"output,omitempty"`
 	Conf        *GlobalConf    `json:"conf"`
 }
 
@@ -100,9 +171,36 @@ const (
 	STATUS_REFUSED       Status = "REFUSED"
 )
 
+const (
+	TRANSPORT_UDP   = "udp"
+	TRANSPORT_TLS   = "tls"
+	TRANSPORT_HTTPS = "https"
+)
+
+// Compressions of input and output files. An empty compression is picked
+// from the file extension.
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+	COMPRESSION_XZ   = "xz"
+)
+
+func validCompression(c string) bool {
+	switch c {
+	case "", COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD, COMPRESSION_XZ:
+		return true
+	}
+	return false
+}
+
+// RootServers are the IPv4 addresses of the root servers. Iterative lookups
+// start from them unless other name servers or root hints are given. They
+// are replaced by the addresses the root servers give for themselves when
+// the roots are primed.
 var RootServers = [...]string{
 	"198.41.0.4:53",
-	"192.228.79.201:53",
+	"170.247.170.2:53",
 	"192.33.4.12:53",
 	"199.7.91.13:53",
 	"192.203.230.10:53",
@@ -114,3 +212,286 @@ var RootServers = [...]string{
 	"193.0.14.129:53",
 	"199.7.83.42:53",
 	"202.12.27.33:53"}
+
+// RootServersIPv6 are the IPv6 addresses of the root servers, used along with
+// RootServers when RootIPv6 is set
+var RootServersIPv6 = [...]string{
+	"[2001:503:ba3e::2:30]:53",
+	"[2801:1b8:10::b]:53",
+	"[2001:500:2::c]:53",
+	"[2001:500:2d::d]:53",
+	"[2001:500:a8::e]:53",
+	"[2001:500:2f::f]:53",
+	"[2001:500:12::d0d]:53",
+	"[2001:500:1::53]:53",
+	"[2001:7fe::53]:53",
+	"[2001:503:c27::2:30]:53",
+	"[2001:7fd::1]:53",
+	"[2001:500:9f::42]:53",
+	"[2001:dc3::35]:53"}
+
+// ParseRootHints reads a root hints file in zone file format, such as
+// named.root as published by IANA, and returns the addresses of the name
+// servers of the root zone that it lists. IPv6 addresses are only included if
+// ipv6 is set.
+func ParseRootHints(r io.Reader, file string, ipv6 bool) ([]string, error) {
+	var roots []string
+	isRoot := make(map[string]bool)
+	addrs := make(map[string][]string)
+	var parseErr error
+	for t := range dns.ParseZone(r, ".", file) {
+		if t.Error != nil {
+			if parseErr == nil {
+				parseErr = t.Error
+			}
+			continue
+		}
+		name := strings.ToLower(t.RR.Header().Name)
+		switch rr := t.RR.(type) {
+		case *dns.NS:
+			if ns := strings.ToLower(rr.Ns); name == "." && !isRoot[ns] {
+				isRoot[ns] = true
+				roots = append(roots, ns)
+			}
+		case *dns.A:
+			addrs[name] = append(addrs[name], net.JoinHostPort(rr.A.String(), "53"))
+		case *dns.AAAA:
+			if ipv6 {
+				addrs[name] = append(addrs[name], net.JoinHostPort(rr.AAAA.String(), "53"))
+			}
+		}
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	var servers []string
+	for _, ns := range roots {
+		servers = append(servers, addrs[ns]...)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no addresses of root name servers found")
+	}
+	return servers, nil
+}
+
+// DefaultPort is the port of name servers given without one
+func (c *GlobalConf) DefaultPort() string {
+	if c.Transport == TRANSPORT_TLS {
+		return "853"
+	}
+	return "53"
+}
+
+// Prepare fills in defaults for unset fields, checks that the settings can
+// be used together and derives the settings that follow from others. It must
+// be called before the configuration is handed to a lookup module. If no
+// name servers are given, the root servers are used for iterative lookups
+// and the servers in ResolvConfPath (/etc/resolv.conf by default) otherwise.
+func (c *GlobalConf) Prepare() error {
+	if c.Threads <= 0 {
+		c.Threads = 1000
+	}
+	if c.Retries <= 0 {
+		c.Retries = 1
+	}
+	if c.MaxDepth <= 0 {
+		c.MaxDepth = 10
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = 10000
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 15 * time.Second
+	}
+	if c.IterationTimeout <= 0 {
+		c.IterationTimeout = 4 * time.Second
+	}
+	if c.Class == 0 {
+		c.Class = dns.ClassINET
+	}
+	if c.TimeFormat == "" {
+		c.TimeFormat = time.RFC3339
+	}
+	if c.InputHandler == "" {
+		c.InputHandler = "file"
+	}
+	if c.OutputHandler == "" {
+		c.OutputHandler = "file"
+	}
+	if c.OutputFormat == "" {
+		c.OutputFormat = FORMAT_JSON
+	}
+	if c.Transport == "" {
+		c.Transport = TRANSPORT_UDP
+	}
+	if c.HTTPSMethod == "" {
+		c.HTTPSMethod = "GET"
+	}
+	if c.UDPBufferSize == 0 {
+		c.UDPBufferSize = 4096
+	}
+	if c.ResolvConfPath == "" {
+		c.ResolvConfPath = "/etc/resolv.conf"
+	}
+	if c.Shards <= 0 {
+		c.Shards = 1
+	}
+	if a, ok := GetOutputHandler(c.OutputHandler).(ConfAdjuster); ok {
+		a.AdjustConf(c)
+	}
+	if _, ok := encoders[c.OutputFormat]; !ok {
+		return errors.New("unknown output format " + c.OutputFormat)
+	}
+
+	if len(c.NameServers) == 0 {
+		// if we're doing recursive resolution, figure out default OS name servers
+		// otherwise, use the set of 13 root name servers
+		if c.IterativeResolution && c.RootHintsFilePath != "" {
+			f, err := os.Open(c.RootHintsFilePath)
+			if err != nil {
+				return errors.New("unable to open root hints: " + err.Error())
+			}
+			ns, err := ParseRootHints(f, c.RootHintsFilePath, c.RootIPv6)
+			f.Close()
+			if err != nil {
+				return errors.New("unable to read root hints: " + err.Error())
+			}
+			c.NameServers = ns
+		} else if c.IterativeResolution {
+			c.NameServers = RootServers[:]
+			if c.RootIPv6 {
+				c.NameServers = append(c.NameServers, RootServersIPv6[:]...)
+			}
+		} else {
+			ns, err := GetDNSServers(c.ResolvConfPath)
+			if err != nil {
+				return errors.New("unable to fetch correct name servers: " + err.Error())
+			}
+			c.NameServers = ns
+		}
+		c.NameServersSpecified = false
+	} else {
+		c.NameServersSpecified = true
+	}
+	if c.RootHintsFilePath != "" && (!c.IterativeResolution || c.NameServersSpecified) {
+		return errors.New("root hints can only be used with iterative resolution, instead of name servers")
+	}
+	switch c.Transport {
+	case TRANSPORT_UDP:
+	case TRANSPORT_TLS:
+		if c.IterativeResolution {
+			return errors.New("DNS-over-TLS is not supported with iterative resolution")
+		}
+		if !c.NameServersSpecified {
+			// resolv.conf servers carry port 53, which won't speak TLS
+			for i, ns := range c.NameServers {
+				host, _, _ := net.SplitHostPort(ns)
+				c.NameServers[i] = net.JoinHostPort(host, "853")
+			}
+		}
+		c.NameServers = SetDefaultPort(c.NameServers, c.DefaultPort())
+		tlsConf, err := NewTLSConfig(c.TLSServerName, c.TLSCAFile, c.TLSInsecureSkipVerify)
+		if err != nil {
+			return errors.New("unable to configure TLS: " + err.Error())
+		}
+		c.TLSConfig = tlsConf
+	case TRANSPORT_HTTPS:
+		if c.IterativeResolution {
+			return errors.New("DNS-over-HTTPS is not supported with iterative resolution")
+		}
+		if !c.NameServersSpecified {
+			return errors.New("DNS-over-HTTPS requires the URL of a DNS-over-HTTPS server as name server")
+		}
+		for _, ns := range c.NameServers {
+			if !strings.HasPrefix(ns, "https://") {
+				return errors.New("DNS-over-HTTPS name servers must be https:// URLs: " + ns)
+			}
+		}
+		method := strings.ToUpper(c.HTTPSMethod)
+		if method != "GET" && method != "POST" {
+			return errors.New("unknown DNS-over-HTTPS method " + c.HTTPSMethod + ". Valid values are GET (default) and POST")
+		}
+		c.HTTPSMethod = method
+		tlsConf, err := NewTLSConfig(c.TLSServerName, c.TLSCAFile, c.TLSInsecureSkipVerify)
+		if err != nil {
+			return errors.New("unable to configure TLS: " + err.Error())
+		}
+		c.TLSConfig = tlsConf
+	default:
+		return errors.New("unknown transport " + c.Transport + ". Valid values are udp (default), tls and https")
+	}
+	if c.ClientSubnetString != "" {
+		subnet, err := ParseClientSubnet(c.ClientSubnetString)
+		if err != nil {
+			return errors.New("invalid client subnet: " + err.Error())
+		}
+		c.ClientSubnet = subnet
+	}
+	if c.ValidateDNSSEC {
+		if !c.IterativeResolution {
+			return errors.New("DNSSEC validation requires iterative resolution")
+		}
+		c.DNSSEC = true
+	} else if c.TrustAnchorsFilePath != "" {
+		return errors.New("trust anchors can only be used with DNSSEC validation")
+	}
+	if c.DNSSEC || c.NSID || c.ClientSubnet != nil {
+		c.EDNS = true
+	}
+	if c.EDNS && (c.UDPBufferSize < dns.MinMsgSize || c.UDPBufferSize > dns.MaxMsgSize) {
+		return errors.New("invalid UDP buffer size. Must be between 512 and 65535")
+	}
+	if c.RateLimit < 0 || c.PerServerRateLimit < 0 {
+		return errors.New("invalid rate limit. Must be >= 0")
+	}
+	if c.TargetedInput && c.AlexaFormat {
+		return errors.New("targeted input and Alexa input cannot be used together")
+	}
+	if c.Shard < 0 || c.Shard >= c.Shards {
+		return errors.New("invalid shard. Must be between 0 and shards - 1")
+	}
+	if c.Resume && c.CheckpointFilePath == "" {
+		return errors.New("resuming a scan requires a checkpoint file")
+	}
+	for _, comp := range []string{c.InputCompression, c.OutputCompression} {
+		if !validCompression(comp) {
+			return errors.New("unknown compression " + comp + ". Valid values are none, gzip, zstd and xz")
+		}
+	}
+	if c.CacheSizeString != "" {
+		if n, err := strconv.Atoi(c.CacheSizeString); err == nil {
+			c.CacheSize = n
+		} else {
+			size, err := ParseSize(c.CacheSizeString)
+			if err != nil {
+				return errors.New("invalid cache size " + c.CacheSizeString + ". Must be a number of entries or a size such as 512MB")
+			}
+			c.CacheBytes = size
+		}
+	}
+	if c.CacheSize <= 0 || c.CacheBytes < 0 {
+		return errors.New("invalid cache size. Must be > 0")
+	}
+	if c.CacheFilePath != "" && !c.IterativeResolution {
+		return errors.New("a cache file can only be used with iterative resolution")
+	}
+	if c.OutputRotateSizeString != "" {
+		size, err := ParseSize(c.OutputRotateSizeString)
+		if err != nil {
+			return err
+		}
+		c.OutputRotateSize = size
+	}
+	if c.OutputRotateSize < 0 || c.OutputRotateInterval < 0 || c.OutputShards < 0 {
+		return errors.New("invalid output rotation or shards. Must be >= 0")
+	}
+	if c.OutputRotateSize > 0 || c.OutputRotateInterval > 0 || c.OutputShards > 1 {
+		if c.OutputHandler != "file" {
+			return errors.New("output rotation and sharding require the file output handler")
+		}
+		if c.OutputFilePath == "" || c.OutputFilePath == "-" {
+			return errors.New("output rotation and sharding require an output file")
+		}
+	}
+	return nil
+}
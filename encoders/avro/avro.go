@@ -0,0 +1,171 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package avro writes results as Avro object container files, which most
+// data warehouses load directly.
+package avro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kwang40/zdns"
+	"github.com/linkedin/goavro/v2"
+)
+
+const FORMAT_AVRO = "avro"
+
+// resultSchema is the schema of every result. The type of its data is
+// filled in by the schema of the module's data (see zdns.AvroModule).
+const resultSchema = `{
+	"type": "record",
+	"name": "Result",
+	"namespace": "zdns",
+	"fields": [
+		{"name": "name", "type": "string"},
+		{"name": "altered_name", "type": "string"},
+		{"name": "nameserver", "type": "string"},
+		{"name": "class", "type": "string"},
+		{"name": "alexa_rank", "type": "long"},
+		{"name": "status", "type": "string"},
+		{"name": "error", "type": "string"},
+		{"name": "timestamp", "type": "string"},
+		{"name": "data", "type": ["null", %s]}
+	]
+}`
+
+// Schema returns the schema of the results of module, whose data is the
+// module's own record, or JSON for modules that do not implement
+// zdns.AvroModule. It also returns the name of the type of the data.
+func Schema(module zdns.GlobalLookupFactory) (string, string, error) {
+	m, ok := module.(zdns.AvroModule)
+	if !ok {
+		return fmt.Sprintf(resultSchema, `"string"`), "string", nil
+	}
+	var data struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal([]byte(m.AvroSchema()), &data); err != nil {
+		return "", "", errors.New("unable to parse module schema: " + err.Error())
+	}
+	name := data.Name
+	if !strings.Contains(name, ".") {
+		if data.Namespace == "" {
+			// names without a namespace are in that of Result
+			data.Namespace = "zdns"
+		}
+		name = data.Namespace + "." + name
+	}
+	return fmt.Sprintf(resultSchema, m.AvroSchema()), name, nil
+}
+
+// results are written in blocks of this many
+const blockSize = 1000
+
+type encoder struct {
+	w      *goavro.OCFWriter
+	module zdns.AvroModule
+	// the union branch of the data of results
+	data  string
+	block []interface{}
+}
+
+// newEncoder starts a new container file. A container cannot be continued
+// by another one, so avro output is never appended to.
+func newEncoder(w io.Writer, conf *zdns.GlobalConf, appending bool) (zdns.Encoder, error) {
+	if appending {
+		return nil, errors.New("avro output cannot be appended to")
+	}
+	module := zdns.GetLookup(conf.Module)
+	schema, data, err := Schema(module)
+	if err != nil {
+		return nil, err
+	}
+	ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               w,
+		Schema:          schema,
+		CompressionName: goavro.CompressionDeflateLabel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	e := &encoder{w: ocf, data: data}
+	e.module, _ = module.(zdns.AvroModule)
+	return e, nil
+}
+
+func (e *encoder) record(res zdns.Result) (interface{}, error) {
+	if res.Data == nil {
+		return nil, nil
+	}
+	if e.module == nil {
+		j, err := json.Marshal(res.Data)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{e.data: string(j)}, nil
+	}
+	r, err := e.module.AvroRecord(res.Data)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{e.data: r}, nil
+}
+
+func (e *encoder) Encode(res zdns.Result) error {
+	data, err := e.record(res)
+	if err != nil {
+		// report the name without the data that could not be encoded, as
+		// the json format does
+		data = nil
+		res.Status = string(zdns.STATUS_ERROR)
+		res.Error = "unable to encode Avro result: " + err.Error()
+	}
+	e.block = append(e.block, map[string]interface{}{
+		"name":         res.Name,
+		"altered_name": res.AlteredName,
+		"nameserver":   res.Nameserver,
+		"class":        res.Class,
+		"alexa_rank":   int64(res.AlexaRank),
+		"status":       res.Status,
+		"error":        res.Error,
+		"timestamp":    res.Timestamp,
+		"data":         data,
+	})
+	if len(e.block) < blockSize {
+		return nil
+	}
+	return e.flush()
+}
+
+func (e *encoder) flush() error {
+	if len(e.block) == 0 {
+		return nil
+	}
+	err := e.w.Append(e.block)
+	e.block = e.block[:0]
+	return err
+}
+
+func (e *encoder) Close() error {
+	return e.flush()
+}
+
+func init() {
+	zdns.RegisterEncoder(FORMAT_AVRO, newEncoder)
+}
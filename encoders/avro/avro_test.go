@@ -0,0 +1,138 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package avro
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/kwang40/zdns"
+	_ "github.com/kwang40/zdns/modules/alookup"
+	_ "github.com/kwang40/zdns/modules/axfr"
+	_ "github.com/kwang40/zdns/modules/dmarc"
+	"github.com/kwang40/zdns/modules/miekg"
+	_ "github.com/kwang40/zdns/modules/mxlookup"
+	_ "github.com/kwang40/zdns/modules/nslookup"
+	_ "github.com/kwang40/zdns/modules/spf"
+	"github.com/linkedin/goavro/v2"
+)
+
+// encode writes results of module and reads them back
+func encode(t *testing.T, module string, results []zdns.Result) []map[string]interface{} {
+	var buf bytes.Buffer
+	enc, err := newEncoder(&buf, &zdns.GlobalConf{Module: module}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if err := enc.Encode(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := goavro.NewOCFReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	for r.Scan() {
+		d, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, d.(map[string]interface{}))
+	}
+	if len(decoded) != len(results) {
+		t.Fatalf("read %d results, expected %d", len(decoded), len(results))
+	}
+	return decoded
+}
+
+func TestEncode(t *testing.T) {
+	a := zdns.MiekgAnswer{Ttl: 300, Type: "A", Class: "IN", Name: "example.com", Answer: "192.0.2.1"}
+	mx := miekg.MXAnswer{
+		Answer:     zdns.MiekgAnswer{Ttl: 300, Type: "MX", Class: "IN", Name: "example.com", Answer: "mx.example.com"},
+		Preference: 10,
+	}
+	svcb := miekg.SVCBAnswer{
+		Answer:   zdns.MiekgAnswer{Ttl: 300, Type: "HTTPS", Class: "IN", Name: "example.com", Answer: ""},
+		Priority: 1,
+		Target:   ".",
+		Params:   map[string]interface{}{"alpn": []string{"h2"}, "port": uint16(443)},
+	}
+	results := []zdns.Result{
+		{Name: "example.com", Status: "NOERROR", Data: zdns.MiekgResult{
+			Answers:    []interface{}{a, mx, svcb},
+			Additional: []interface{}{a},
+			Protocol:   "udp",
+			EDNS:       &zdns.EDNSResult{UDPSize: 1232, DO: true},
+			DNSSEC:     &zdns.DNSSECResult{Status: zdns.DNSSEC_SECURE},
+		}},
+		{Name: "example.net", Status: "TIMEOUT"},
+	}
+	decoded := encode(t, "MX", results)
+	if decoded[0]["name"] != "example.com" || decoded[1]["status"] != "TIMEOUT" || decoded[1]["data"] != nil {
+		t.Errorf("unexpected results %v", decoded)
+	}
+	data := decoded[0]["data"].(map[string]interface{})["zdns.miekg.MiekgResult"].(map[string]interface{})
+	answers := data["answers"].([]interface{})
+	if len(answers) != 3 {
+		t.Fatalf("got %d answers, expected 3", len(answers))
+	}
+	expected := map[string]interface{}{"name": "example.com", "type": "MX", "class": "IN", "ttl": int64(300), "answer": "mx.example.com", "preference": int32(10)}
+	if got := answers[1].(map[string]interface{})["zdns.miekg.MXAnswer"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got MX answer %v, expected %v", got, expected)
+	}
+	params := answers[2].(map[string]interface{})["zdns.miekg.SVCBAnswer"].(map[string]interface{})["params"].(map[string]interface{})
+	if !reflect.DeepEqual(params["port"], map[string]interface{}{"long": int64(443)}) {
+		t.Errorf("unexpected SvcParams %v", params)
+	}
+	edns := data["edns"].(map[string]interface{})["zdns.miekg.EDNS"].(map[string]interface{})
+	dnssec := data["dnssec"].(map[string]interface{})["zdns.miekg.DNSSEC"].(map[string]interface{})
+	if edns["udp_size"] != int32(1232) || dnssec["status"] != "secure" {
+		t.Errorf("unexpected EDNS %v or DNSSEC %v", edns, dnssec)
+	}
+}
+
+func TestEncodeUnexpectedData(t *testing.T) {
+	decoded := encode(t, "MX", []zdns.Result{{Name: "example.com", Status: "NOERROR", Data: "not a result"}})
+	if decoded[0]["status"] != string(zdns.STATUS_ERROR) || decoded[0]["data"] != nil || decoded[0]["error"] == "" {
+		t.Errorf("expected an error without data, got %v", decoded[0])
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	// a module without a schema of its own
+	decoded := encode(t, "", []zdns.Result{{Name: "example.com", Status: "NOERROR", Data: map[string]int{"answer": 1}}})
+	if data := decoded[0]["data"]; !reflect.DeepEqual(data, map[string]interface{}{"string": `{"answer":1}`}) {
+		t.Errorf("unexpected data %v", data)
+	}
+}
+
+func TestModuleSchemas(t *testing.T) {
+	for _, module := range []string{"A", "MX", "ALOOKUP", "AXFR", "DMARC", "MXLOOKUP", "NSLOOKUP", "SPF"} {
+		schema, _, err := Schema(zdns.GetLookup(module))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := goavro.NewCodec(schema); err != nil {
+			t.Errorf("%s: bad schema: %v", module, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+)
+
+// Record is a single record of a result, flattened for the tabular output
+// formats. Section is the part of the result it comes from (e.g. answers or
+// additionals), and Extra holds the fields of the record beyond the common
+// ones as a JSON object.
+type Record struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Class   string `json:"class"`
+	TTL     uint32 `json:"ttl"`
+	Answer  string `json:"answer"`
+	Extra   string `json:"extra"`
+}
+
+// Result data that implements Tabular is written as one row per record by
+// the tabular output formats. Any other data is written as a single record
+// in the data section, with all of its fields in Extra.
+type Tabular interface {
+	Records() []Record
+}
+
+// NewRecord flattens v, an answer or a record of a lookup module, into a
+// Record of section
+func NewRecord(section string, v interface{}) Record {
+	r := Record{Section: section}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return r
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(j, &fields); err != nil {
+		// not an object, e.g. a bare address
+		r.Extra = string(j)
+		return r
+	}
+	// typed answers carry their common fields in a nested Answer
+	if nested, ok := fields["Answer"]; ok {
+		var common map[string]json.RawMessage
+		if err := json.Unmarshal(nested, &common); err == nil {
+			delete(fields, "Answer")
+			for k, v := range common {
+				if _, ok := fields[k]; !ok {
+					fields[k] = v
+				}
+			}
+		}
+	}
+	take := func(key string, dst interface{}) {
+		if v, ok := fields[key]; ok && json.Unmarshal(v, dst) == nil {
+			delete(fields, key)
+		}
+	}
+	take("name", &r.Name)
+	take("type", &r.Type)
+	take("class", &r.Class)
+	take("ttl", &r.TTL)
+	take("answer", &r.Answer)
+	// numeric duplicates of type and class
+	delete(fields, "RrType")
+	delete(fields, "RrClass")
+	if len(fields) > 0 {
+		extra, _ := json.Marshal(fields)
+		r.Extra = string(extra)
+	}
+	return r
+}
+
+// Records returns the records of res.Data
+func (res Result) Records() []Record {
+	if res.Data == nil {
+		return nil
+	}
+	if t, ok := res.Data.(Tabular); ok {
+		return t.Records()
+	}
+	return []Record{NewRecord("data", res.Data)}
+}
+
+func (r MiekgResult) Records() []Record {
+	var records []Record
+	for _, a := range r.Answers {
+		records = append(records, NewRecord("answers", a))
+	}
+	for _, a := range r.Authorities {
+		records = append(records, NewRecord("authorities", a))
+	}
+	for _, a := range r.Additional {
+		records = append(records, NewRecord("additionals", a))
+	}
+	return records
+}
+
+func (r ALookupResult) Records() []Record {
+	var records []Record
+	for _, ip := range r.IPv4Addresses {
+		records = append(records, Record{Section: "ipv4_addresses", Type: "A", Answer: ip})
+	}
+	for _, ip := range r.IPv6Addresses {
+		records = append(records, Record{Section: "ipv6_addresses", Type: "AAAA", Answer: ip})
+	}
+	return records
+}
+
+// jsonEncoder writes one JSON object per line
+type jsonEncoder struct {
+	w io.Writer
+}
+
+func newJSONEncoder(w io.Writer, conf *GlobalConf, appending bool) (Encoder, error) {
+	return &jsonEncoder{w: w}, nil
+}
+
+func (e *jsonEncoder) Encode(res Result) error {
+	j, err := json.Marshal(res)
+	if err != nil {
+		// report the name without the data that could not be encoded
+		res.Data, res.Trace = nil, nil
+		res.Status = string(STATUS_ERROR)
+		res.Error = "unable to marshal JSON result: " + err.Error()
+		j, _ = json.Marshal(res)
+	}
+	_, err = e.w.Write(append(j, '\n'))
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	return nil
+}
+
+// CSVHeader names the columns written by the csv output format
+var CSVHeader = []string{"name", "altered_name", "nameserver", "class", "alexa_rank", "status", "error", "timestamp",
+	"section", "record_name", "record_type", "record_class", "ttl", "answer", "extra"}
+
+// csvEncoder writes a row per record of each result, or a single row with
+// empty record columns for results without records
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer, conf *GlobalConf, appending bool) (Encoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w)}
+	if appending {
+		return e, nil
+	}
+	if err := e.w.Write(CSVHeader); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *csvEncoder) Encode(res Result) error {
+	rank := ""
+	if res.AlexaRank != 0 {
+		rank = strconv.Itoa(res.AlexaRank)
+	}
+	result := []string{res.Name, res.AlteredName, res.Nameserver, res.Class, rank, res.Status, res.Error, res.Timestamp}
+	records := res.Records()
+	if len(records) == 0 {
+		return e.w.Write(append(result, "", "", "", "", "", "", ""))
+	}
+	for _, r := range records {
+		row := append(result[:len(result):len(result)], r.Section, r.Name, r.Type, r.Class, strconv.FormatUint(uint64(r.TTL), 10), r.Answer, r.Extra)
+		if err := e.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func init() {
+	RegisterEncoder(FORMAT_JSON, newJSONEncoder)
+	RegisterEncoder(FORMAT_CSV, newCSVEncoder)
+}
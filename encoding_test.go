@@ -0,0 +1,62 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"testing"
+
+	"github.com/kwang40/zdns"
+	"github.com/kwang40/zdns/modules/miekg"
+)
+
+func TestCSVEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := zdns.NewEncoder(zdns.FORMAT_CSV, &buf, &zdns.GlobalConf{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx := miekg.MXAnswer{
+		Answer:     zdns.MiekgAnswer{Ttl: 300, Type: "MX", RrType: 15, Class: "IN", Name: "example.com", Answer: "mx.example.com"},
+		Preference: 10,
+	}
+	results := []zdns.Result{
+		{Name: "example.com", Status: "NOERROR", Data: zdns.MiekgResult{Answers: []interface{}{mx}}},
+		{Name: "example.net", Status: "TIMEOUT"},
+	}
+	for _, res := range results {
+		if err := enc.Encode(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		zdns.CSVHeader,
+		{"example.com", "", "", "", "", "NOERROR", "", "", "answers", "example.com", "MX", "IN", "300", "mx.example.com", `{"preference":10}`},
+		{"example.net", "", "", "", "", "TIMEOUT", "", "", "", "", "", "", "", "", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("got rows %q, expected %q", rows, expected)
+	}
+}
@@ -15,13 +15,15 @@
 package zdns
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"io"
 	"math/rand"
 	"strings"
 	"sync"
 
 	"github.com/miekg/dns"
-	log "github.com/sirupsen/logrus"
 )
 
 /* Each lookup module registers a single GlobalLookupFactory, which is
@@ -40,26 +42,39 @@ import (
  * should refer to this configuration instead of copying all configuration
  * values for every connection. The Base structs implement these basic
  * pieces of functionality and should be inherited in most situations.
+ *
+ * DoLookups hands every lookup a context that carries the deadline for the
+ * whole name (--timeout) and is cancelled when the scan is stopped. Lookups
+ * must pass it down to every query they send on the wire and return as soon
+ * as it is done, rather than keeping timers of their own.
  */
 
 // one Lookup per IP/name/connection ==========================================
 //
 type Lookup interface {
-	DoLookup(name string) (interface{}, []interface{}, Status, error)
-	DoZonefileLookup(record *dns.Token) (interface{}, Status, error)
+	DoLookup(ctx context.Context, name string) (interface{}, []interface{}, Status, error)
+	DoZonefileLookup(ctx context.Context, record *dns.Token) (interface{}, Status, error)
 }
 
 type BaseLookup struct {
 }
 
-func (base *BaseLookup) DoLookup(name string, class uint16) (interface{}, Status, error) {
-	log.Fatal("Unimplemented DoLookup")
-	return nil, STATUS_ERROR, nil
+func (base *BaseLookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, Status, error) {
+	return nil, nil, STATUS_ERROR, errors.New("unimplemented DoLookup")
+}
+
+func (base *BaseLookup) DoZonefileLookup(ctx context.Context, record *dns.Token) (interface{}, Status, error) {
+	return nil, STATUS_ERROR, errors.New("unimplemented DoZonefileLookup")
 }
 
-func (base *BaseLookup) DoZonefileLookup(record *dns.Token) (interface{}, Status, error) {
-	log.Fatal("Unimplemented DoZonefileLookup")
-	return nil, STATUS_ERROR, nil
+// Lookups that implement TargetedLookup can be pointed at the name servers
+// that targeted input gives for a name (see GlobalConf.TargetedInput). The
+// name servers are set after MakeLookup and before DoLookup, which tries the
+// next of them on every retry. Only the input name is looked up from them.
+// LastNameServer returns the one the last attempt went to.
+type TargetedLookup interface {
+	SetNameServers(nameServers []string)
+	LastNameServer() string
 }
 
 // one RoutineLookupFactory per goroutine =====================================
@@ -68,6 +83,19 @@ type RoutineLookupFactory interface {
 	MakeLookup() (Lookup, error)
 }
 
+// RoutineLookupFactories that implement RoutineCloser hold connections open
+// between lookups (e.g., DNS-over-TLS). Close is called once the goroutine
+// that owns the factory is done with it.
+type RoutineCloser interface {
+	Close()
+}
+
+func closeRoutineFactory(f RoutineLookupFactory) {
+	if c, ok := f.(RoutineCloser); ok {
+		c.Close()
+	}
+}
+
 // one RoutineLookupFactory per execution =====================================
 //
 type GlobalLookupFactory interface {
@@ -87,23 +115,77 @@ type GlobalLookupFactory interface {
 	Help() string
 	// Return a single scanner which will scan a single host
 	MakeRoutineFactory(int) (RoutineLookupFactory, error)
-	RandomNameServer() string
+	RandomNameServer() (string, error)
+}
+
+// GlobalLookupFactories that implement MetadataProvider add what Metadata
+// returns to the "module" section of the metadata file once the scan is done,
+// and OutputHandlers to the "output" section
+type MetadataProvider interface {
+	Metadata() interface{}
 }
 
 // handle domain input
 type InputHandler interface {
-	// give the InputHandler access to the global config in case it needs any of the settings
-	Initialize(conf *GlobalConf)
-	// FeedChannel takes a channel to write domains to, the WaitGroup managing them, and if it's a zonefile input
-	FeedChannel(in chan<- interface{}, wg *sync.WaitGroup, zonefileInput bool) error
+	// give the InputHandler access to the global config in case it needs any of the settings.
+	// An error, e.g. for input that cannot be read, is reported before the scan starts.
+	Initialize(conf *GlobalConf) error
+	// FeedChannel takes a channel to write domains to, the WaitGroup managing them, and if it's a zonefile input.
+	// stop is closed once the rest of the input is no longer wanted, e.g. when the scan is interrupted, and
+	// FeedChannel then returns without writing it. An error ends the scan.
+	FeedChannel(in chan<- interface{}, wg *sync.WaitGroup, zonefileInput bool, stop <-chan struct{}) error
 }
 
 // handle output results
 type OutputHandler interface {
-	// give the OutputHandler access to the global config in case it needs any of the settings
-	Initialize(conf *GlobalConf)
-	// takes a channel (results) to write the query results to, and the WaitGroup managing the handlers
-	WriteResults(results <-chan string, wg *sync.WaitGroup, stdOutput bool) error
+	// give the OutputHandler access to the global config in case it needs any of the settings.
+	// An error, e.g. for settings the handler cannot write, is reported before the scan starts.
+	Initialize(conf *GlobalConf) error
+	// takes a channel (results) to write the query results to, and the WaitGroup managing the handlers.
+	// Handlers that write a stream of results encode them with the Encoder
+	// returned by NewEncoder for GlobalConf.OutputFormat. An error ends the scan.
+	WriteResults(results <-chan Result, wg *sync.WaitGroup) error
+}
+
+// Encoder writes results to a stream in some output format
+type Encoder interface {
+	Encode(res Result) error
+	// Close writes out anything the encoder has buffered. It does not close
+	// the underlying writer.
+	Close() error
+}
+
+// EncoderMaker starts an output stream on w for the results of the scan
+// configured by conf. appending is set when w continues the output of an
+// earlier run, so that no header is written again. Formats that cannot be
+// appended to return an error.
+type EncoderMaker func(w io.Writer, conf *GlobalConf, appending bool) (Encoder, error)
+
+// Lookup modules that implement AvroModule are written by the avro output
+// format with a schema of their own. Other modules have the data of their
+// results written as JSON.
+type AvroModule interface {
+	// AvroSchema returns the Avro schema of the data of the module's
+	// results, a named record
+	AvroSchema() string
+	// AvroRecord converts the data of a result to that schema, in the
+	// native form of goavro (e.g. maps for records, int64 for longs)
+	AvroRecord(data interface{}) (interface{}, error)
+}
+
+// OutputHandlers that implement ResumeChecker are asked whether they can
+// append to the output of the scan that is being resumed. clean is false if
+// that scan did not shut down cleanly, so its output may end in the middle
+// of a result (see Checkpoint).
+type ResumeChecker interface {
+	CheckResume(clean bool) error
+}
+
+// OutputHandlers that implement ConfAdjuster can change the settings that
+// determine what goes into results (e.g., turn on Trace) before the scan
+// starts. AdjustConf is called by GlobalConf.Prepare.
+type ConfAdjuster interface {
+	AdjustConf(conf *GlobalConf)
 }
 
 type BaseGlobalLookupFactory struct {
@@ -126,15 +208,15 @@ func (s *BaseGlobalLookupFactory) Help() string {
 	return ""
 }
 
-func (f *BaseGlobalLookupFactory) RandomNameServer() string {
+func (f *BaseGlobalLookupFactory) RandomNameServer() (string, error) {
 	if f.GlobalConf == nil {
-		log.Fatal("no global conf initialized")
+		return "", errors.New("no global conf initialized")
 	}
 	l := len(f.GlobalConf.NameServers)
 	if l == 0 {
-		log.Fatal("No name servers specified")
+		return "", errors.New("no name servers specified")
 	}
-	return f.GlobalConf.NameServers[rand.Intn(l)]
+	return f.GlobalConf.NameServers[rand.Intn(l)], nil
 }
 
 func (s *BaseGlobalLookupFactory) AllowStdIn() bool {
@@ -148,12 +230,18 @@ func (s *BaseGlobalLookupFactory) ZonefileInput() bool {
 // keep a mapping from name to factory
 var lookups map[string]GlobalLookupFactory
 
+// make lookup modules for names that no module is registered under
+var lookupMakers []func(name string) GlobalLookupFactory
+
 // keep a mapping from name to input handler
 var inputHandlers map[string]InputHandler
 
 // keep a mapping from name to output handler
 var outputHandlers map[string]OutputHandler
 
+// keep a mapping from output format to encoder
+var encoders map[string]EncoderMaker
+
 func RegisterLookup(name string, s GlobalLookupFactory) {
 	if lookups == nil {
 		lookups = make(map[string]GlobalLookupFactory, 100)
@@ -161,6 +249,13 @@ func RegisterLookup(name string, s GlobalLookupFactory) {
 	lookups[name] = s
 }
 
+// RegisterLookupMaker registers f to make lookup modules on demand for names
+// that no module is registered under (e.g., a generic lookup of TYPE65). f
+// returns nil for names it does not know.
+func RegisterLookupMaker(f func(name string) GlobalLookupFactory) {
+	lookupMakers = append(lookupMakers, f)
+}
+
 func RegisterInputHandler(name string, h InputHandler) {
 	if inputHandlers == nil {
 		inputHandlers = make(map[string]InputHandler)
@@ -175,6 +270,23 @@ func RegisterOutputHandler(name string, h OutputHandler) {
 	outputHandlers[name] = h
 }
 
+func RegisterEncoder(format string, f EncoderMaker) {
+	if encoders == nil {
+		encoders = make(map[string]EncoderMaker)
+	}
+	encoders[format] = f
+}
+
+// NewEncoder starts an output stream in format on w for the results of the
+// scan configured by conf, after the output of an earlier run if appending
+func NewEncoder(format string, w io.Writer, conf *GlobalConf, appending bool) (Encoder, error) {
+	f, ok := encoders[format]
+	if !ok {
+		return nil, errors.New("unknown output format " + format)
+	}
+	return f(w, conf, appending)
+}
+
 func ValidlookupsString() string {
 	valid := make([]string, len(lookups))
 	i := 0
@@ -188,10 +300,15 @@ func ValidlookupsString() string {
 func GetLookup(name string) GlobalLookupFactory {
 
 	factory, ok := lookups[name]
-	if !ok {
-		return nil
+	if ok {
+		return factory
 	}
-	return factory
+	for _, maker := range lookupMakers {
+		if factory := maker(name); factory != nil {
+			return factory
+		}
+	}
+	return nil
 }
 
 func GetInputHandler(name string) InputHandler {
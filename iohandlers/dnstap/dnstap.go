@@ -0,0 +1,196 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package dnstap writes the queries and responses of a scan as dnstap
+// (http://dnstap.info) messages in Frame Streams format.
+package dnstap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/golang/protobuf/proto"
+	"github.com/kwang40/zdns"
+	"github.com/kwang40/zdns/modules/miekg"
+)
+
+// UnixPrefix marks an output path as a unix socket to connect to
+const UnixPrefix = "unix:"
+
+// OutputHandler writes a TOOL_QUERY message for every query sent during the
+// scan and a TOOL_RESPONSE message for every response received. It reads
+// them from the exchanges of the trace steps of results, so it turns on
+// tracing and raw responses.
+type OutputHandler struct {
+	filepath string
+}
+
+func (h *OutputHandler) AdjustConf(conf *zdns.GlobalConf) {
+	conf.Trace = true
+	conf.RawResponse = true
+}
+
+func (h *OutputHandler) Initialize(conf *zdns.GlobalConf) error {
+	h.filepath = conf.OutputFilePath
+	if conf.Resume && h.filepath != "" && h.filepath != "-" && !strings.HasPrefix(h.filepath, UnixPrefix) {
+		// a second frame stream can't be appended to the first one
+		return errors.New("dnstap output files cannot be resumed")
+	}
+	return nil
+}
+
+func (h *OutputHandler) WriteResults(results <-chan zdns.Result, wg *sync.WaitGroup) error {
+	defer (*wg).Done()
+
+	var w io.Writer
+	bidirectional := false
+	switch {
+	case strings.HasPrefix(h.filepath, UnixPrefix):
+		conn, err := net.Dial("unix", strings.TrimPrefix(h.filepath, UnixPrefix))
+		if err != nil {
+			return errors.New("unable to connect to dnstap socket: " + err.Error())
+		}
+		defer conn.Close()
+		w = conn
+		bidirectional = true
+	case h.filepath == "" || h.filepath == "-":
+		w = os.Stdout
+	default:
+		f, err := os.Create(h.filepath)
+		if err != nil {
+			return errors.New("unable to open output file: " + err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+	enc, err := framestream.NewEncoder(w, &framestream.EncoderOptions{
+		ContentType:   dnstap.FSContentType,
+		Bidirectional: bidirectional,
+	})
+	if err != nil {
+		return errors.New("unable to start dnstap output: " + err.Error())
+	}
+	for res := range results {
+		frames, err := Frames(res)
+		if err != nil {
+			return errors.New("unable to convert result to dnstap: " + err.Error())
+		}
+		for _, frame := range frames {
+			if _, err := enc.Write(frame); err != nil {
+				return errors.New("unable to write output: " + err.Error())
+			}
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return errors.New("unable to write output: " + err.Error())
+	}
+	return nil
+}
+
+// Frames returns the encoded dnstap messages for the exchanges in the trace
+// of res. Results without a trace, such as those of modules that do not send
+// queries themselves, have none.
+func Frames(res zdns.Result) ([][]byte, error) {
+	var frames [][]byte
+	for _, t := range res.Trace {
+		s, ok := t.(miekg.TraceStep)
+		if !ok {
+			continue
+		}
+		for _, e := range s.Exchanges {
+			for _, m := range messages(s.NameServer, e) {
+				frame, err := proto.Marshal(&dnstap.Dnstap{
+					Type:    dnstap.Dnstap_MESSAGE.Enum(),
+					Version: []byte("zdns"),
+					Message: m,
+				})
+				if err != nil {
+					return nil, err
+				}
+				frames = append(frames, frame)
+			}
+		}
+	}
+	return frames, nil
+}
+
+// messages builds the query message of e and, if a response was received,
+// the response message
+func messages(nameServer string, e miekg.Exchange) []*dnstap.Message {
+	if e.Query == nil {
+		return nil
+	}
+	sent := e.Time
+	received := sent.Add(time.Duration(e.RTT * float64(time.Millisecond)))
+
+	q := newMessage(dnstap.Message_TOOL_QUERY, nameServer, e.Protocol)
+	q.QueryTimeSec, q.QueryTimeNsec = timestamp(sent)
+	q.QueryMessage = e.Query
+	if e.Response == nil {
+		return []*dnstap.Message{q}
+	}
+	r := newMessage(dnstap.Message_TOOL_RESPONSE, nameServer, e.Protocol)
+	r.QueryTimeSec, r.QueryTimeNsec = timestamp(sent)
+	r.ResponseTimeSec, r.ResponseTimeNsec = timestamp(received)
+	r.ResponseMessage = e.Response
+	return []*dnstap.Message{q, r}
+}
+
+// newMessage fills in the socket fields, which are left out for name
+// servers that are not host:port pairs (e.g., DNS-over-HTTPS URLs)
+func newMessage(t dnstap.Message_Type, nameServer string, protocol string) *dnstap.Message {
+	m := &dnstap.Message{Type: t.Enum()}
+	if protocol == "udp" {
+		m.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+	} else {
+		// DNS-over-TLS and DNS-over-HTTPS run over TCP
+		m.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+	}
+	host, port, err := net.SplitHostPort(nameServer)
+	if err != nil {
+		return m
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return m
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		m.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		m.ResponseAddress = ip4
+	} else {
+		m.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		m.ResponseAddress = ip
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		m.ResponsePort = proto.Uint32(uint32(p))
+	}
+	return m
+}
+
+func timestamp(t time.Time) (*uint64, *uint32) {
+	return proto.Uint64(uint64(t.Unix())), proto.Uint32(uint32(t.Nanosecond()))
+}
+
+// register handlers
+func init() {
+	zdns.RegisterOutputHandler("dnstap", new(OutputHandler))
+}
@@ -0,0 +1,102 @@
+package dnstap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/golang/protobuf/proto"
+	"github.com/kwang40/zdns"
+	"github.com/kwang40/zdns/modules/miekg"
+)
+
+func tracedResult() zdns.Result {
+	sent := time.Date(2020, 1, 2, 3, 4, 7, 0, time.UTC)
+	return zdns.Result{Name: "example.com", Status: "NOERROR", Trace: []interface{}{
+		miekg.TraceStep{NameServer: "192.0.2.1:53", Exchanges: []miekg.Exchange{
+			{Attempt: 1, Protocol: "udp", Time: sent.Add(-1500 * time.Millisecond), Error: "i/o timeout", Query: []byte{0, 1}},
+			{Attempt: 2, Protocol: "udp", Time: sent, RTT: 1500, Query: []byte{0, 2}, Response: []byte{0, 2, 0x80}},
+		}},
+		miekg.TraceStep{NameServer: "192.0.2.2:53", Cached: true},
+	}}
+}
+
+func TestWriteResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.fstrm")
+
+	h := new(OutputHandler)
+	if err := h.Initialize(&zdns.GlobalConf{OutputFilePath: path}); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan zdns.Result, 1)
+	results <- tracedResult()
+	close(results)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	if err := h.WriteResults(results, &wg); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dec, err := framestream.NewDecoder(f, &framestream.DecoderOptions{ContentType: dnstap.FSContentType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*dnstap.Message
+	for {
+		frame, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var d dnstap.Dnstap
+		if err := proto.Unmarshal(frame, &d); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, d.Message)
+	}
+
+	// the first attempt timed out, so only the second one has a response
+	types := []dnstap.Message_Type{dnstap.Message_TOOL_QUERY, dnstap.Message_TOOL_QUERY, dnstap.Message_TOOL_RESPONSE}
+	if len(msgs) != len(types) {
+		t.Fatalf("got %d messages, expected %d", len(msgs), len(types))
+	}
+	for i, m := range msgs {
+		if m.GetType() != types[i] {
+			t.Errorf("message %d has type %v, expected %v", i, m.GetType(), types[i])
+		}
+		if m.GetSocketProtocol() != dnstap.SocketProtocol_UDP || m.GetSocketFamily() != dnstap.SocketFamily_INET {
+			t.Errorf("message %d has socket %v/%v", i, m.GetSocketFamily(), m.GetSocketProtocol())
+		}
+		if !bytes.Equal(m.ResponseAddress, []byte{192, 0, 2, 1}) || m.GetResponsePort() != 53 {
+			t.Errorf("message %d was sent to %v port %d", i, m.ResponseAddress, m.GetResponsePort())
+		}
+	}
+	if !bytes.Equal(msgs[1].QueryMessage, []byte{0, 2}) {
+		t.Errorf("unexpected query message %v", msgs[1].QueryMessage)
+	}
+	r := msgs[2]
+	if !bytes.Equal(r.ResponseMessage, []byte{0, 2, 0x80}) {
+		t.Errorf("unexpected response message %v", r.ResponseMessage)
+	}
+	if r.GetQueryTimeSec() != 1577934247 || r.GetResponseTimeSec() != 1577934248 || r.GetResponseTimeNsec() != 5e8 {
+		t.Errorf("unexpected times %d, %d.%09d", r.GetQueryTimeSec(), r.GetResponseTimeSec(), r.GetResponseTimeNsec())
+	}
+}
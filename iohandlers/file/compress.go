@@ -0,0 +1,94 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package file
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/kwang40/zdns"
+	"github.com/ulikunitz/xz"
+)
+
+// compression returns c, or if c is empty, the compression that the
+// extension of path stands for
+func compression(c string, path string) string {
+	if c != "" {
+		return c
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz", ".gzip":
+		return zdns.COMPRESSION_GZIP
+	case ".zst", ".zstd":
+		return zdns.COMPRESSION_ZSTD
+	case ".xz":
+		return zdns.COMPRESSION_XZ
+	}
+	return zdns.COMPRESSION_NONE
+}
+
+// newReader decompresses r. Concatenated streams, such as those of resumed
+// scans, are read one after the other.
+func newReader(r io.Reader, c string) (io.ReadCloser, error) {
+	switch c {
+	case zdns.COMPRESSION_NONE:
+		return ioutil.NopCloser(r), nil
+	case zdns.COMPRESSION_GZIP:
+		return gzip.NewReader(r)
+	case zdns.COMPRESSION_ZSTD:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case zdns.COMPRESSION_XZ:
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(x), nil
+	}
+	return nil, errors.New("unknown compression " + c)
+}
+
+// nopWriteCloser leaves uncompressed output unbuffered
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newWriter compresses what is written to w. Closing the returned writer
+// flushes the compressed stream, but does not close w.
+func newWriter(w io.Writer, c string) (io.WriteCloser, error) {
+	switch c {
+	case zdns.COMPRESSION_NONE:
+		return nopWriteCloser{w}, nil
+	case zdns.COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case zdns.COMPRESSION_ZSTD:
+		return zstd.NewWriter(w)
+	case zdns.COMPRESSION_XZ:
+		return xz.NewWriter(w)
+	}
+	return nil, errors.New("unknown compression " + c)
+}
@@ -0,0 +1,149 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/kwang40/zdns"
+)
+
+// write runs an output handler on the results named by names
+func write(t *testing.T, conf *zdns.GlobalConf, names ...string) *FileOutputHandler {
+	h := new(FileOutputHandler)
+	if err := h.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan zdns.Result, len(names))
+	for _, n := range names {
+		results <- zdns.Result{Name: n, Status: "NOERROR"}
+	}
+	close(results)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	if err := h.WriteResults(results, &wg); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// read returns the names of the results read back by the input handler
+func read(t *testing.T, conf *zdns.GlobalConf) []string {
+	h := new(FileInputHandler)
+	if err := h.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	errc := make(chan error, 1)
+	go func() { errc <- h.FeedChannel(in, &wg, false, nil) }()
+	var names []string
+	for line := range in {
+		var res zdns.Result
+		if err := json.Unmarshal([]byte(line.(string)), &res); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, res.Name)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestCompressedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ext := range []string{".gz", ".zst", ".xz"} {
+		path := filepath.Join(dir, "out.json"+ext)
+		conf := &zdns.GlobalConf{InputFilePath: path, OutputFilePath: path, OutputFormat: zdns.FORMAT_JSON}
+		write(t, conf, "a.com", "b.com")
+		// resuming appends a second stream
+		conf.Resume = true
+		write(t, conf, "c.com")
+
+		names := read(t, conf)
+		if len(names) != 3 || names[0] != "a.com" || names[2] != "c.com" {
+			t.Errorf("%s: read back %v", ext, names)
+		}
+		if compressed, err := ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		} else if compressed[0] == '{' {
+			t.Errorf("%s: output is not compressed", ext)
+		}
+	}
+}
+
+func TestCheckResume(t *testing.T) {
+	for _, c := range []struct {
+		path   string
+		rotate bool
+		clean  bool
+		ok     bool
+	}{
+		{"out.json.gz", false, true, true},
+		{"out.json.gz", false, false, false},
+		{"out.json.zst", false, false, false},
+		{"out.json", false, false, true},
+		{"out.json.gz", true, false, true},
+	} {
+		conf := &zdns.GlobalConf{OutputFilePath: c.path, OutputFormat: zdns.FORMAT_JSON, Resume: true}
+		if c.rotate {
+			conf.OutputRotateSize = 1 << 20
+		}
+		h := new(FileOutputHandler)
+		if err := h.Initialize(conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.CheckResume(c.clean); (err == nil) != c.ok {
+			t.Errorf("%s (rotated %v, clean %v): unexpected result %v", c.path, c.rotate, c.clean, err)
+		}
+	}
+}
+
+func TestFeedChannelStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		name     string
+		content  string
+		zonefile bool
+	}{
+		{"names.txt", "a.com\nb.com\nc.com\n", false},
+		{"zone.txt", "a.com. 300 IN A 192.0.2.1\nb.com. 300 IN A 192.0.2.2\nc.com. 300 IN A 192.0.2.3\n", true},
+	} {
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h := new(FileInputHandler)
+		if err := h.Initialize(&zdns.GlobalConf{InputFilePath: path}); err != nil {
+			t.Fatal(err)
+		}
+		in := make(chan interface{})
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		errc := make(chan error, 1)
+		go func() { errc <- h.FeedChannel(in, &wg, c.zonefile, stop) }()
+		<-in
+		// the rest of the input is never read
+		close(stop)
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+	}
+}
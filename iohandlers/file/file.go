@@ -2,23 +2,36 @@ package file
 
 import (
 	"bufio"
+	"errors"
+	"io/ioutil"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
-	log "github.com/sirupsen/logrus"
 	"github.com/kwang40/zdns"
 )
 
 type FileInputHandler struct {
-	filepath string
+	filepath    string
+	compression string
 }
 
-func (h *FileInputHandler) Initialize(conf *zdns.GlobalConf) {
+func (h *FileInputHandler) Initialize(conf *zdns.GlobalConf) error {
 	h.filepath = conf.InputFilePath
+	h.compression = compression(conf.InputCompression, conf.InputFilePath)
+	if h.filepath != "" && h.filepath != "-" {
+		if _, err := os.Stat(h.filepath); err != nil {
+			return errors.New("unable to open input file: " + err.Error())
+		}
+	}
+	return nil
 }
 
-func (h *FileInputHandler) FeedChannel(in chan<- interface{}, wg *sync.WaitGroup, zonefileInput bool) error {
+// FeedChannel stops reading once stop is closed. Input from stdin is only
+// seen to be stopped once its next line arrives, or for zone files once it
+// ends.
+func (h *FileInputHandler) FeedChannel(in chan<- interface{}, wg *sync.WaitGroup, zonefileInput bool, stop <-chan struct{}) error {
 	defer close(in)
 	defer (*wg).Done()
 
@@ -29,59 +42,149 @@ func (h *FileInputHandler) FeedChannel(in chan<- interface{}, wg *sync.WaitGroup
 		var err error
 		f, err = os.Open(h.filepath)
 		if err != nil {
-			log.Fatal("unable to open input file:", err.Error())
+			return errors.New("unable to open input file: " + err.Error())
 		}
+		defer f.Close()
+	}
+	r, err := newReader(f, h.compression)
+	if err != nil {
+		return errors.New("unable to decompress input file: " + err.Error())
 	}
+	defer r.Close()
 	if zonefileInput {
-		tokens := dns.ParseZone(f, ".", h.filepath)
+		tokens := dns.ParseZone(r, ".", h.filepath)
 		for t := range tokens {
-			in <- t
+			select {
+			case in <- t:
+			case <-stop:
+				// the parser runs until its tokens are read, which
+				// ends with an error once the file is closed
+				if f != os.Stdin {
+					f.Close()
+				}
+				for range tokens {
+				}
+				return nil
+			}
 		}
 	} else {
-		s := bufio.NewScanner(f)
+		s := bufio.NewScanner(r)
 		for s.Scan() {
-			in <- s.Text()
+			select {
+			case in <- s.Text():
+			case <-stop:
+				return nil
+			}
 		}
 		if err := s.Err(); err != nil {
-			log.Fatal("input unable to read file", err)
+			return errors.New("unable to read input file: " + err.Error())
 		}
 	}
 	return nil
 }
 
 type FileOutputHandler struct {
-	filepath string
+	conf           *zdns.GlobalConf
+	filepath       string
+	format         string
+	compression    string
+	resume         bool
+	rotateSize     int64
+	rotateInterval time.Duration
+	shards         int
+	timeFormat     string
+	sealed         []SealedFile
 }
 
-func (h *FileOutputHandler) Initialize(conf *zdns.GlobalConf) {
+func (h *FileOutputHandler) Initialize(conf *zdns.GlobalConf) error {
+	h.conf = conf
 	h.filepath = conf.OutputFilePath
+	h.format = conf.OutputFormat
+	h.compression = compression(conf.OutputCompression, conf.OutputFilePath)
+	h.resume = conf.Resume
+	h.rotateSize = conf.OutputRotateSize
+	h.rotateInterval = conf.OutputRotateInterval
+	h.shards = conf.OutputShards
+	h.timeFormat = conf.TimeFormat
+	h.sealed = nil
+	// fail before the scan if results cannot be encoded, e.g. because the
+	// module has no usable schema
+	enc, err := zdns.NewEncoder(h.format, ioutil.Discard, conf, false)
+	if err != nil {
+		return errors.New("unable to write " + h.format + " output: " + err.Error())
+	}
+	return enc.Close()
 }
 
-func (h *FileOutputHandler) WriteResults(results <-chan string, wg *sync.WaitGroup, stdOutput bool) error {
+func (h *FileOutputHandler) WriteResults(results <-chan zdns.Result, wg *sync.WaitGroup) error {
 	defer (*wg).Done()
 
+	if h.rotating() || h.shards > 1 {
+		return h.writeSplit(results)
+	}
 	var f *os.File
-	if stdOutput || h.filepath == "" || h.filepath == "-" {
+	if h.filepath == "" || h.filepath == "-" {
 		f = os.Stdout
 	} else {
 		var err error
-		f, err = os.OpenFile(h.filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if h.resume {
+			// keep the results of the interrupted scan. A compressed
+			// stream is appended after the one already in the file,
+			// which CheckResume made sure is complete.
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err = os.OpenFile(h.filepath, flags, 0644)
 		if err != nil {
-			log.Fatal("unable to open output file:", err.Error())
+			return errors.New("unable to open output file: " + err.Error())
 		}
 		defer f.Close()
 	}
-	for n := range results {
-		if _, err := f.WriteString(n + "\n"); err != nil {
-			if stdOutput {
-				log.Fatal("Problem at stdout channel")
-			}
-			log.Fatal("Problem writing", n, err.Error())
+	o, err := h.start(f)
+	if err != nil {
+		return err
+	}
+	for res := range results {
+		if err := o.enc.Encode(res); err != nil {
+			return errors.New("unable to write output: " + err.Error())
 		}
 	}
-	return nil
+	return o.finish()
 }
 
+// CheckResume refuses to resume a scan whose output cannot be continued.
+// Formats other than json buffer results that the checkpoint already counts
+// as done, so they are lost if the previous run did not shut down cleanly.
+// Compressed output that the previous run did not finish may also end in a
+// stream cut short, after which an appended stream could not be read.
+// Rotated files are never appended to, but other output is only appended to
+// in formats that allow it.
+func (h *FileOutputHandler) CheckResume(clean bool) error {
+	stdout := h.filepath == "" || h.filepath == "-"
+	if !h.rotating() && !stdout {
+		if _, err := zdns.NewEncoder(h.format, ioutil.Discard, h.conf, true); err != nil {
+			return errors.New("unable to resume the scan writing " + h.filepath + ": " + err.Error())
+		}
+	}
+	if clean {
+		return nil
+	}
+	if h.format != zdns.FORMAT_JSON {
+		return errors.New("the previous scan did not shut down cleanly, so " + h.format + " results it buffered may be lost and it cannot be resumed")
+	}
+	if h.compression == zdns.COMPRESSION_NONE || h.rotating() || stdout {
+		return nil
+	}
+	return errors.New("the scan writing " + h.filepath + " did not shut down cleanly, so its compressed output may be truncated and cannot be resumed")
+}
+
+// Metadata lists the files written when output is rotated or sharded
+func (h *FileOutputHandler) Metadata() interface{} {
+	if !h.rotating() && h.shards <= 1 {
+		return nil
+	}
+	return OutputMetadata{Files: h.sealed}
+}
 
 // register handlers
 func init() {
@@ -0,0 +1,161 @@
+package file
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kwang40/zdns"
+	_ "github.com/kwang40/zdns/encoders/avro"
+	"github.com/linkedin/goavro/v2"
+)
+
+// resume checks that a scan writing conf may be resumed and writes names
+func resume(t *testing.T, conf *zdns.GlobalConf, names ...string) *FileOutputHandler {
+	conf.Resume = true
+	h := new(FileOutputHandler)
+	if err := h.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CheckResume(true); err != nil {
+		t.Fatal(err)
+	}
+	return write(t, conf, names...)
+}
+
+// readCSV returns the rows of the csv output file at path
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := newReader(f, compression("", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestResumeCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"out.csv", "out.csv.gz"} {
+		path := filepath.Join(dir, name)
+		conf := &zdns.GlobalConf{OutputFilePath: path, OutputFormat: zdns.FORMAT_CSV}
+		write(t, conf, "a.com", "b.com")
+		resume(t, conf, "c.com")
+
+		var names []string
+		rows := readCSV(t, path)
+		if len(rows) == 0 || !reflect.DeepEqual(rows[0], zdns.CSVHeader) {
+			t.Fatalf("%s: output does not start with the header: %q", name, rows)
+		}
+		for _, row := range rows[1:] {
+			names = append(names, row[0])
+		}
+		if !reflect.DeepEqual(names, []string{"a.com", "b.com", "c.com"}) {
+			t.Errorf("%s: expected the header once followed by every result, got %q", name, rows)
+		}
+	}
+
+	// sharded output appends to every shard file
+	conf := &zdns.GlobalConf{OutputFilePath: filepath.Join(dir, "sharded.csv"), OutputFormat: zdns.FORMAT_CSV, OutputShards: 2}
+	h := write(t, conf, "a.com", "b.com", "c.com", "d.com")
+	resume(t, conf, "e.com", "f.com", "g.com", "h.com")
+	results := 0
+	for shard := 0; shard < 2; shard++ {
+		rows := readCSV(t, h.path(shard, 0))
+		for i, row := range rows {
+			if (i == 0) != reflect.DeepEqual(row, zdns.CSVHeader) {
+				t.Errorf("shard %d: unexpected row %d %q", shard, i, row)
+			}
+		}
+		results += len(rows) - 1
+	}
+	if results != 8 {
+		t.Errorf("shard files hold %d results, expected 8", results)
+	}
+}
+
+func TestResumeAvro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a container file cannot be appended to
+	conf := &zdns.GlobalConf{OutputFilePath: filepath.Join(dir, "out.avro"), OutputFormat: "avro", Resume: true}
+	h := new(FileOutputHandler)
+	if err := h.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CheckResume(true); err == nil {
+		t.Error("expected appending to avro output to be refused")
+	}
+
+	// rotated output continues in a new file
+	conf = &zdns.GlobalConf{OutputFilePath: filepath.Join(dir, "rotated.avro"), OutputFormat: "avro", OutputRotateSize: 1 << 20}
+	sealed := write(t, conf, "a.com", "b.com").Metadata().(OutputMetadata).Files
+	sealed = append(sealed, resume(t, conf, "c.com").Metadata().(OutputMetadata).Files...)
+	var names []string
+	for _, s := range sealed {
+		f, err := os.Open(s.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := goavro.NewOCFReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Scan() {
+			d, err := r.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, d.(map[string]interface{})["name"].(string))
+		}
+		f.Close()
+	}
+	if len(sealed) != 2 || !reflect.DeepEqual(names, []string{"a.com", "b.com", "c.com"}) {
+		t.Errorf("expected two files with every result, got %v with %v", sealed, names)
+	}
+}
+
+func TestResumeUnclean(t *testing.T) {
+	for _, c := range []struct {
+		format string
+		rotate bool
+		ok     bool
+	}{
+		{zdns.FORMAT_JSON, false, true},
+		{zdns.FORMAT_CSV, false, false},
+		{zdns.FORMAT_CSV, true, false},
+		{"avro", true, false},
+	} {
+		conf := &zdns.GlobalConf{OutputFilePath: "out", OutputFormat: c.format, Resume: true}
+		if c.rotate {
+			conf.OutputRotateSize = 1 << 20
+		}
+		h := new(FileOutputHandler)
+		if err := h.Initialize(conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.CheckResume(false); (err == nil) != c.ok {
+			t.Errorf("%s (rotated %v): unexpected result %v", c.format, c.rotate, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kwang40/zdns"
+)
+
+// partialSuffix marks output files that are still being written. They are
+// renamed to their final name once sealed.
+const partialSuffix = ".partial"
+
+// SealedFile describes an output file that has been completed. Files are
+// sealed when they reach the rotation size or interval, and when the scan
+// ends.
+type SealedFile struct {
+	Path    string `json:"path"`
+	Shard   int    `json:"shard"`
+	Results int    `json:"results"`
+	Bytes   int64  `json:"bytes"`
+	Opened  string `json:"opened"`
+	Sealed  string `json:"sealed"`
+}
+
+// OutputMetadata is the output section of the metadata of rotated or
+// sharded output
+type OutputMetadata struct {
+	Files []SealedFile `json:"files"`
+}
+
+// countingWriter counts the bytes written to the file, after compression
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// outputFile is a stream of encoded and compressed results written to f
+type outputFile struct {
+	f        *os.File
+	counter  *countingWriter
+	w        io.WriteCloser
+	enc      zdns.Encoder
+	results  int
+	opened   time.Time
+	deadline time.Time
+}
+
+// start begins an output stream on f, after the output already in it when
+// a resumed scan appends to it
+func (h *FileOutputHandler) start(f *os.File) (*outputFile, error) {
+	appending := false
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+		appending = true
+	}
+	counter := &countingWriter{w: f}
+	w, err := newWriter(counter, h.compression)
+	if err != nil {
+		return nil, errors.New("unable to compress output: " + err.Error())
+	}
+	enc, err := zdns.NewEncoder(h.format, w, h.conf, appending)
+	if err != nil {
+		return nil, errors.New("unable to start output: " + err.Error())
+	}
+	o := &outputFile{f: f, counter: counter, w: w, enc: enc, opened: time.Now()}
+	if h.rotateInterval > 0 {
+		o.deadline = o.opened.Truncate(h.rotateInterval).Add(h.rotateInterval)
+	}
+	return o, nil
+}
+
+// finish flushes the output stream and closes its file
+func (o *outputFile) finish() error {
+	if err := o.enc.Close(); err != nil {
+		return errors.New("unable to write output: " + err.Error())
+	}
+	// the end of a compressed stream is only written on close
+	if err := o.w.Close(); err != nil {
+		return errors.New("unable to write output: " + err.Error())
+	}
+	if o.f != os.Stdout {
+		if err := o.f.Close(); err != nil {
+			return errors.New("unable to close output file: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (h *FileOutputHandler) rotating() bool {
+	return h.rotateSize > 0 || h.rotateInterval > 0
+}
+
+// path returns the name of the output file of shard with sequence number seq.
+// The shard and sequence number are inserted before the extensions of the
+// output file, e.g. out-shard3-00012.json.gz.
+func (h *FileOutputHandler) path(shard int, seq int) string {
+	dir, name := filepath.Split(h.filepath)
+	ext := ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name, ext = name[:i], name[i:]
+	}
+	if h.shards > 1 {
+		name += fmt.Sprintf("-shard%d", shard)
+	}
+	if h.rotating() {
+		name += fmt.Sprintf("-%05d", seq)
+	}
+	return dir + name + ext
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// open starts the next file of shard, which is written under a partial name
+// until it is sealed. It returns the final name of the file. Rotated files
+// of a resumed scan continue after the files that are already there,
+// including partial ones left by a scan that did not shut down cleanly.
+func (h *FileOutputHandler) open(shard int, seq *int) (*outputFile, string, error) {
+	path := h.path(shard, *seq)
+	*seq++
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if h.resume {
+		if h.rotating() {
+			for exists(path) || exists(path+partialSuffix) {
+				path = h.path(shard, *seq)
+				*seq++
+			}
+		} else {
+			// the file of the interrupted scan is appended to, and so
+			// is partial again until it is sealed
+			if err := os.Rename(path, path+partialSuffix); err != nil && !os.IsNotExist(err) {
+				return nil, path, errors.New("unable to reopen output file: " + err.Error())
+			}
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+	}
+	f, err := os.OpenFile(path+partialSuffix, flags, 0644)
+	if err != nil {
+		return nil, path, errors.New("unable to open output file: " + err.Error())
+	}
+	o, err := h.start(f)
+	if err != nil {
+		f.Close()
+		return nil, path, err
+	}
+	return o, path, nil
+}
+
+// writeSplit writes results into a file per shard, which is replaced by a
+// new one whenever it reaches the rotation size or interval. Files are
+// opened once a result is written to them, so no file is empty.
+func (h *FileOutputHandler) writeSplit(results <-chan zdns.Result) error {
+	shards := h.shards
+	if shards < 1 {
+		shards = 1
+	}
+	files := make([]*outputFile, shards)
+	paths := make([]string, shards)
+	seqs := make([]int, shards)
+	defer func() {
+		// files left open after an error
+		for _, o := range files {
+			if o != nil {
+				o.f.Close()
+			}
+		}
+	}()
+	seal := func(shard int) error {
+		o := files[shard]
+		files[shard] = nil
+		if err := o.finish(); err != nil {
+			return err
+		}
+		if err := os.Rename(paths[shard]+partialSuffix, paths[shard]); err != nil {
+			return errors.New("unable to seal output file: " + err.Error())
+		}
+		h.sealed = append(h.sealed, SealedFile{
+			Path:    paths[shard],
+			Shard:   shard,
+			Results: o.results,
+			Bytes:   o.counter.n,
+			Opened:  o.opened.Format(h.timeFormat),
+			Sealed:  time.Now().Format(h.timeFormat),
+		})
+		return nil
+	}
+
+	var tick <-chan time.Time
+	if h.rotateInterval > 0 {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				for s, o := range files {
+					if o != nil {
+						if err := seal(s); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			}
+			s := 0
+			if shards > 1 {
+				s = int((zdns.NameHash(res.Name) >> 32) % uint64(shards))
+			}
+			if o := files[s]; o != nil && !o.deadline.IsZero() && !time.Now().Before(o.deadline) {
+				if err := seal(s); err != nil {
+					return err
+				}
+			}
+			if files[s] == nil {
+				o, path, err := h.open(s, &seqs[s])
+				if err != nil {
+					return err
+				}
+				files[s], paths[s] = o, path
+			}
+			o := files[s]
+			if err := o.enc.Encode(res); err != nil {
+				return errors.New("unable to write output: " + err.Error())
+			}
+			o.results++
+			if h.rotateSize > 0 && o.counter.n >= h.rotateSize {
+				if err := seal(s); err != nil {
+					return err
+				}
+			}
+		case now := <-tick:
+			for s, o := range files {
+				if o != nil && !now.Before(o.deadline) {
+					if err := seal(s); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/kwang40/zdns"
+)
+
+func TestShardedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &zdns.GlobalConf{
+		OutputFilePath:   filepath.Join(dir, "out.json"),
+		OutputFormat:     zdns.FORMAT_JSON,
+		OutputShards:     2,
+		OutputRotateSize: 200,
+	}
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("name%d.com", i))
+	}
+	h := write(t, conf, names...)
+
+	sealed := h.Metadata().(OutputMetadata).Files
+	results := 0
+	shards := make(map[int]bool)
+	for _, f := range sealed {
+		results += f.Results
+		shards[f.Shard] = true
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != f.Bytes {
+			t.Errorf("%s has %d bytes, metadata says %d", f.Path, info.Size(), f.Bytes)
+		}
+	}
+	if results != len(names) {
+		t.Errorf("sealed files hold %d results, expected %d", results, len(names))
+	}
+	if partial, _ := filepath.Glob(filepath.Join(dir, "*"+partialSuffix)); len(partial) != 0 {
+		t.Errorf("files left partial after the scan: %v", partial)
+	}
+	if len(shards) != 2 || len(sealed) <= 2 {
+		t.Errorf("expected rotated files in both shards, got %v", sealed)
+	}
+
+	// a resumed scan continues after the files already written
+	conf.Resume = true
+	resumed := write(t, conf, names[0]).Metadata().(OutputMetadata).Files
+	for _, f := range sealed {
+		if f.Path == resumed[0].Path {
+			t.Errorf("resumed scan overwrote %s", f.Path)
+		}
+	}
+}
+
+func TestPartialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &zdns.GlobalConf{
+		OutputFilePath:   filepath.Join(dir, "out.json"),
+		OutputFormat:     zdns.FORMAT_JSON,
+		OutputRotateSize: 1,
+	}
+	h := new(FileOutputHandler)
+	if err := h.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan zdns.Result)
+	errc := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { errc <- h.WriteResults(results, &wg) }()
+
+	// every result fills a file, which is sealed right away
+	results <- zdns.Result{Name: "a.com", Status: "NOERROR"}
+	results <- zdns.Result{Name: "b.com", Status: "NOERROR"}
+	close(results)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range h.Metadata().(OutputMetadata).Files {
+		if _, err := os.Stat(f.Path); err != nil {
+			t.Errorf("sealed file %s is missing: %v", f.Path, err)
+		}
+	}
+
+	// a file that is still being written keeps its partial name
+	conf.OutputRotateSize = 1 << 20
+	conf.Resume = true
+	h = new(FileOutputHandler)
+	if err := h.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	results = make(chan zdns.Result)
+	wg.Add(1)
+	go func() { errc <- h.WriteResults(results, &wg) }()
+	results <- zdns.Result{Name: "c.com", Status: "NOERROR"}
+	// the handler has opened the file once it takes the next result
+	results <- zdns.Result{Name: "d.com", Status: "NOERROR"}
+	partial, _ := filepath.Glob(filepath.Join(dir, "*"+partialSuffix))
+	if len(partial) != 1 || partial[0] != h.path(0, 2)+partialSuffix {
+		t.Errorf("expected %s to be partial, got %v", h.path(0, 2), partial)
+	}
+	close(results)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(h.path(0, 2)); err != nil {
+		t.Errorf("file was not sealed: %v", err)
+	}
+}
@@ -15,14 +15,24 @@
 package zdns
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-redis/redis"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/kwang40/zdns/metrics"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
@@ -53,13 +63,52 @@ type DNSFlags struct {
 	ErrorCode          int  `json:"error_code"`
 }
 
+type EDNSClientSubnet struct {
+	Family       uint16 `json:"family"`
+	SourcePrefix uint8  `json:"source_prefix"`
+	ScopePrefix  uint8  `json:"scope_prefix"`
+	Address      string `json:"address"`
+}
+
+// contents of the OPT pseudo-record returned by the server
+type EDNSResult struct {
+	Version       uint8             `json:"version"`
+	UDPSize       uint16            `json:"udp_size"`
+	DO            bool              `json:"do"`
+	ExtendedRcode int               `json:"extended_rcode"`
+	NSID          string            `json:"nsid,omitempty"`
+	ClientSubnet  *EDNSClientSubnet `json:"client_subnet,omitempty"`
+}
+
+type DNSSECStatus string
+
+const (
+	DNSSEC_SECURE        DNSSECStatus = "secure"
+	DNSSEC_INSECURE      DNSSECStatus = "insecure"
+	DNSSEC_BOGUS         DNSSECStatus = "bogus"
+	DNSSEC_INDETERMINATE DNSSECStatus = "indeterminate"
+)
+
+// outcome of validating a result against the root trust anchor
+type DNSSECResult struct {
+	Status DNSSECStatus `json:"status"`
+	Reason string       `json:"reason,omitempty"`
+}
+
 // result to be returned by scan of host
 type MiekgResult struct {
 	Answers     []interface{} `json:"answers"`
 	Additional  []interface{} `json:"additionals"`
 	Authorities []interface{} `json:"authorities"`
 	Protocol    string        `json:"protocol"`
+	RTT         float64       `json:"rtt_ms,omitempty"`
+	Attempts    int           `json:"attempts,omitempty"`
 	Flags       DNSFlags      `json:"flags"`
+	EDNS        *EDNSResult   `json:"edns,omitempty"`
+	DNSSEC      *DNSSECResult `json:"dnssec,omitempty"`
+	// Raw is the response as received, which is kept if it could not be
+	// parsed and otherwise only with GlobalConf.RawResponse
+	Raw []byte `json:"raw,omitempty"`
 }
 
 type ALookupResult struct {
@@ -83,13 +132,125 @@ func GetDNSServers(path string) ([]string, error) {
 	return servers, nil
 }
 
-func parseAlexa(line string) (string, int) {
+// SetDefaultPort appends port to every server that does not already carry one
+func SetDefaultPort(servers []string, port string) []string {
+	var retv []string
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), port)
+		}
+		retv = append(retv, s)
+	}
+	return retv
+}
+
+// NewTLSConfig builds the client configuration used for DNS-over-TLS. If
+// caFile is empty, the system roots are used to verify servers.
+func NewTLSConfig(serverName string, caFile string, skipVerify bool) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	return conf, nil
+}
+
+// ParseClientSubnet converts a CIDR (e.g., 192.0.2.0/24) into an EDNS Client
+// Subnet option (RFC 7871)
+func ParseClientSubnet(cidr string) (*dns.EDNS0_SUBNET, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	e.SourceNetmask = uint8(ones)
+	e.SourceScope = 0
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4
+	} else {
+		e.Family = 2
+		e.Address = ipNet.IP
+	}
+	return e, nil
+}
+
+// ParseSize reads a size in bytes, optionally followed by one of the units
+// K, M, G and T (powers of 1024, with an optional B or iB, e.g. 512MB)
+func ParseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "B"), "I")
+	mult := int64(1)
+	if n := len(t); n > 0 {
+		if i := strings.IndexByte("KMGT", t[n-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			t = t[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size " + s)
+	}
+	return n * mult, nil
+}
+
+// NameHash is a hash of name that is the same across runs and machines. The
+// case of name and a trailing dot are ignored. Input sharding uses the lower
+// 32 bits and output sharding the upper 32 bits, so that the output shards
+// of a scan of an input shard are still balanced.
+func NameHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(strings.TrimSuffix(name, "."))))
+	return h.Sum64()
+}
+
+// parseTargeted reads a line of targeted input, a TargetedDomain in JSON
+func parseTargeted(line string) (TargetedDomain, error) {
+	var target TargetedDomain
+	if err := json.Unmarshal([]byte(line), &target); err != nil {
+		return target, errors.New("malformed targeted input line: " + err.Error())
+	}
+	if target.Domain == "" {
+		return target, errors.New("malformed targeted input line: no domain")
+	}
+	for _, ns := range target.Nameservers {
+		if ns == "" {
+			return target, errors.New("malformed targeted input line: empty name server")
+		}
+	}
+	return target, nil
+}
+
+func illegalInput(gc *GlobalConf, line string, err error) Result {
+	return Result{
+		Name:      line,
+		Status:    string(STATUS_ILLEGAL_INPUT),
+		Error:     err.Error(),
+		Timestamp: time.Now().Format(gc.TimeFormat),
+	}
+}
+
+func parseAlexa(line string) (string, int, error) {
 	s := strings.SplitN(line, ",", 2)
+	if len(s) != 2 {
+		return "", 0, errors.New("malformed Alexa Top Million line: no rank")
+	}
 	rank, err := strconv.Atoi(s[0])
 	if err != nil {
-		log.Fatal("Malformed Alexa Top Million file")
+		return "", 0, errors.New("malformed Alexa Top Million line: " + err.Error())
 	}
-	return s[1], rank
+	return s[1], rank, nil
 }
 
 func makeName(name string, prefix string) (string, bool) {
@@ -100,80 +261,141 @@ func makeName(name string, prefix string) (string, bool) {
 	}
 }
 
-func doLookup(g *GlobalLookupFactory, gc *GlobalConf, input <-chan interface{}, output chan<- string, resultChannel chan<- Result, metaChan chan<- routineMetadata, wg *sync.WaitGroup, threadID int) error {
-	f, err := (*g).MakeRoutineFactory(threadID)
+// lookupInput looks up a single input, either a name or a zone file token,
+// within the per-name deadline. ok is false if the input holds nothing to
+// look up.
+func lookupInput(ctx context.Context, g GlobalLookupFactory, gc *GlobalConf, l Lookup, genericInput interface{}) (Result, Status, bool) {
+	var res Result
+	var innerRes interface{}
+	var trace []interface{}
+	var status Status
+	var err error
+	var tl TargetedLookup
+	// each name gets a single deadline that covers every query sent
+	// on its behalf
+	ctx, cancel := context.WithTimeout(ctx, gc.Timeout)
+	defer cancel()
+	if g.ZonefileInput() {
+		length := len(genericInput.(*dns.Token).RR.Header().Name)
+		if length == 0 {
+			return res, status, false
+		}
+		res.Name = genericInput.(*dns.Token).RR.Header().Name[0 : length-1]
+		res.Class = dns.Class(gc.Class).String()
+		switch typ := genericInput.(*dns.Token).RR.(type) {
+		case *dns.NS:
+			ns := strings.ToLower(typ.Ns)
+			res.Nameserver = ns[:len(ns)-1]
+		}
+		innerRes, status, err = l.DoZonefileLookup(ctx, genericInput.(*dns.Token))
+	} else {
+		line := genericInput.(string)
+		var changed bool
+		var rawName string
+		var rank int
+		if gc.AlexaFormat == true {
+			rawName, rank, err = parseAlexa(line)
+			if err != nil {
+				return illegalInput(gc, line, err), STATUS_ILLEGAL_INPUT, true
+			}
+			res.AlexaRank = rank
+		} else if gc.TargetedInput {
+			target, err := parseTargeted(line)
+			if err != nil {
+				return illegalInput(gc, line, err), STATUS_ILLEGAL_INPUT, true
+			}
+			rawName = target.Domain
+			if len(target.Nameservers) > 0 {
+				var ok bool
+				if tl, ok = l.(TargetedLookup); !ok {
+					res.Name = rawName
+					res.Status = string(STATUS_ERROR)
+					res.Error = "lookup module does not support targeted name servers"
+					res.Timestamp = time.Now().Format(gc.TimeFormat)
+					return res, STATUS_ERROR, true
+				}
+				servers := target.Nameservers
+				if gc.Transport != TRANSPORT_HTTPS {
+					servers = SetDefaultPort(servers, gc.DefaultPort())
+				}
+				// start at a random server to spread the load over them
+				start := rand.Intn(len(servers))
+				tl.SetNameServers(append(servers[start:len(servers):len(servers)], servers[:start]...))
+			}
+		} else {
+			rawName = line
+		}
+		lookupName, changed := makeName(rawName, gc.NamePrefix)
+		if changed {
+			res.AlteredName = lookupName
+		}
+		res.Name = rawName
+		res.Class = dns.Class(gc.Class).String()
+		innerRes, trace, status, err = l.DoLookup(ctx, lookupName)
+		if tl != nil {
+			res.Nameserver = tl.LastNameServer()
+		}
+	}
+	res.Timestamp = time.Now().Format(gc.TimeFormat)
+	res.Status = string(status)
+	res.Data = innerRes
+	res.Trace = trace
 	if err != nil {
-		log.Fatal("Unable to create new routine factory", err.Error())
+		res.Error = err.Error()
 	}
+	return res, status, true
+}
+
+func doLookup(ctx context.Context, g *GlobalLookupFactory, gc *GlobalConf, input <-chan numberedInput, output chan<- Result, resultChannel chan<- Result, metaChan chan<- routineMetadata, done chan<- int, errs *scanErrors, wg *sync.WaitGroup, threadID int) error {
 	var metadata routineMetadata
 	metadata.Status = make(map[Status]int)
-	for genericInput := range input {
+	defer (*wg).Done()
+	defer func() { metaChan <- metadata }()
+	f, err := (*g).MakeRoutineFactory(threadID)
+	if err != nil {
+		errs.add(errors.New("unable to create new routine factory: "+err.Error()), true)
+		return err
+	}
+	defer closeRoutineFactory(f)
+	for item := range input {
 		var res Result
-		var innerRes interface{}
-		var trace []interface{}
 		var status Status
-		var err error
-		l, err := f.MakeLookup()
-		if err != nil {
-			log.Fatal("Unable to build lookup instance", err)
-		}
-		if (*g).ZonefileInput() {
-			length := len(genericInput.(*dns.Token).RR.Header().Name)
-			if length == 0 {
-				continue
+		ok := true
+		metrics.NamesStarted.Inc()
+		start := time.Now()
+		if l, err := f.MakeLookup(); err != nil {
+			status = STATUS_ERROR
+			res = Result{Status: string(status), Error: "unable to build lookup instance: " + err.Error()}
+			res.Timestamp = time.Now().Format(gc.TimeFormat)
+			if name, isName := item.Data.(string); isName {
+				res.Name = name
 			}
-			res.Name = genericInput.(*dns.Token).RR.Header().Name[0 : length-1]
-			res.Class = dns.Class(gc.Class).String()
-			switch typ := genericInput.(*dns.Token).RR.(type) {
-			case *dns.NS:
-				ns := strings.ToLower(typ.Ns)
-				res.Nameserver = ns[:len(ns)-1]
-			}
-			innerRes, status, err = l.DoZonefileLookup(genericInput.(*dns.Token))
 		} else {
-			line := genericInput.(string)
-			var changed bool
-			var rawName string
-			var rank int
-			if gc.AlexaFormat == true {
-				rawName, rank = parseAlexa(line)
-				res.AlexaRank = rank
-			} else {
-				rawName = line
-			}
-			lookupName, changed := makeName(rawName, gc.NamePrefix)
-			if changed {
-				res.AlteredName = lookupName
-			}
-			res.Name = rawName
-			res.Class = dns.Class(gc.Class).String()
-			innerRes, trace, status, err = l.DoLookup(lookupName)
-		}
-		res.Timestamp = time.Now().Format(gc.TimeFormat)
-		if status != STATUS_NO_OUTPUT {
-			res.Status = string(status)
-			res.Data = innerRes
-			res.Trace = trace
-			if err != nil {
-				res.Error = err.Error()
-			}
-
+			res, status, ok = lookupInput(ctx, *g, gc, l, item.Data)
+		}
+		if ctx.Err() != nil {
+			// the scan was aborted. Leave this name out of the output and
+			// the checkpoint so that a resumed scan looks it up again.
+			continue
+		}
+		if ok {
+			metrics.Results.WithLabelValues(string(status)).Inc()
+			metrics.LookupDuration.Observe(time.Since(start).Seconds())
+		}
+		if ok && status != STATUS_NO_OUTPUT {
 			if resultChannel != nil {
 				resultChannel <- res
 			}
-			jsonRes, err := json.Marshal(res)
-			if err != nil {
-				log.Fatal("Unable to marshal JSON result", err)
-			}
-			output <- string(jsonRes)
-
+			output <- res
+		}
+		if done != nil {
+			done <- item.Index
+		}
+		if ok {
+			metadata.Names++
+			metadata.Status[status]++
 		}
-
-		metadata.Names++
-		metadata.Status[status]++
 	}
-	metaChan <- metadata
-	(*wg).Done()
 	return nil
 }
 
@@ -189,7 +411,112 @@ func aggregateMetadata(c <-chan routineMetadata) Metadata {
 	return meta
 }
 
-func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
+// inputName returns the name an input is for, or for lines that cannot be
+// parsed, the line itself
+func inputName(gc *GlobalConf, data interface{}) string {
+	switch input := data.(type) {
+	case *dns.Token:
+		if input.RR != nil {
+			return input.RR.Header().Name
+		}
+		return input.Comment
+	case string:
+		if gc.AlexaFormat {
+			if name, _, err := parseAlexa(input); err == nil {
+				return name
+			}
+		} else if gc.TargetedInput {
+			if target, err := parseTargeted(input); err == nil {
+				return target.Domain
+			}
+		}
+		return input
+	}
+	return ""
+}
+
+// inShard reports whether an input belongs to the shard of the input that
+// this process looks up
+func inShard(gc *GlobalConf, data interface{}) bool {
+	if gc.Shards <= 1 {
+		return true
+	}
+	return uint32(NameHash(inputName(gc, data)))%uint32(gc.Shards) == uint32(gc.Shard)
+}
+
+// numberInputs tags every input with its position in the input stream and
+// drops the ones of other shards and the ones that the checkpoint has
+// already seen processed. It stops handing out work once stop is closed, and
+// closes unread once it no longer reads in.
+func numberInputs(gc *GlobalConf, in <-chan interface{}, out chan<- numberedInput, tracker *checkpointTracker, stop <-chan struct{}, abort <-chan struct{}, unread chan<- struct{}) {
+	defer close(out)
+	defer close(unread)
+	i := 0
+	for data := range in {
+		if !inShard(gc, data) {
+			// other shards are done as far as this scan is concerned
+			if tracker != nil {
+				tracker.markDone(i)
+			}
+		} else if tracker == nil || !tracker.isDone(i) {
+			select {
+			case <-stop:
+				return
+			case <-abort:
+				return
+			default:
+			}
+			select {
+			case out <- numberedInput{Index: i, Data: data}:
+			case <-stop:
+				return
+			case <-abort:
+				return
+			}
+		}
+		i++
+	}
+}
+
+// scanErrors collects the errors of the goroutines that make up a scan. The
+// first fatal one closes abort, which ends the scan like closing stop does.
+type scanErrors struct {
+	sync.Mutex
+	errs  []string
+	abort chan struct{}
+	fatal bool
+}
+
+func newScanErrors() *scanErrors {
+	return &scanErrors{abort: make(chan struct{})}
+}
+
+func (e *scanErrors) add(err error, fatal bool) {
+	e.Lock()
+	defer e.Unlock()
+	log.Error(err.Error())
+	e.errs = append(e.errs, err.Error())
+	if fatal && !e.fatal {
+		e.fatal = true
+		close(e.abort)
+	}
+}
+
+func (e *scanErrors) err() error {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(e.errs, "; "))
+}
+
+// DoLookups runs the scan described by c. Closing stop ends the scan early:
+// no further names are handed out, lookups in flight finish and their output
+// is flushed. Cancelling ctx aborts every lookup in flight. Errors of the
+// input and output handlers also end the scan early; they are returned once
+// the output has been flushed.
+func DoLookups(ctx context.Context, stop <-chan struct{}, g *GlobalLookupFactory, c *GlobalConf) error {
 	// DoLookup:
 	//	- n threads that do processing from in and place results in out
 	//	- process until inChan closes, then wg.done()
@@ -198,22 +525,86 @@ func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
 	var outRedisStdChan chan Result
 	var outStdChan chan string
 	inChan := make(chan interface{})
-	outChan := make(chan string)
+	workChan := make(chan numberedInput)
+	outChan := make(chan Result)
 
 	metaChan := make(chan routineMetadata, c.Threads)
+	errs := newScanErrors()
 	var routineWG sync.WaitGroup
 	var stdRoutineWG sync.WaitGroup
+	var inputWG sync.WaitGroup
+	var trackerWG sync.WaitGroup
 
 	inHandler := GetInputHandler(c.InputHandler)
+	if inHandler == nil {
+		return errors.New("unknown input handler " + c.InputHandler)
+	}
 	outHandler := GetOutputHandler(c.OutputHandler)
-	inHandler.Initialize(c)
-	outHandler.Initialize(c)
+	if outHandler == nil {
+		return errors.New("unknown output handler " + c.OutputHandler)
+	}
+	if c.MetricsListenAddr != "" {
+		stopMetrics, err := metrics.Serve(c.MetricsListenAddr)
+		if err != nil {
+			return errors.New("unable to serve metrics: " + err.Error())
+		}
+		defer stopMetrics()
+	}
+
+	var tracker *checkpointTracker
+	var doneChan chan int
+	resumeClean := true
+	if c.CheckpointFilePath != "" {
+		var start *Checkpoint
+		if c.Resume {
+			var err error
+			if start, err = LoadCheckpoint(c.CheckpointFilePath); err != nil {
+				return err
+			}
+			if start.InputFile != "" && start.InputFile != c.InputFilePath {
+				return errors.New("checkpoint " + c.CheckpointFilePath + " was written for input " + start.InputFile)
+			}
+			if start.Shards != 0 && (start.Shard != c.Shard || start.Shards != c.Shards) {
+				return fmt.Errorf("checkpoint %s was written for shard %d of %d", c.CheckpointFilePath, start.Shard, start.Shards)
+			}
+			resumeClean = start.Clean
+		}
+		tracker = newCheckpointTracker(c.CheckpointFilePath, c.InputFilePath, c.Shard, c.Shards, start)
+		doneChan = make(chan int, c.Threads)
+	}
+
+	if err := inHandler.Initialize(c); err != nil {
+		return err
+	}
+	if err := outHandler.Initialize(c); err != nil {
+		return err
+	}
+	if rc, ok := outHandler.(ResumeChecker); ok && tracker != nil && c.Resume {
+		if err := rc.CheckResume(resumeClean); err != nil {
+			return err
+		}
+	}
+
+	if tracker != nil {
+		trackerWG.Add(1)
+		go tracker.track(doneChan, &trackerWG)
+	}
 
 	// Use handlers to populate the input and output/results channel
+	inputWG.Add(1)
+	unread := make(chan struct{})
+	go func() {
+		if err := inHandler.FeedChannel(inChan, &inputWG, (*g).ZonefileInput(), unread); err != nil {
+			errs.add(err, true)
+		}
+	}()
+	go numberInputs(c, inChan, workChan, tracker, stop, errs.abort, unread)
+	var outputErr error
 	routineWG.Add(1)
-	go inHandler.FeedChannel(inChan, &routineWG, (*g).ZonefileInput())
-	routineWG.Add(1)
-	go outHandler.WriteResults(outChan, &routineWG, false)
+	go func() {
+		defer routineWG.Done()
+		outputErr = writeResults(outHandler, outChan, errs)
+	}()
 
 	if c.RedisServerUrl != ""  || len(c.StdOutModules) != 0 {
 		var redisOutput = c.RedisServerUrl != ""
@@ -228,9 +619,14 @@ func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
 		routineWG.Add(1)
 		if stdOutput {
 			stdRoutineWG.Add(1)
-			go outHandler.WriteResults(outStdChan, &stdRoutineWG, true)
+			go writeStdOut(outStdChan, &stdRoutineWG, errs)
 		}
-		go redisStdHandler.WriteResults(outRedisStdChan, &routineWG, c, outStdChan, redisOutput, stdOutput)
+		go func() {
+			// storage failures are reported, but do not end the scan
+			if err := redisStdHandler.WriteResults(outRedisStdChan, &routineWG, c, outStdChan, redisOutput, stdOutput); err != nil {
+				errs.add(err, false)
+			}
+		}()
 	}
 
 
@@ -239,7 +635,7 @@ func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
 	lookupWG.Add(c.Threads)
 	startTime := time.Now().Format(c.TimeFormat)
 	for i := 0; i < c.Threads; i++ {
-		go doLookup(g, c, inChan, outChan, outRedisStdChan, metaChan, &lookupWG, i)
+		go doLookup(ctx, g, c, workChan, outChan, outRedisStdChan, metaChan, doneChan, errs, &lookupWG, i)
 	}
 	lookupWG.Wait()
 	close(outChan)
@@ -252,6 +648,23 @@ func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
 		close(outStdChan)
 	}
 	stdRoutineWG.Wait()
+	// output has been flushed, so the checkpoint can cover it, and is
+	// complete unless the output handler failed
+	if doneChan != nil {
+		tracker.setClean(outputErr == nil)
+		close(doneChan)
+		trackerWG.Wait()
+	}
+	// the input handler returns without the input that is no longer wanted
+	inputWG.Wait()
+	interrupted := false
+	select {
+	case <-stop:
+		interrupted = true
+	case <-errs.abort:
+		interrupted = true
+	default:
+	}
 	if c.MetadataFilePath != "" {
 		// we're done processing data. aggregate all the data from individual routines
 		metaData := aggregateMetadata(metaChan)
@@ -263,6 +676,15 @@ func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
 		// command line argument, so there should be no loss of data when casting
 		// back to an integer here.
 		metaData.Timeout = int(c.Timeout.Seconds())
+		metaData.Interrupted = interrupted
+		metaData.Shard = c.Shard
+		metaData.Shards = c.Shards
+		if p, ok := (*g).(MetadataProvider); ok {
+			metaData.Module = p.Metadata()
+		}
+		if p, ok := outHandler.(MetadataProvider); ok {
+			metaData.Output = p.Metadata()
+		}
 		metaData.Conf = c
 		// add global lookup-related metadata
 		// write out metadata
@@ -273,17 +695,50 @@ func DoLookups(g *GlobalLookupFactory, c *GlobalConf) error {
 			var err error
 			f, err = os.OpenFile(c.MetadataFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 			if err != nil {
-				log.Fatal("unable to open metadata file:", err.Error())
+				errs.add(errors.New("unable to open metadata file: "+err.Error()), false)
+				return errs.err()
 			}
 			defer f.Close()
 		}
 		j, err := json.Marshal(metaData)
 		if err != nil {
-			log.Fatal("unable to JSON encode metadata:", err.Error())
+			errs.add(errors.New("unable to JSON encode metadata: "+err.Error()), false)
+			return errs.err()
+		}
+		if _, err := f.WriteString(string(j)); err != nil {
+			errs.add(errors.New("unable to write metadata: "+err.Error()), false)
+		}
+	}
+	return errs.err()
+}
+
+// writeResults runs an output handler and returns its error. If it fails,
+// the rest of the results are discarded so that the lookups can wind down.
+func writeResults(h OutputHandler, results <-chan Result, errs *scanErrors) error {
+	// the caller waits for writeResults rather than for the handler, so
+	// that the error is known by then
+	var wg sync.WaitGroup
+	wg.Add(1)
+	err := h.WriteResults(results, &wg)
+	if err != nil {
+		errs.add(err, true)
+		for range results {
+		}
+	}
+	return err
+}
+
+// writeStdOut prints the IP,name lines of StdOutModules
+func writeStdOut(lines <-chan string, wg *sync.WaitGroup, errs *scanErrors) {
+	defer (*wg).Done()
+	for l := range lines {
+		if _, err := os.Stdout.WriteString(l + "\n"); err != nil {
+			errs.add(errors.New("unable to write output: "+err.Error()), true)
+			for range lines {
+			}
+			return
 		}
-		f.WriteString(string(j))
 	}
-	return nil
 }
 
 
@@ -308,6 +763,17 @@ func (h *RedisStdOutputHandler) Close() {
 func (h *RedisStdOutputHandler) WriteResults(results <-chan Result, wg *sync.WaitGroup, gc *GlobalConf, outStdChan chan<- string, redisOutput bool, stdOutput bool) error {
 	defer (*wg).Done()
 	var typeAStr = dns.TypeToString[dns.TypeA]
+	// a failed write loses one record, not the scan; failures are counted
+	// and reported once the results are done
+	var failed int
+	var lastErr error
+	save := func(key string, domain string) {
+		if err := h.saveToRedis(key, domain); err != nil {
+			log.Warn(err.Error())
+			failed++
+			lastErr = err
+		}
+	}
 
 	for r := range results {
 		var key = ""
@@ -326,7 +792,7 @@ func (h *RedisStdOutputHandler) WriteResults(results <-chan Result, wg *sync.Wai
 			}
 			if key != ""{
 				if redisOutput{
-					h.saveToRedis(key, domain)
+					save(key, domain)
 				}
 				if stdOutput && (gc.StdOutModules[typeAStr] || gc.StdOutModules["ANY"]) {
 					outStdChan<- key + "," + domain
@@ -335,7 +801,7 @@ func (h *RedisStdOutputHandler) WriteResults(results <-chan Result, wg *sync.Wai
 		case ALookupResult:
 			if len(res.IPv4Addresses) > 0 {
 				if redisOutput {
-					h.saveToRedis(res.IPv4Addresses[0], r.Name)
+					save(res.IPv4Addresses[0], r.Name)
 				}
 				if stdOutput && (gc.StdOutModules[typeAStr] || gc.StdOutModules["ANY"]) {
 					outStdChan<- res.IPv4Addresses[0] + "," + r.Name
@@ -352,16 +818,19 @@ func (h *RedisStdOutputHandler) WriteResults(results <-chan Result, wg *sync.Wai
 			*/
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d redis writes failed, last: %v", failed, lastErr)
+	}
 	return nil
 }
 
-func (h *RedisStdOutputHandler) saveToRedis(key string, domain string) {
+func (h *RedisStdOutputHandler) saveToRedis(key string, domain string) error {
 	var value []string
 	redisValue, err := h.client.Get(key).Result()
 	if err == redis.Nil { // no key found
 		value = make([]string, 0)
 	} else if err != nil {
-		log.Fatal("unable to get key:", err)
+		return errors.New("unable to get redis key: " + err.Error())
 	} else {
 		err = json.Unmarshal([]byte(redisValue), &value)
 		if err != nil {
@@ -375,12 +844,13 @@ func (h *RedisStdOutputHandler) saveToRedis(key string, domain string) {
 
 	jsonBytes, err := json.Marshal(value)
 	if err != nil {
-		log.Error("error marshalling redis:", err)
+		return errors.New("error marshalling redis value: " + err.Error())
 	}
 	err = h.client.Set(key, string(jsonBytes[:]), 0).Err()
 	if err != nil {
-		log.Error("unable to set redis key:", err)
+		return errors.New("unable to set redis key: " + err.Error())
 	}
+	return nil
 }
 
 func contains(arr []string, str string) bool {
@@ -0,0 +1,107 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package metrics holds the Prometheus metrics that ZDNS keeps while a scan
+// runs. They are updated by the scan loop and the lookup modules and can be
+// served over HTTP with Serve.
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// OtherNameServer is the name_server label of queries to name servers that
+// were not configured, e.g. the authoritative servers of iterative lookups,
+// which would otherwise give every server contacted a series of its own
+const OtherNameServer = "other"
+
+var (
+	NamesStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "zdns_names_started_total",
+		Help: "Names handed to a lookup routine.",
+	})
+	Results = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zdns_results_total",
+		Help: "Names whose lookup has finished, by status.",
+	}, []string{"status"})
+	LookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "zdns_lookup_duration_seconds",
+		Help:    "Time taken to look up a name, including every query sent for it.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 13),
+	})
+	Queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zdns_queries_total",
+		Help: "Queries sent, by name server.",
+	}, []string{"name_server"})
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zdns_query_duration_seconds",
+		Help:    "Round trip time of queries, by the protocol of the last exchange.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"protocol"})
+	Retries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "zdns_retries_total",
+		Help: "Queries sent again after a timeout or temporary failure.",
+	})
+	TCPFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "zdns_tcp_fallbacks_total",
+		Help: "Truncated UDP responses retried over TCP.",
+	})
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zdns_cache_requests_total",
+		Help: "Lookups in the iterative cache, by result (hit or miss).",
+	}, []string{"result"})
+
+	// Registry holds the metrics above along with the standard Go and
+	// process metrics
+	Registry = prometheus.NewRegistry()
+)
+
+func init() {
+	Registry.MustRegister(NamesStarted, Results, LookupDuration, Queries,
+		QueryDuration, Retries, TCPFallbacks, CacheRequests,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// CacheRequest counts a lookup in the iterative cache
+func CacheRequest(hit bool) {
+	if hit {
+		CacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		CacheRequests.WithLabelValues("miss").Inc()
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics at /metrics on addr (e.g. ":9100") until the
+// returned function is called
+func Serve(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return func() { server.Close() }, nil
+}
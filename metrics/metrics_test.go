@@ -0,0 +1,40 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	Results.WithLabelValues("NOERROR").Inc()
+	CacheRequest(true)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, want := range []string{
+		`zdns_results_total{status="NOERROR"} 1`,
+		`zdns_cache_requests_total{result="hit"} 1`,
+		"zdns_names_started_total 0",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
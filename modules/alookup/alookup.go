@@ -15,8 +15,10 @@
 package alookup
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -31,12 +33,11 @@ type Lookup struct {
 	miekg.Lookup
 }
 
-func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
-	nameServer := s.Factory.Factory.RandomNameServer()
-	return s.DoTargetedLookup(name, nameServer)
+func (s *Lookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
+	return s.DoTargetedLookup(ctx, name, s.NameServer)
 }
 
-func (s *Lookup) doLookupProtocol(name string, nameServer string, dnsType uint16, searchSet map[string][]zdns.MiekgAnswer, origName string, depth int) ([]string, []interface{}, zdns.Status, error) {
+func (s *Lookup) doLookupProtocol(ctx context.Context, name string, nameServer string, dnsType uint16, searchSet map[string][]zdns.MiekgAnswer, origName string, depth int) ([]string, []interface{}, zdns.Status, error) {
 	// avoid infinite loops
 	var tmp []string
 	if name == origName && depth != 0 {
@@ -52,7 +53,7 @@ func (s *Lookup) doLookupProtocol(name string, nameServer string, dnsType uint16
 		var miekgResult interface{}
 		var status zdns.Status
 		var err error
-		miekgResult, trace, status, err = s.DoTypedMiekgLookup(name, dnsType)
+		miekgResult, trace, status, err = s.DoTypedMiekgLookup(ctx, name, dnsType)
 		if status != zdns.STATUS_NOERROR || err != nil {
 			return nil, trace, status, err
 		}
@@ -91,7 +92,7 @@ func (s *Lookup) doLookupProtocol(name string, nameServer string, dnsType uint16
 	} else if res[0].Type == dns.Type(dns.TypeCNAME).String() {
 		// we have a CNAME and need to further recurse to find IPs
 		shortName := strings.ToLower(res[0].Answer[0 : len(res[0].Answer)-1])
-		res, secondTrace, status, err := s.doLookupProtocol(shortName, nameServer, dnsType, searchSet, origName, depth+1)
+		res, secondTrace, status, err := s.doLookupProtocol(ctx, shortName, nameServer, dnsType, searchSet, origName, depth+1)
 		trace = append(trace, secondTrace...)
 		return res, trace, status, err
 	} else {
@@ -99,7 +100,7 @@ func (s *Lookup) doLookupProtocol(name string, nameServer string, dnsType uint16
 	}
 }
 
-func (s *Lookup) DoTargetedLookup(name string, nameServer string) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoTargetedLookup(ctx context.Context, name string, nameServer string) (interface{}, []interface{}, zdns.Status, error) {
 	res := zdns.ALookupResult{}
 	searchSet := map[string][]zdns.MiekgAnswer{}
 	var ipv4 []string
@@ -107,13 +108,13 @@ func (s *Lookup) DoTargetedLookup(name string, nameServer string) (interface{},
 	var ipv4Trace []interface{}
 	var ipv6Trace []interface{}
 	if s.Factory.Factory.IPv4Lookup || !s.Factory.Factory.IPv6Lookup {
-		ipv4, ipv4Trace, _, _ = s.doLookupProtocol(name, nameServer, dns.TypeA, searchSet, name, 0)
+		ipv4, ipv4Trace, _, _ = s.doLookupProtocol(ctx, name, nameServer, dns.TypeA, searchSet, name, 0)
 		res.IPv4Addresses = make([]string, len(ipv4))
 		copy(res.IPv4Addresses, ipv4)
 	}
 	searchSet = map[string][]zdns.MiekgAnswer{}
 	if s.Factory.Factory.IPv6Lookup {
-		ipv6, ipv6Trace, _, _ = s.doLookupProtocol(name, nameServer, dns.TypeAAAA, searchSet, name, 0)
+		ipv6, ipv6Trace, _, _ = s.doLookupProtocol(ctx, name, nameServer, dns.TypeAAAA, searchSet, name, 0)
 		res.IPv6Addresses = make([]string, len(ipv6))
 		copy(res.IPv6Addresses, ipv6)
 	}
@@ -135,7 +136,10 @@ type RoutineLookupFactory struct {
 
 func (s *RoutineLookupFactory) MakeLookup() (zdns.Lookup, error) {
 	a := Lookup{Factory: s}
-	nameServer := s.Factory.RandomNameServer()
+	nameServer, err := s.Factory.RandomNameServer()
+	if err != nil {
+		return nil, err
+	}
 	a.Initialize(nameServer, dns.TypeA, dns.ClassINET, &s.RoutineLookupFactory)
 	return &a, nil
 }
@@ -159,6 +163,30 @@ func (s *GlobalLookupFactory) Help() string {
 	return ""
 }
 
+// AvroSchema is the schema of zdns.ALookupResult
+func (s *GlobalLookupFactory) AvroSchema() string {
+	return `{
+		"type": "record",
+		"name": "ALookupResult",
+		"namespace": "zdns.alookup",
+		"fields": [
+			{"name": "ipv4_addresses", "type": {"type": "array", "items": "string"}},
+			{"name": "ipv6_addresses", "type": {"type": "array", "items": "string"}}
+		]
+	}`
+}
+
+func (s *GlobalLookupFactory) AvroRecord(data interface{}) (interface{}, error) {
+	res, ok := data.(zdns.ALookupResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", data)
+	}
+	return map[string]interface{}{
+		"ipv4_addresses": res.IPv4Addresses,
+		"ipv6_addresses": res.IPv6Addresses,
+	}, nil
+}
+
 func (s *GlobalLookupFactory) MakeRoutineFactory(threadID int) (zdns.RoutineLookupFactory, error) {
 	r := new(RoutineLookupFactory)
 	r.Factory = s
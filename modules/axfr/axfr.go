@@ -15,13 +15,14 @@
 package axfr
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
 
-	log "github.com/sirupsen/logrus"
-
 	"github.com/miekg/dns"
 	"github.com/zmap/go-iptree/blacklist"
 	"github.com/kwang40/zdns"
@@ -47,11 +48,23 @@ type AXFRResult struct {
 	Servers []AXFRServerResult `json:"servers,omitempty"`
 }
 
+// Records returns the transferred records, in a section named after the
+// server they came from
+func (r AXFRResult) Records() []zdns.Record {
+	var records []zdns.Record
+	for _, s := range r.Servers {
+		for _, rec := range s.Records {
+			records = append(records, zdns.NewRecord(s.Server, rec))
+		}
+	}
+	return records
+}
+
 func dotName(name string) string {
 	return strings.Join([]string{name, "."}, "")
 }
 
-func (s *Lookup) DoAXFR(name string, server string) AXFRServerResult {
+func (s *Lookup) DoAXFR(ctx context.Context, name string, server string) AXFRServerResult {
 	var retv AXFRServerResult
 	retv.Server = server
 	// check if the server address is blacklisted and if so, exclude
@@ -72,7 +85,18 @@ func (s *Lookup) DoAXFR(name string, server string) AXFRServerResult {
 	}
 	m := new(dns.Msg)
 	m.SetAxfr(dotName(name))
-	tr := new(dns.Transfer)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(server, "53"))
+	if err != nil {
+		retv.Status = "ERROR"
+		retv.Error = err.Error()
+		return retv
+	}
+	defer conn.Close()
+	// abort the transfer if the lookup is cancelled or runs out of time
+	stop := miekg.CloseWhenDone(ctx, conn)
+	defer stop()
+	tr := &dns.Transfer{Conn: &dns.Conn{Conn: conn}}
 	if a, err := tr.In(m, net.JoinHostPort(server, "53")); err != nil {
 		retv.Status = "ERROR"
 		retv.Error = err.Error()
@@ -95,15 +119,15 @@ func (s *Lookup) DoAXFR(name string, server string) AXFRServerResult {
 	return retv
 }
 
-func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
-	parsedNS, trace, status, err := s.DoNSLookup(name, true, false)
+func (s *Lookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
+	parsedNS, trace, status, err := s.DoNSLookup(ctx, name, true, false)
 	if status != zdns.STATUS_NOERROR {
 		return nil, trace, status, err
 	}
 	var retv AXFRResult
 	for _, server := range parsedNS.Servers {
 		if len(server.IPv4Addresses) > 0 {
-			retv.Servers = append(retv.Servers, s.DoAXFR(name, server.IPv4Addresses[0]))
+			retv.Servers = append(retv.Servers, s.DoAXFR(ctx, name, server.IPv4Addresses[0]))
 		}
 	}
 	return retv, trace, zdns.STATUS_NOERROR, nil
@@ -118,7 +142,10 @@ type RoutineLookupFactory struct {
 
 func (s *RoutineLookupFactory) MakeLookup() (zdns.Lookup, error) {
 	a := Lookup{Factory: s}
-	nameServer := s.Factory.RandomNameServer()
+	nameServer, err := s.Factory.RandomNameServer()
+	if err != nil {
+		return nil, err
+	}
 	a.Initialize(nameServer, dns.TypeA, dns.ClassINET, &s.RoutineLookupFactory)
 	return &a, nil
 }
@@ -142,6 +169,52 @@ func (s *GlobalLookupFactory) AddFlags(f *flag.FlagSet) {
 	f.StringVar(&s.BlacklistPath, "blacklist-file", "", "blacklist file for servers to exclude from AXFR lookups")
 }
 
+// AvroSchema is the schema of AXFRResult
+func (s *GlobalLookupFactory) AvroSchema() string {
+	return `{
+		"type": "record",
+		"name": "AXFRResult",
+		"namespace": "zdns.axfr",
+		"fields": [
+			{"name": "servers", "type": {"type": "array", "items": {
+				"type": "record",
+				"name": "AXFRServerResult",
+				"fields": [
+					{"name": "server", "type": "string"},
+					{"name": "status", "type": "string"},
+					{"name": "error", "type": "string"},
+					{"name": "records", "type": {"type": "array", "items": ` + miekg.AnswerSchema + `}}
+				]
+			}}}
+		]
+	}`
+}
+
+func (s *GlobalLookupFactory) AvroRecord(data interface{}) (interface{}, error) {
+	res, ok := data.(AXFRResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", data)
+	}
+	servers := make([]interface{}, 0, len(res.Servers))
+	for _, server := range res.Servers {
+		records := make([]interface{}, 0, len(server.Records))
+		for _, rec := range server.Records {
+			r, err := miekg.AvroAnswer(rec)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+		servers = append(servers, map[string]interface{}{
+			"server":  server.Server,
+			"status":  server.Status,
+			"error":   server.Error,
+			"records": records,
+		})
+	}
+	return map[string]interface{}{"servers": servers}, nil
+}
+
 func (s *GlobalLookupFactory) MakeRoutineFactory(threadID int) (zdns.RoutineLookupFactory, error) {
 	r := new(RoutineLookupFactory)
 	r.Factory = s
@@ -160,7 +233,7 @@ func (s *GlobalLookupFactory) Initialize(c *zdns.GlobalConf) error {
 		}
 	}
 	if c.IterativeResolution == true {
-		log.Fatal("AXFR module does not support iterative resolution")
+		return errors.New("AXFR module does not support iterative resolution")
 	}
 	return nil
 }
@@ -0,0 +1,352 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kwang40/zdns"
+)
+
+// AvroNamespace is the namespace of the Avro records of this package
+const AvroNamespace = "zdns.miekg"
+
+// the fields of each answer type beyond those of zdns.MiekgAnswer, by the
+// name of its Avro record
+var answerRecords = []struct {
+	name   string
+	fields string
+}{
+	{"Answer", ``},
+	{"MXAnswer", `{"name": "preference", "type": "int"}`},
+	{"DSAnswer", `{"name": "key_tag", "type": "int"}, {"name": "algorithm", "type": "int"},
+		{"name": "digest_type", "type": "int"}, {"name": "digest", "type": "string"}`},
+	{"DNSKEYAnswer", `{"name": "flags", "type": "int"}, {"name": "protocol", "type": "int"},
+		{"name": "algorithm", "type": "int"}, {"name": "public_key", "type": "string"}`},
+	{"CAAAnswer", `{"name": "tag", "type": "string"}, {"name": "value", "type": "string"}, {"name": "flag", "type": "int"}`},
+	{"SOAAnswer", `{"name": "ns", "type": "string"}, {"name": "mbox", "type": "string"}, {"name": "serial", "type": "long"},
+		{"name": "refresh", "type": "long"}, {"name": "retry", "type": "long"}, {"name": "expire", "type": "long"},
+		{"name": "min_ttl", "type": "long"}`},
+	{"SRVAnswer", `{"name": "priority", "type": "int"}, {"name": "weight", "type": "int"}, {"name": "port", "type": "int"},
+		{"name": "target", "type": "string"}`},
+	{"NAPTRAnswer", `{"name": "order", "type": "int"}, {"name": "preference", "type": "int"}, {"name": "flags", "type": "string"},
+		{"name": "service", "type": "string"}, {"name": "regexp", "type": "string"}, {"name": "replacement", "type": "string"}`},
+	{"TLSAAnswer", `{"name": "usage", "type": "int"}, {"name": "selector", "type": "int"}, {"name": "matching_type", "type": "int"},
+		{"name": "certificate", "type": "string"}`},
+	{"SSHFPAnswer", `{"name": "algorithm", "type": "int"}, {"name": "fingerprint_type", "type": "int"},
+		{"name": "fingerprint", "type": "string"}`},
+	{"URIAnswer", `{"name": "priority", "type": "int"}, {"name": "weight", "type": "int"}, {"name": "target", "type": "string"}`},
+	{"LOCAnswer", `{"name": "version", "type": "int"}, {"name": "latitude", "type": "double"}, {"name": "longitude", "type": "double"},
+		{"name": "altitude", "type": "double"}, {"name": "size", "type": "double"},
+		{"name": "horizontal_precision", "type": "double"}, {"name": "vertical_precision", "type": "double"}`},
+	{"HINFOAnswer", `{"name": "cpu", "type": "string"}, {"name": "os", "type": "string"}`},
+	{"RPAnswer", `{"name": "mbox", "type": "string"}, {"name": "txt", "type": "string"}`},
+	// params are a union of the types of the values of parseSvcParam
+	{"SVCBAnswer", `{"name": "priority", "type": "int"}, {"name": "target", "type": "string"},
+		{"name": "params", "type": {"type": "map", "values": ["boolean", "long", "string", {"type": "array", "items": "string"}]}}`},
+	{"UnknownAnswer", `{"name": "rr", "type": "string"}, {"name": "rdata", "type": "string"}`},
+}
+
+func answerSchema(define bool) string {
+	var types []string
+	for _, r := range answerRecords {
+		if !define {
+			types = append(types, `"`+AvroNamespace+"."+r.name+`"`)
+			continue
+		}
+		fields := `{"name": "name", "type": "string"}, {"name": "type", "type": "string"},
+		{"name": "class", "type": "string"}, {"name": "ttl", "type": "long"}, {"name": "answer", "type": "string"}`
+		if r.fields != "" {
+			fields += ", " + r.fields
+		}
+		types = append(types, `{"type": "record", "name": "`+r.name+`", "namespace": "`+AvroNamespace+`", "fields": [`+fields+`]}`)
+	}
+	return "[" + strings.Join(types, ", ") + "]"
+}
+
+// AnswerSchema is the Avro schema of the answers of ParseAnswer, a union of
+// a record per answer type. A schema can only define these records once, so
+// any further answers of the schema are of AnswerTypes, which refers to them
+// by name.
+var (
+	AnswerSchema = answerSchema(true)
+	AnswerTypes  = answerSchema(false)
+)
+
+// MiekgResultSchema is the Avro schema of zdns.MiekgResult
+var MiekgResultSchema = `{
+	"type": "record",
+	"name": "MiekgResult",
+	"namespace": "` + AvroNamespace + `",
+	"fields": [
+		{"name": "answers", "type": {"type": "array", "items": ` + AnswerSchema + `}},
+		{"name": "additionals", "type": {"type": "array", "items": ` + AnswerTypes + `}},
+		{"name": "authorities", "type": {"type": "array", "items": ` + AnswerTypes + `}},
+		{"name": "protocol", "type": "string"},
+		{"name": "rtt_ms", "type": "double"},
+		{"name": "attempts", "type": "int"},
+		{"name": "flags", "type": {"type": "record", "name": "DNSFlags", "fields": [
+			{"name": "response", "type": "boolean"},
+			{"name": "opcode", "type": "int"},
+			{"name": "authoritative", "type": "boolean"},
+			{"name": "truncated", "type": "boolean"},
+			{"name": "recursion_desired", "type": "boolean"},
+			{"name": "recursion_available", "type": "boolean"},
+			{"name": "authenticated", "type": "boolean"},
+			{"name": "checking_disabled", "type": "boolean"},
+			{"name": "error_code", "type": "int"}
+		]}},
+		{"name": "edns", "type": ["null", {"type": "record", "name": "EDNS", "fields": [
+			{"name": "version", "type": "int"},
+			{"name": "udp_size", "type": "int"},
+			{"name": "do", "type": "boolean"},
+			{"name": "extended_rcode", "type": "int"},
+			{"name": "nsid", "type": "string"},
+			{"name": "client_subnet", "type": ["null", {"type": "record", "name": "ClientSubnet", "fields": [
+				{"name": "family", "type": "int"},
+				{"name": "source_prefix", "type": "int"},
+				{"name": "scope_prefix", "type": "int"},
+				{"name": "address", "type": "string"}
+			]}]}
+		]}]},
+		{"name": "dnssec", "type": ["null", {"type": "record", "name": "DNSSEC", "fields": [
+			{"name": "status", "type": "string"},
+			{"name": "reason", "type": "string"}
+		]}]},
+		{"name": "raw", "type": ["null", "bytes"]}
+	]
+}`
+
+func avroHeader(a zdns.MiekgAnswer) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   a.Name,
+		"type":   a.Type,
+		"class":  a.Class,
+		"ttl":    int64(a.Ttl),
+		"answer": a.Answer,
+	}
+}
+
+func avroParams(params map[string]interface{}) (map[string]interface{}, error) {
+	retv := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		switch v := v.(type) {
+		case bool:
+			retv[k] = map[string]interface{}{"boolean": v}
+		case uint16:
+			retv[k] = map[string]interface{}{"long": int64(v)}
+		case string:
+			retv[k] = map[string]interface{}{"string": v}
+		case []string:
+			retv[k] = map[string]interface{}{"array": v}
+		default:
+			return nil, fmt.Errorf("unexpected value of SvcParam %s: %T", k, v)
+		}
+	}
+	return retv, nil
+}
+
+// AvroAnswer converts an answer of ParseAnswer to AnswerSchema
+func AvroAnswer(answer interface{}) (interface{}, error) {
+	var name string
+	var r map[string]interface{}
+	switch a := answer.(type) {
+	case zdns.MiekgAnswer:
+		name, r = "Answer", avroHeader(a)
+	case MXAnswer:
+		name, r = "MXAnswer", avroHeader(a.Answer)
+		r["preference"] = int(a.Preference)
+	case DSAnswer:
+		name, r = "DSAnswer", avroHeader(a.Answer)
+		r["key_tag"] = int(a.KeyTag)
+		r["algorithm"] = int(a.Algorithm)
+		r["digest_type"] = int(a.DigestType)
+		r["digest"] = a.Digest
+	case DNSKEYAnswer:
+		name, r = "DNSKEYAnswer", avroHeader(a.Answer)
+		r["flags"] = int(a.Flags)
+		r["protocol"] = int(a.Protocol)
+		r["algorithm"] = int(a.Algorithm)
+		r["public_key"] = a.PublicKey
+	case CAAAnswer:
+		name, r = "CAAAnswer", avroHeader(a.Answer)
+		r["tag"] = a.Tag
+		r["value"] = a.Value
+		r["flag"] = int(a.Flag)
+	case SOAAnswer:
+		name, r = "SOAAnswer", avroHeader(a.Answer)
+		r["ns"] = a.Ns
+		r["mbox"] = a.Mbox
+		r["serial"] = int64(a.Serial)
+		r["refresh"] = int64(a.Refresh)
+		r["retry"] = int64(a.Retry)
+		r["expire"] = int64(a.Expire)
+		r["min_ttl"] = int64(a.Minttl)
+	case SRVAnswer:
+		name, r = "SRVAnswer", avroHeader(a.Answer)
+		r["priority"] = int(a.Priority)
+		r["weight"] = int(a.Weight)
+		r["port"] = int(a.Port)
+		r["target"] = a.Target
+	case NAPTRAnswer:
+		name, r = "NAPTRAnswer", avroHeader(a.Answer)
+		r["order"] = int(a.Order)
+		r["preference"] = int(a.Preference)
+		r["flags"] = a.Flags
+		r["service"] = a.Service
+		r["regexp"] = a.Regexp
+		r["replacement"] = a.Replacement
+	case TLSAAnswer:
+		name, r = "TLSAAnswer", avroHeader(a.Answer)
+		r["usage"] = int(a.Usage)
+		r["selector"] = int(a.Selector)
+		r["matching_type"] = int(a.MatchingType)
+		r["certificate"] = a.Certificate
+	case SSHFPAnswer:
+		name, r = "SSHFPAnswer", avroHeader(a.Answer)
+		r["algorithm"] = int(a.Algorithm)
+		r["fingerprint_type"] = int(a.Type)
+		r["fingerprint"] = a.Fingerprint
+	case URIAnswer:
+		name, r = "URIAnswer", avroHeader(a.Answer)
+		r["priority"] = int(a.Priority)
+		r["weight"] = int(a.Weight)
+		r["target"] = a.Target
+	case LOCAnswer:
+		name, r = "LOCAnswer", avroHeader(a.Answer)
+		r["version"] = int(a.Version)
+		r["latitude"] = a.Latitude
+		r["longitude"] = a.Longitude
+		r["altitude"] = a.Altitude
+		r["size"] = a.Size
+		r["horizontal_precision"] = a.HorizPre
+		r["vertical_precision"] = a.VertPre
+	case HINFOAnswer:
+		name, r = "HINFOAnswer", avroHeader(a.Answer)
+		r["cpu"] = a.CPU
+		r["os"] = a.OS
+	case RPAnswer:
+		name, r = "RPAnswer", avroHeader(a.Answer)
+		r["mbox"] = a.Mbox
+		r["txt"] = a.Txt
+	case SVCBAnswer:
+		name, r = "SVCBAnswer", avroHeader(a.Answer)
+		r["priority"] = int(a.Priority)
+		r["target"] = a.Target
+		params, err := avroParams(a.Params)
+		if err != nil {
+			return nil, err
+		}
+		r["params"] = params
+	case UnknownAnswer:
+		name, r = "UnknownAnswer", avroHeader(a.Answer)
+		r["rr"] = a.RR
+		r["rdata"] = a.RData
+	default:
+		return nil, fmt.Errorf("unexpected answer type %T", answer)
+	}
+	return map[string]interface{}{AvroNamespace + "." + name: r}, nil
+}
+
+func avroAnswers(answers []interface{}) ([]interface{}, error) {
+	retv := make([]interface{}, 0, len(answers))
+	for _, a := range answers {
+		r, err := AvroAnswer(a)
+		if err != nil {
+			return nil, err
+		}
+		retv = append(retv, r)
+	}
+	return retv, nil
+}
+
+// AvroMiekgResult converts a zdns.MiekgResult to MiekgResultSchema
+func AvroMiekgResult(data interface{}) (interface{}, error) {
+	res, ok := data.(zdns.MiekgResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", data)
+	}
+	r := map[string]interface{}{
+		"protocol": res.Protocol,
+		"rtt_ms":   res.RTT,
+		"attempts": res.Attempts,
+		"flags": map[string]interface{}{
+			"response":            res.Flags.Response,
+			"opcode":              res.Flags.Opcode,
+			"authoritative":       res.Flags.Authoritative,
+			"truncated":           res.Flags.Truncated,
+			"recursion_desired":   res.Flags.RecursionDesired,
+			"recursion_available": res.Flags.RecursionAvailable,
+			"authenticated":       res.Flags.Authenticated,
+			"checking_disabled":   res.Flags.CheckingDisabled,
+			"error_code":          res.Flags.ErrorCode,
+		},
+		"edns":   nil,
+		"dnssec": nil,
+		"raw":    nil,
+	}
+	for section, answers := range map[string][]interface{}{
+		"answers":     res.Answers,
+		"additionals": res.Additional,
+		"authorities": res.Authorities,
+	} {
+		records, err := avroAnswers(answers)
+		if err != nil {
+			return nil, errors.New(section + ": " + err.Error())
+		}
+		r[section] = records
+	}
+	if e := res.EDNS; e != nil {
+		edns := map[string]interface{}{
+			"version":        int(e.Version),
+			"udp_size":       int(e.UDPSize),
+			"do":             e.DO,
+			"extended_rcode": e.ExtendedRcode,
+			"nsid":           e.NSID,
+			"client_subnet":  nil,
+		}
+		if s := e.ClientSubnet; s != nil {
+			edns["client_subnet"] = map[string]interface{}{AvroNamespace + ".ClientSubnet": map[string]interface{}{
+				"family":        int(s.Family),
+				"source_prefix": int(s.SourcePrefix),
+				"scope_prefix":  int(s.ScopePrefix),
+				"address":       s.Address,
+			}}
+		}
+		r["edns"] = map[string]interface{}{AvroNamespace + ".EDNS": edns}
+	}
+	if d := res.DNSSEC; d != nil {
+		r["dnssec"] = map[string]interface{}{AvroNamespace + ".DNSSEC": map[string]interface{}{
+			"status": string(d.Status),
+			"reason": d.Reason,
+		}}
+	}
+	if res.Raw != nil {
+		r["raw"] = map[string]interface{}{"bytes": res.Raw}
+	}
+	return r, nil
+}
+
+// AvroSchema is MiekgResultSchema, which the modules built on this one
+// replace with the schema of their own results
+func (s *GlobalLookupFactory) AvroSchema() string {
+	return MiekgResultSchema
+}
+
+func (s *GlobalLookupFactory) AvroRecord(data interface{}) (interface{}, error) {
+	return AvroMiekgResult(data)
+}
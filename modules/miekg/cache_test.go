@@ -0,0 +1,146 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// negativeHandler is authoritative for example. It has no name
+// missing.example and no records of empty.example
+func negativeHandler(queries *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Authoritative = true
+		if q.Question[0].Name == "missing.example." {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Ns = append(resp.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Serial: 1,
+			Minttl: 300,
+		})
+		w.WriteMsg(resp)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	server := &dns.Server{PacketConn: pc, Handler: negativeHandler(&queries)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	conf := &zdns.GlobalConf{IterativeResolution: true, Trace: true, NameServers: []string{pc.LocalAddr().String()}}
+	if err := conf.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	g := new(GlobalLookupFactory)
+	if err := g.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Finalize()
+	g.SetDNSType(dns.TypeA)
+	rf, err := g.MakeRoutineFactory(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := rf.MakeLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		status zdns.Status
+	}{
+		{"missing.example", zdns.STATUS_NXDOMAIN},
+		{"empty.example", zdns.STATUS_NOERROR},
+	} {
+		atomic.StoreInt32(&queries, 0)
+		for i := 0; i < 2; i++ {
+			_, trace, status, _ := l.DoLookup(context.Background(), c.name)
+			if status != c.status {
+				t.Fatalf("%s: expected %s, got %s", c.name, c.status, status)
+			}
+			if i == 1 {
+				if len(trace) != 1 || !trace[0].(TraceStep).Cached {
+					t.Errorf("%s: negative cache hit not traced: %+v", c.name, trace)
+				}
+			}
+		}
+		if n := atomic.LoadInt32(&queries); n != 1 {
+			t.Errorf("%s: expected one query, got %d", c.name, n)
+		}
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &zdns.GlobalConf{IterativeResolution: true, NoRootPriming: true, CacheFilePath: filepath.Join(dir, "cache.json")}
+	if err := conf.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := new(GlobalLookupFactory)
+	if err := g.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	ns := zdns.MiekgAnswer{Ttl: 172800, Type: "NS", RrType: dns.TypeNS, Class: "IN", RrClass: dns.ClassINET, Name: "com", Answer: "a.gtld-servers.net"}
+	g.AddCachedAnswer(ns, "com", dns.TypeNS, ns.Ttl, 0, 0)
+	expired := zdns.MiekgAnswer{Type: "A", RrType: dns.TypeA, Class: "IN", RrClass: dns.ClassINET, Name: "gone.com", Answer: "192.0.2.1"}
+	g.AddCachedAnswer(expired, "gone.com", dns.TypeA, 0, 0, 0)
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900}, Minttl: 900}
+	g.AddCachedNegative("missing.com", dns.TypeA, zdns.STATUS_NXDOMAIN, soa, 0, 0)
+	if err := g.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	warm := new(GlobalLookupFactory)
+	if err := warm.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer warm.IterativeCache.Close()
+	res, ok := warm.GetCachedResult("com", dns.TypeNS, true, 0, 0)
+	if !ok || len(res.Authorities) != 1 || res.Authorities[0] != ns {
+		t.Errorf("delegation not restored: %+v", res)
+	}
+	if _, ok := warm.GetCachedResult("gone.com", dns.TypeA, false, 0, 0); ok {
+		t.Error("expired answer restored")
+	}
+	if _, status, ok := warm.GetCachedNegative("missing.com", dns.TypeA, 0, 0); !ok || status != zdns.STATUS_NXDOMAIN {
+		t.Error("negative answer not restored")
+	}
+}
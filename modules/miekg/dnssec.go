@@ -0,0 +1,802 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation of iterative lookups. While iterating, every response is
+// split into RRsets that are stored in SignedCache together with the RRSIGs
+// covering them, along with the authority section of negative answers and of
+// referrals without DS records. Once a name has been resolved, every RRset of
+// the response the lookup ended with is validated by rebuilding the chain of
+// trust from the root trust anchor down to the zone that signed it, fetching
+// any DNSKEY and DS RRsets that were not seen during iteration.
+
+// RootTrustAnchors are the DS records of the root zone KSKs (KSK-2017 and
+// KSK-2024) as published by IANA.
+var RootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	kindRRset = iota
+	kindDenial
+	kindKeys
+)
+
+type signedCacheKey struct {
+	Name string
+	Type uint16
+	Kind int
+}
+
+func (k signedCacheKey) Hash() uint64 {
+	return zdns.NameHash(k.Name) ^ uint64(k.Type)<<8 ^ uint64(k.Kind)
+}
+
+func (k signedCacheKey) Size() int64 {
+	return int64(len(k.Name))
+}
+
+// an RRset as received on the wire, with the signatures that cover it
+type signedRRset struct {
+	RRs       []dns.RR
+	Sigs      []*dns.RRSIG
+	ExpiresAt time.Time
+}
+
+func (set signedRRset) Size() int64 {
+	n := 0
+	for _, rr := range set.RRs {
+		n += dns.Len(rr)
+	}
+	for _, sig := range set.Sigs {
+		n += dns.Len(sig)
+	}
+	return int64(n)
+}
+
+// the authority section of a negative answer, or of a referral that carries
+// no DS records, which may prove that the queried data does not exist
+type denial struct {
+	Rcode     int
+	Proof     []signedRRset
+	ExpiresAt time.Time
+}
+
+func (d denial) Size() int64 {
+	var n int64
+	for _, set := range d.Proof {
+		n += set.Size()
+	}
+	return n
+}
+
+// DNSKEYs of a zone that chain up to the trust anchor
+type trustedKeys struct {
+	Keys      []*dns.DNSKEY
+	ExpiresAt time.Time
+}
+
+func (t trustedKeys) Size() int64 {
+	n := 0
+	for _, key := range t.Keys {
+		n += dns.Len(key)
+	}
+	return int64(n)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+func minTTL(rrs []dns.RR) time.Duration {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// groupRRsets splits a message section into RRsets and attaches the RRSIGs
+// covering each of them
+func groupRRsets(rrs []dns.RR) []signedRRset {
+	var sets []signedRRset
+	index := make(map[signedCacheKey]int)
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := signedCacheKey{Name: canonicalName(rr.Header().Name), Type: rr.Header().Rrtype}
+		i, ok := index[k]
+		if !ok {
+			i = len(sets)
+			index[k] = i
+			sets = append(sets, signedRRset{})
+		}
+		sets[i].RRs = append(sets[i].RRs, rr)
+	}
+	for _, sig := range sigs {
+		k := signedCacheKey{Name: canonicalName(sig.Hdr.Name), Type: sig.TypeCovered}
+		if i, ok := index[k]; ok {
+			sets[i].Sigs = append(sets[i].Sigs, sig)
+		}
+	}
+	now := time.Now()
+	for i := range sets {
+		sets[i].ExpiresAt = now.Add(minTTL(sets[i].RRs))
+	}
+	return sets
+}
+
+func (s *GlobalLookupFactory) InitDNSSEC(c *zdns.GlobalConf) error {
+	s.TrustAnchors = nil
+	if c.TrustAnchorsFilePath != "" {
+		anchors, err := readTrustAnchors(c.TrustAnchorsFilePath)
+		if err != nil {
+			return err
+		}
+		s.TrustAnchors = anchors
+	} else {
+		for _, a := range RootTrustAnchors {
+			rr, err := dns.NewRR(a)
+			if err != nil {
+				return err
+			}
+			ds, ok := rr.(*dns.DS)
+			if !ok {
+				return errors.New("trust anchor is not a DS record: " + a)
+			}
+			s.TrustAnchors = append(s.TrustAnchors, ds)
+		}
+	}
+	initCache(&s.SignedCache, c)
+	return nil
+}
+
+func (s *GlobalLookupFactory) putSigned(k signedCacheKey, v interface{}) {
+	var expiresAt time.Time
+	switch e := v.(type) {
+	case signedRRset:
+		expiresAt = e.ExpiresAt
+	case denial:
+		expiresAt = e.ExpiresAt
+	case trustedKeys:
+		expiresAt = e.ExpiresAt
+	}
+	s.SignedCache.AddExpiring(k, v, expiresAt)
+}
+
+func (s *GlobalLookupFactory) getSigned(k signedCacheKey) (interface{}, bool) {
+	return s.SignedCache.Get(k)
+}
+
+func (s *GlobalLookupFactory) getRRset(name string, dnsType uint16) (signedRRset, bool) {
+	v, ok := s.getSigned(signedCacheKey{Name: name, Type: dnsType, Kind: kindRRset})
+	if !ok {
+		return signedRRset{}, false
+	}
+	return v.(signedRRset), true
+}
+
+func (s *GlobalLookupFactory) getDenial(name string, dnsType uint16) (denial, bool) {
+	v, ok := s.getSigned(signedCacheKey{Name: name, Type: dnsType, Kind: kindDenial})
+	if !ok {
+		return denial{}, false
+	}
+	return v.(denial), true
+}
+
+// RecordSignedResponse stores the RRsets and signatures of a response so
+// that they are available when the chain of trust is validated
+func (s *GlobalLookupFactory) RecordSignedResponse(r *dns.Msg) {
+	if len(r.Question) == 0 {
+		return
+	}
+	q := r.Question[0]
+	answers := groupRRsets(r.Answer)
+	authority := groupRRsets(r.Ns)
+	for _, set := range answers {
+		k := signedCacheKey{Name: canonicalName(set.RRs[0].Header().Name), Type: set.RRs[0].Header().Rrtype, Kind: kindRRset}
+		s.putSigned(k, set)
+	}
+	var referral string
+	hasSOA := false
+	for _, set := range authority {
+		k := signedCacheKey{Name: canonicalName(set.RRs[0].Header().Name), Type: set.RRs[0].Header().Rrtype, Kind: kindRRset}
+		s.putSigned(k, set)
+		switch k.Type {
+		case dns.TypeNS:
+			referral = k.Name
+		case dns.TypeSOA:
+			hasSOA = true
+		}
+	}
+	if len(r.Answer) != 0 || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return
+	}
+	d := denial{Rcode: r.Rcode, Proof: authority, ExpiresAt: time.Now().Add(minTTL(r.Ns))}
+	if r.Rcode == dns.RcodeNameError || hasSOA {
+		s.putSigned(signedCacheKey{Name: canonicalName(q.Name), Type: q.Qtype, Kind: kindDenial}, d)
+	} else if referral != "" {
+		if _, ok := s.getRRset(referral, dns.TypeDS); !ok {
+			// a referral without DS records proves an insecure delegation
+			s.putSigned(signedCacheKey{Name: referral, Type: dns.TypeDS, Kind: kindDenial}, d)
+		}
+	}
+}
+
+func secure() *zdns.DNSSECResult {
+	return &zdns.DNSSECResult{Status: zdns.DNSSEC_SECURE}
+}
+
+func insecure(reason string) *zdns.DNSSECResult {
+	return &zdns.DNSSECResult{Status: zdns.DNSSEC_INSECURE, Reason: reason}
+}
+
+func bogus(reason string) *zdns.DNSSECResult {
+	return &zdns.DNSSECResult{Status: zdns.DNSSEC_BOGUS, Reason: reason}
+}
+
+func indeterminate(reason string) *zdns.DNSSECResult {
+	return &zdns.DNSSECResult{Status: zdns.DNSSEC_INDETERMINATE, Reason: reason}
+}
+
+func describe(set signedRRset) string {
+	h := set.RRs[0].Header()
+	return h.Name + " " + dns.Type(h.Rrtype).String()
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(digest uint8) bool {
+	switch digest {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// verifyRRset checks that at least one signature over set, currently in its
+// validity period, was made by one of keys
+func verifyRRset(set signedRRset, keys []*dns.DNSKEY) error {
+	if len(set.Sigs) == 0 {
+		return errors.New("no RRSIG for " + describe(set))
+	}
+	lastErr := errors.New("no RRSIG for " + describe(set) + " made by a trusted key")
+	for _, sig := range set.Sigs {
+		if !sig.ValidityPeriod(time.Time{}) {
+			lastErr = fmt.Errorf("RRSIG by key %d for %s is outside its validity period", sig.KeyTag, describe(set))
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			err := sig.Verify(k, set.RRs)
+			if err == nil {
+				return nil
+			}
+			lastErr = fmt.Errorf("RRSIG by key %d for %s does not verify: %s", sig.KeyTag, describe(set), err.Error())
+		}
+	}
+	return lastErr
+}
+
+// trustKeys checks that the DNSKEY RRset of zone is self-signed by a key
+// matching one of the DS records, and returns its zone signing keys
+func trustKeys(zone string, set signedRRset, dss []*dns.DS) ([]*dns.DNSKEY, *zdns.DNSSECResult) {
+	supported := false
+	for _, ds := range dss {
+		if supportedAlgorithm(ds.Algorithm) && supportedDigest(ds.DigestType) {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, insecure("no DS record for " + zone + " uses a supported algorithm")
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range set.RRs {
+		if k, ok := rr.(*dns.DNSKEY); ok && k.Flags&dns.ZONE != 0 {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		for _, ds := range dss {
+			if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+				continue
+			}
+			computed := k.ToDS(ds.DigestType)
+			if computed == nil || !strings.EqualFold(computed.Digest, ds.Digest) {
+				continue
+			}
+			if err := verifyRRset(set, []*dns.DNSKEY{k}); err == nil {
+				return keys, nil
+			}
+		}
+	}
+	return nil, bogus("no DNSKEY of " + zone + " matches its DS records and signs the DNSKEY RRset")
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCompare orders names as described in RFC 4034, Section 6.1
+func canonicalCompare(a string, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := nsec.Hdr.Name
+	if canonicalCompare(owner, nsec.NextDomain) >= 0 {
+		// last NSEC in the zone wraps around to the apex
+		return canonicalCompare(name, owner) > 0 || canonicalCompare(name, nsec.NextDomain) < 0
+	}
+	return canonicalCompare(name, owner) > 0 && canonicalCompare(name, nsec.NextDomain) < 0
+}
+
+// provesDenial checks the NSEC or NSEC3 records of a negative answer. Only
+// the direct match or cover of name is checked; closest encloser and
+// wildcard proofs are not.
+func provesDenial(proof []signedRRset, name string, dnsType uint16, nxdomain bool) bool {
+	for _, set := range proof {
+		for _, rr := range set.RRs {
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				if nxdomain && nsecCovers(n, name) {
+					return true
+				}
+				if !nxdomain && canonicalName(n.Hdr.Name) == name && !hasType(n.TypeBitMap, dnsType) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+			case *dns.NSEC3:
+				if nxdomain && n.Cover(name) {
+					return true
+				}
+				if !nxdomain && n.Match(name) && !hasType(n.TypeBitMap, dnsType) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+				// an opt-out NSEC3 covering an unsigned delegation
+				if !nxdomain && dnsType == dns.TypeDS && n.Flags&1 == 1 && n.Cover(name) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// verifyDenial checks that every RRset of a negative answer is signed by
+// keys and that the NSEC or NSEC3 records prove the denial
+func verifyDenial(d denial, name string, dnsType uint16, keys []*dns.DNSKEY) error {
+	var proof []signedRRset
+	for _, set := range d.Proof {
+		switch set.RRs[0].Header().Rrtype {
+		case dns.TypeNS, dns.TypeDS:
+			// delegation data in a referral is not signed by the parent
+			continue
+		}
+		if err := verifyRRset(set, keys); err != nil {
+			return err
+		}
+		proof = append(proof, set)
+	}
+	if !provesDenial(proof, name, dnsType, d.Rcode == dns.RcodeNameError) {
+		return errors.New("no NSEC or NSEC3 record proves that " + name + " " + dns.Type(dnsType).String() + " does not exist")
+	}
+	return nil
+}
+
+// rootServer returns a name server to iterate from. The lookup itself may
+// have been pointed at other name servers with SetNameServers, but chains of
+// trust are always walked down from the root.
+func (s *Lookup) rootServer() string {
+	if ns, err := s.Factory.Factory.RandomNameServer(); err == nil {
+		return ns
+	}
+	return s.NameServer
+}
+
+// fetchRRset returns a signed RRset from the cache. If it is not there, it is
+// looked up iteratively from the root, which stores the response in the
+// cache.
+func (s *Lookup) fetchRRset(ctx context.Context, name string, dnsType uint16) (signedRRset, bool) {
+	g := s.Factory.Factory
+	if set, ok := g.getRRset(name, dnsType); ok {
+		return set, true
+	}
+	s.VerboseLog(1, "DNSSEC: fetching ", name, " (", dnsType, ")")
+	root := s.rootServer()
+	var trace []interface{}
+	if name == "." {
+		res, _, history, status, _ := s.retryingLookup(ctx, dnsType, dns.ClassINET, name, []string{root}, false)
+		if s.Factory.Trace {
+			trace = append(trace, TraceStep{
+				Result:     res,
+				DnsType:    dnsType,
+				DnsClass:   dns.ClassINET,
+				Name:       name,
+				NameServer: root,
+				Depth:      1,
+				Layer:      name,
+				Status:     status,
+				Exchanges:  history,
+			})
+		}
+	} else {
+		_, trace, _, _ = s.iterativeLookup(ctx, dnsType, dns.ClassINET, strings.TrimSuffix(name, "."), root, 1, ".", nil)
+	}
+	s.dnssecTrace = append(s.dnssecTrace, trace...)
+	return g.getRRset(name, dnsType)
+}
+
+func (s *Lookup) rootKeys(ctx context.Context) ([]*dns.DNSKEY, *zdns.DNSSECResult) {
+	g := s.Factory.Factory
+	if v, ok := g.getSigned(signedCacheKey{Name: ".", Type: dns.TypeDNSKEY, Kind: kindKeys}); ok {
+		return v.(trustedKeys).Keys, nil
+	}
+	set, ok := s.fetchRRset(ctx, ".", dns.TypeDNSKEY)
+	if !ok {
+		return nil, indeterminate("unable to retrieve the root DNSKEY RRset")
+	}
+	keys, res := trustKeys(".", set, g.TrustAnchors)
+	if res != nil {
+		return nil, res
+	}
+	g.putSigned(signedCacheKey{Name: ".", Type: dns.TypeDNSKEY, Kind: kindKeys}, trustedKeys{Keys: keys, ExpiresAt: set.ExpiresAt})
+	return keys, nil
+}
+
+// isZoneCut reports whether name is known to be delegated, either from a
+// captured referral or from the iterative cache
+func (s *Lookup) isZoneCut(name string) bool {
+	if _, ok := s.Factory.Factory.getRRset(name, dns.TypeNS); ok {
+		return true
+	}
+	_, ok := s.Factory.Factory.GetCachedResult(strings.TrimSuffix(name, "."), dns.TypeNS, true, 1, s.Factory.ThreadID)
+	return ok
+}
+
+// chainOfTrust walks from the root down to name, following every signed
+// delegation. It returns the keys of the deepest zone reached, or a result
+// if the walk ended in an insecure delegation or could not be completed. If
+// isZone is set, name must itself be a signed zone.
+func (s *Lookup) chainOfTrust(ctx context.Context, name string, isZone bool) ([]*dns.DNSKEY, string, *zdns.DNSSECResult) {
+	g := s.Factory.Factory
+	keys, res := s.rootKeys(ctx)
+	if res != nil {
+		return nil, ".", res
+	}
+	zone := "."
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := canonicalName(strings.Join(labels[i:], "."))
+		last := i == 0
+		if v, ok := g.getSigned(signedCacheKey{Name: child, Type: dns.TypeDNSKEY, Kind: kindKeys}); ok {
+			keys = v.(trustedKeys).Keys
+			zone = child
+			continue
+		}
+		ds, hasDS := g.getRRset(child, dns.TypeDS)
+		d, hasDenial := g.getDenial(child, dns.TypeDS)
+		if !hasDS && !hasDenial {
+			if !(last && isZone) && !s.isZoneCut(child) {
+				// not a delegation, so still inside zone
+				continue
+			}
+			ds, hasDS = s.fetchRRset(ctx, child, dns.TypeDS)
+			d, hasDenial = g.getDenial(child, dns.TypeDS)
+		}
+		if hasDS {
+			if err := verifyRRset(ds, keys); err != nil {
+				return nil, zone, bogus(err.Error())
+			}
+			var dss []*dns.DS
+			for _, rr := range ds.RRs {
+				if r, ok := rr.(*dns.DS); ok {
+					dss = append(dss, r)
+				}
+			}
+			set, ok := s.fetchRRset(ctx, child, dns.TypeDNSKEY)
+			if !ok {
+				return nil, zone, indeterminate("unable to retrieve the DNSKEY RRset of " + child)
+			}
+			childKeys, res := trustKeys(child, set, dss)
+			if res != nil {
+				return nil, zone, res
+			}
+			g.putSigned(signedCacheKey{Name: child, Type: dns.TypeDNSKEY, Kind: kindKeys}, trustedKeys{Keys: childKeys, ExpiresAt: set.ExpiresAt})
+			keys = childKeys
+			zone = child
+		} else if hasDenial {
+			if err := verifyDenial(d, child, dns.TypeDS, keys); err != nil {
+				return nil, zone, bogus(err.Error())
+			}
+			return nil, zone, insecure("delegation to " + child + " has no DS record")
+		} else {
+			return nil, zone, indeterminate("unable to determine whether " + child + " is signed")
+		}
+	}
+	return keys, zone, nil
+}
+
+// unsigned decides between insecure and bogus for data without signatures
+func (s *Lookup) unsigned(ctx context.Context, name string, reason string) *zdns.DNSSECResult {
+	_, zone, res := s.chainOfTrust(ctx, name, false)
+	if res != nil {
+		return res
+	}
+	return bogus(reason + " in secure zone " + zone)
+}
+
+func (s *Lookup) validateRRset(ctx context.Context, set signedRRset) *zdns.DNSSECResult {
+	owner := canonicalName(set.RRs[0].Header().Name)
+	if len(set.Sigs) == 0 {
+		return s.unsigned(ctx, owner, "no RRSIG for "+describe(set))
+	}
+	signer := canonicalName(set.Sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, owner) {
+		return bogus("RRSIG for " + describe(set) + " made by unrelated zone " + signer)
+	}
+	keys, _, res := s.chainOfTrust(ctx, signer, true)
+	if res != nil {
+		return res
+	}
+	if err := verifyRRset(set, keys); err != nil {
+		return bogus(err.Error())
+	}
+	return secure()
+}
+
+func (s *Lookup) validateDenial(ctx context.Context, d denial, name string, dnsType uint16) *zdns.DNSSECResult {
+	signer := ""
+	for _, set := range d.Proof {
+		if len(set.Sigs) > 0 {
+			signer = canonicalName(set.Sigs[0].SignerName)
+			break
+		}
+	}
+	if signer == "" {
+		return s.unsigned(ctx, name, "no signed denial of existence for "+name)
+	}
+	keys, _, res := s.chainOfTrust(ctx, signer, true)
+	if res != nil {
+		return res
+	}
+	if err := verifyDenial(d, name, dnsType, keys); err != nil {
+		return bogus(err.Error())
+	}
+	return secure()
+}
+
+// validateResult runs ValidateResult and adds the lookups made to validate
+// the result to trace
+func (s *Lookup) validateResult(ctx context.Context, name string, dnsType uint16, status zdns.Status, trace []interface{}) (*zdns.DNSSECResult, []interface{}) {
+	s.dnssecTrace = nil
+	res := s.ValidateResult(ctx, name, dnsType, status)
+	trace = append(trace, s.dnssecTrace...)
+	s.dnssecTrace = nil
+	return res, trace
+}
+
+// maxChainLength bounds the CNAME and DNAME records followed from the name
+// that was looked up
+const maxChainLength = 16
+
+// rank orders statuses from the weakest to the strongest
+func rank(status zdns.DNSSECStatus) int {
+	switch status {
+	case zdns.DNSSEC_BOGUS:
+		return 0
+	case zdns.DNSSEC_INDETERMINATE:
+		return 1
+	case zdns.DNSSEC_INSECURE:
+		return 2
+	}
+	return 3
+}
+
+// lowest returns whichever of a and b has the weaker status
+func lowest(a *zdns.DNSSECResult, b *zdns.DNSSECResult) *zdns.DNSSECResult {
+	if a == nil || rank(b.Status) < rank(a.Status) {
+		return b
+	}
+	return a
+}
+
+// dnameAbove returns the DNAME RRset of the closest ancestor of name that
+// has one
+func dnameAbove(get func(string, uint16) (signedRRset, bool), name string) (signedRRset, bool) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if set, ok := get(canonicalName(strings.Join(labels[i:], ".")), dns.TypeDNAME); ok {
+			return set, true
+		}
+	}
+	return signedRRset{}, false
+}
+
+// answerChain follows the CNAME and DNAME records from qname to the RRset of
+// dnsType. It returns the RRsets on the way, ending with that RRset if it
+// was found, and the name the chain ended at.
+func answerChain(get func(string, uint16) (signedRRset, bool), qname string, dnsType uint16) ([]signedRRset, string, bool) {
+	var chain []signedRRset
+	name := qname
+	for i := 0; i < maxChainLength; i++ {
+		if set, ok := get(name, dnsType); ok {
+			return append(chain, set), name, true
+		}
+		if set, ok := get(name, dns.TypeCNAME); ok {
+			if cname, ok := set.RRs[0].(*dns.CNAME); ok {
+				chain = append(chain, set)
+				name = canonicalName(cname.Target)
+				continue
+			}
+		}
+		if set, ok := dnameAbove(get, name); ok {
+			if dname, ok := set.RRs[0].(*dns.DNAME); ok {
+				chain = append(chain, set)
+				name = canonicalName(strings.TrimSuffix(name, canonicalName(dname.Hdr.Name)) + dname.Target)
+				continue
+			}
+		}
+		break
+	}
+	return chain, name, false
+}
+
+// sectionGetter finds RRsets among those of a message section
+func sectionGetter(sets []signedRRset) func(string, uint16) (signedRRset, bool) {
+	return func(name string, dnsType uint16) (signedRRset, bool) {
+		for _, set := range sets {
+			h := set.RRs[0].Header()
+			if h.Rrtype == dnsType && canonicalName(h.Name) == name {
+				return set, true
+			}
+		}
+		return signedRRset{}, false
+	}
+}
+
+// synthesized reports whether set is an unsigned CNAME made up by a name
+// server from one of the DNAME records in answers (RFC 6672, Section 5.3.1)
+func synthesized(set signedRRset, answers []signedRRset) bool {
+	h := set.RRs[0].Header()
+	if h.Rrtype != dns.TypeCNAME || len(set.Sigs) != 0 {
+		return false
+	}
+	for _, a := range answers {
+		owner := canonicalName(a.RRs[0].Header().Name)
+		if a.RRs[0].Header().Rrtype == dns.TypeDNAME && canonicalName(h.Name) != owner && dns.IsSubDomain(owner, canonicalName(h.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateResponse validates every RRset of r, a response to a query for
+// qname. If the answer section does not lead to an RRset of dnsType, the
+// authority section must prove that there is none at the end of the chain.
+func (s *Lookup) validateResponse(ctx context.Context, r *dns.Msg, qname string, dnsType uint16) *zdns.DNSSECResult {
+	answers := groupRRsets(r.Answer)
+	authority := groupRRsets(r.Ns)
+	_, target, found := answerChain(sectionGetter(answers), qname, dnsType)
+	var res *zdns.DNSSECResult
+	for _, set := range answers {
+		if !synthesized(set, answers) {
+			res = lowest(res, s.validateRRset(ctx, set))
+		}
+	}
+	denies := r.Rcode == dns.RcodeNameError
+	for _, set := range authority {
+		if set.RRs[0].Header().Rrtype == dns.TypeSOA {
+			denies = true
+		}
+	}
+	if !found && denies {
+		res = lowest(res, s.validateDenial(ctx, denial{Rcode: r.Rcode, Proof: authority}, target, dnsType))
+	} else {
+		for _, set := range authority {
+			res = lowest(res, s.validateRRset(ctx, set))
+		}
+	}
+	for _, set := range groupRRsets(r.Extra) {
+		res = lowest(res, s.validateRRset(ctx, set))
+	}
+	if res == nil {
+		return indeterminate("response for " + qname + " has neither an answer nor a denial of existence")
+	}
+	return res
+}
+
+// validateCached validates an answer that came from the iterative cache,
+// and so only left its RRsets in SignedCache
+func (s *Lookup) validateCached(ctx context.Context, qname string, dnsType uint16) *zdns.DNSSECResult {
+	g := s.Factory.Factory
+	chain, target, found := answerChain(g.getRRset, qname, dnsType)
+	var res *zdns.DNSSECResult
+	for _, set := range chain {
+		res = lowest(res, s.validateRRset(ctx, set))
+	}
+	if !found {
+		if d, ok := g.getDenial(target, dnsType); ok {
+			res = lowest(res, s.validateDenial(ctx, d, target, dnsType))
+		}
+	}
+	if res == nil {
+		return indeterminate("response for " + qname + " is not available for validation")
+	}
+	return res
+}
+
+// ValidateResult determines the DNSSEC status of the outcome of an iterative
+// lookup for name. Every RRset of the response the lookup ended with is
+// validated, following CNAME and DNAME records to the final answer, and the
+// weakest status of all of them is returned.
+func (s *Lookup) ValidateResult(ctx context.Context, name string, dnsType uint16, status zdns.Status) *zdns.DNSSECResult {
+	// lookups made while validating replace the response
+	r := s.response
+	if dnsType == dns.TypePTR {
+		if rev, err := dns.ReverseAddr(name); err == nil {
+			name = rev
+		}
+	}
+	qname := canonicalName(name)
+	switch status {
+	case zdns.STATUS_NOERROR, zdns.STATUS_NXDOMAIN:
+		if r == nil {
+			return s.validateCached(ctx, qname, dnsType)
+		}
+		return s.validateResponse(ctx, r, qname, dnsType)
+	default:
+		return indeterminate("lookup ended with status " + string(status))
+	}
+}
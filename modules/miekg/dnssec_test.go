@@ -0,0 +1,215 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// zoneKey is the only key of a test zone, used both as KSK and ZSK
+type zoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newZoneKey(t *testing.T, zone string) *zoneKey {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &zoneKey{key: k, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs followed by their signature
+func (z *zoneKey) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func rr(t *testing.T, s string) dns.RR {
+	r, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// signedZones serves a signed root, which delegates to the signed zone
+// secure. and the unsigned zone insecure., both served from 127.0.0.2.
+// In secure., www has a good signature, bad has one that does not match its
+// address, and alias is a signed CNAME to bad.
+type signedZones struct {
+	root, secure *zoneKey
+	// answers by zone, name and type
+	answers map[string]map[string][]dns.RR
+	// the authority and additional sections of referrals from the root
+	referrals map[string][2][]dns.RR
+}
+
+func newSignedZones(t *testing.T) *signedZones {
+	z := &signedZones{root: newZoneKey(t, "."), secure: newZoneKey(t, "secure.")}
+	ds := z.secure.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	bad := z.secure.sign(t, rr(t, "bad.secure. 3600 IN A 192.0.2.2"))
+	bad[0].(*dns.A).A = net.ParseIP("192.0.2.66")
+	alias := append(z.secure.sign(t, rr(t, "alias.secure. 3600 IN CNAME bad.secure.")), bad...)
+	z.answers = map[string]map[string][]dns.RR{
+		".": {
+			".DNSKEY": z.root.sign(t, z.root.key),
+		},
+		"secure.": {
+			"secure.DNSKEY":  z.secure.sign(t, z.secure.key),
+			"www.secure.A":   z.secure.sign(t, rr(t, "www.secure. 3600 IN A 192.0.2.1")),
+			"bad.secure.A":   bad,
+			"alias.secure.A": alias,
+		},
+		"insecure.": {
+			"www.insecure.A": {rr(t, "www.insecure. 3600 IN A 192.0.2.3")},
+		},
+	}
+	glue := func(zone string) []dns.RR {
+		return []dns.RR{rr(t, "ns."+zone+" 3600 IN A 127.0.0.2")}
+	}
+	z.referrals = map[string][2][]dns.RR{
+		"secure.": {
+			append([]dns.RR{rr(t, "secure. 3600 IN NS ns.secure.")}, z.root.sign(t, ds)...),
+			glue("secure."),
+		},
+		"insecure.": {
+			append([]dns.RR{rr(t, "insecure. 3600 IN NS ns.insecure.")}, z.root.sign(t, rr(t, "insecure. 3600 IN NSEC secure. NS RRSIG NSEC"))...),
+			glue("insecure."),
+		},
+	}
+	return z
+}
+
+func (z *signedZones) zoneOf(name string) string {
+	for _, zone := range []string{"secure.", "insecure."} {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return "."
+}
+
+func (z *signedZones) handler(root bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, q *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		name := q.Question[0].Name
+		zone := z.zoneOf(name)
+		if root && zone != "." {
+			referral := z.referrals[zone]
+			resp.Ns = referral[0]
+			resp.Extra = referral[1]
+		} else {
+			resp.Authoritative = true
+			resp.Answer = z.answers[zone][name+dns.Type(q.Question[0].Qtype).String()]
+		}
+		w.WriteMsg(resp)
+	}
+}
+
+func newValidatingLookup(t *testing.T, z *signedZones, nameServer string) *Lookup {
+	conf := &zdns.GlobalConf{IterativeResolution: true, ValidateDNSSEC: true, NameServers: []string{nameServer}}
+	if err := conf.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	g := new(GlobalLookupFactory)
+	if err := g.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Finalize() })
+	g.TrustAnchors = []*dns.DS{z.root.key.ToDS(dns.SHA256)}
+	g.SetDNSType(dns.TypeA)
+	rf, err := g.MakeRoutineFactory(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := rf.MakeLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.(*Lookup)
+}
+
+func TestValidateResult(t *testing.T) {
+	z := newSignedZones(t)
+	serveUDP(t, "127.0.0.2:53", z.handler(false))
+	root := serveUDP(t, "127.0.0.1:0", z.handler(true))
+
+	for _, c := range []struct {
+		name     string
+		expected zdns.DNSSECStatus
+	}{
+		{"www.secure", zdns.DNSSEC_SECURE},
+		{"bad.secure", zdns.DNSSEC_BOGUS},
+		{"alias.secure", zdns.DNSSEC_BOGUS},
+		{"www.insecure", zdns.DNSSEC_INSECURE},
+	} {
+		l := newValidatingLookup(t, z, root)
+		res, _, status, err := l.DoLookup(context.Background(), c.name)
+		if status != zdns.STATUS_NOERROR {
+			t.Fatalf("%s: lookup failed: %s %v", c.name, status, err)
+		}
+		dnssec := res.(zdns.MiekgResult).DNSSEC
+		if dnssec == nil || dnssec.Status != c.expected {
+			t.Errorf("%s: expected %s, got %+v", c.name, c.expected, dnssec)
+		}
+	}
+}
+
+func TestValidateResultTargeted(t *testing.T) {
+	z := newSignedZones(t)
+	child := serveUDP(t, "127.0.0.2:53", z.handler(false))
+	root := serveUDP(t, "127.0.0.1:0", z.handler(true))
+
+	// the lookup starts at the name server of secure., which does not serve
+	// the root DNSKEY RRset, so validation has to get it from the root
+	l := newValidatingLookup(t, z, root)
+	l.SetNameServers([]string{child})
+	res, _, status, err := l.DoLookup(context.Background(), "www.secure")
+	if status != zdns.STATUS_NOERROR {
+		t.Fatalf("lookup failed: %s %v", status, err)
+	}
+	if dnssec := res.(zdns.MiekgResult).DNSSEC; dnssec == nil || dnssec.Status != zdns.DNSSEC_SECURE {
+		t.Errorf("expected %s, got %+v", zdns.DNSSEC_SECURE, dnssec)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Exchange describes a single query sent on the wire and its outcome. The
+// exchanges made for a query, including retries and TCP fallbacks, are
+// reported in order in its trace step.
+// With GlobalConf.RawResponse, the query and response are included as they
+// went over the wire.
+type Exchange struct {
+	Attempt   int       `json:"attempt"`
+	Protocol  string    `json:"protocol"`
+	MessageID uint16    `json:"message_id"`
+	Time      time.Time `json:"time"`
+	RTT       float64   `json:"rtt_ms,omitempty"`
+	Rcode     string    `json:"rcode,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Query     []byte    `json:"query,omitempty"`
+	Response  []byte    `json:"response,omitempty"`
+}
+
+// Wire is what went over the wire in an exchange. Response is set whenever a
+// response was received, even if it could not be parsed.
+type Wire struct {
+	Query    []byte
+	Response []byte
+	Sent     time.Time
+	RTT      time.Duration
+}
+
+func newExchange(protocol string, id uint16, w Wire, r *dns.Msg, err error) Exchange {
+	e := Exchange{Protocol: protocol, MessageID: id, Time: w.Sent, Query: w.Query, Response: w.Response}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if r != nil {
+		e.RTT = Millis(w.RTT)
+		e.Rcode = dns.RcodeToString[r.Rcode]
+		e.Truncated = r.Truncated
+	}
+	return e
+}
+
+// Millis converts d to (fractional) milliseconds, the unit of RTTs in results
+func Millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// AttemptTimeout splits the timeout of a whole lookup across retries. Every
+// retry waits twice as long as the previous attempt, so the first attempt
+// gets timeout / (2^retries - 1) for all of them to fit in the deadline.
+func AttemptTimeout(timeout time.Duration, retries int) time.Duration {
+	if retries < 1 {
+		return timeout
+	}
+	return timeout / time.Duration(1<<uint(retries)-1)
+}
+
+// deadline returns the deadline of ctx, or now+timeout if it has none
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(timeout)
+}
+
+// CloseWhenDone closes c as soon as ctx is done, which aborts any read or
+// write blocked on it. The returned function stops watching ctx and must be
+// called once c is no longer in use.
+func CloseWhenDone(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// exchange behaves like c.Exchange, except that the query is abandoned when
+// ctx is done. The deadline of ctx takes precedence over c.Timeout.
+func exchange(ctx context.Context, c *dns.Client, m *dns.Msg, address string) (*dns.Msg, Wire, error) {
+	var w Wire
+	network := c.Net
+	if network == "" {
+		network = "udp"
+	}
+	d := net.Dialer{Deadline: deadline(ctx, c.Timeout)}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, w, err
+	}
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+	// If EDNS0 is used use that for size.
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	stop := CloseWhenDone(ctx, co)
+	defer stop()
+
+	co.SetDeadline(d.Deadline)
+	return roundTrip(co, m)
+}
+
+// roundTrip sends m over co and reads the response
+func roundTrip(co *dns.Conn, m *dns.Msg) (*dns.Msg, Wire, error) {
+	var w Wire
+	var err error
+	if w.Query, err = m.Pack(); err != nil {
+		return nil, w, err
+	}
+	w.Sent = time.Now()
+	if _, err := co.Write(w.Query); err != nil {
+		return nil, w, err
+	}
+	r, raw, err := readMsg(co)
+	w.RTT = time.Since(w.Sent)
+	w.Response = raw
+	if err == nil && r.Id != m.Id {
+		err = dns.ErrId
+	}
+	return r, w, err
+}
+
+// readMsg behaves like co.ReadMsg, except that it also returns the message as
+// received. The message is returned even if it cannot be parsed.
+func readMsg(co *dns.Conn) (*dns.Msg, []byte, error) {
+	raw, err := co.ReadMsgHeader(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(raw); err != nil {
+		// a truncated message is still of use to the caller
+		if err == dns.ErrTruncated {
+			return m, raw, err
+		}
+		return nil, raw, err
+	}
+	return m, raw, nil
+}
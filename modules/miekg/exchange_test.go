@@ -0,0 +1,154 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// truncatingHandler sends truncated responses over UDP and answers every A
+// query with 192.0.2.1 over TCP
+func truncatingHandler(w dns.ResponseWriter, q *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		resp.Truncated = true
+	} else {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+	w.WriteMsg(resp)
+}
+
+func TestExchangeHistory(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Skip("unable to listen on the same port over TCP:", err)
+	}
+	handler := dns.HandlerFunc(truncatingHandler)
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: ln, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	udp := &dns.Client{Timeout: time.Second}
+	tcp := &dns.Client{Net: "tcp", Timeout: time.Second}
+	var history []Exchange
+	res, _, status, err := doLookupWorker(context.Background(), udp, tcp, nil, nil, dns.TypeA, dns.ClassINET, "example.com", pc.LocalAddr().String(), true, &history)
+	if status != zdns.STATUS_NOERROR {
+		t.Fatalf("lookup failed: %s %v", status, err)
+	}
+	if res.Protocol != "tcp" || res.RTT <= 0 {
+		t.Errorf("expected a TCP response with an RTT, got %s %v", res.Protocol, res.RTT)
+	}
+	raw := new(dns.Msg)
+	if err := raw.Unpack(res.Raw); err != nil || len(raw.Answer) != 1 || raw.Truncated {
+		t.Errorf("raw response is not the TCP response: %v %v", raw, err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected two exchanges, got %+v", history)
+	}
+	if history[0].Protocol != "udp" || !history[0].Truncated || history[1].Protocol != "tcp" || history[1].Truncated {
+		t.Errorf("unexpected exchanges %+v", history)
+	}
+	if history[0].MessageID != history[1].MessageID || history[1].Rcode != "NOERROR" {
+		t.Errorf("unexpected exchanges %+v", history)
+	}
+}
+
+// serveUDP answers queries to addr with handler. Name servers found while
+// iterating are queried on port 53, so tests that follow delegations skip
+// when they can't listen there.
+func serveUDP(t *testing.T, addr string, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skip("unable to listen on "+addr+":", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// referralHandler delegates zone to ns.<zone> at the address glue
+func referralHandler(zone string, glue string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, q *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		ns := "ns." + zone
+		resp.Ns = append(resp.Ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+			Ns:  ns,
+		})
+		resp.Extra = append(resp.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.ParseIP(glue),
+		})
+		w.WriteMsg(resp)
+	}
+}
+
+func TestIterativeTraceNXDOMAIN(t *testing.T) {
+	var queries int32
+	serveUDP(t, "127.0.0.2:53", negativeHandler(&queries))
+	root := serveUDP(t, "127.0.0.1:0", referralHandler("example.", "127.0.0.2"))
+
+	conf := &zdns.GlobalConf{IterativeResolution: true, Trace: true, RawResponse: true, NameServers: []string{root}}
+	if err := conf.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	g := new(GlobalLookupFactory)
+	if err := g.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Finalize()
+	g.SetDNSType(dns.TypeA)
+	rf, err := g.MakeRoutineFactory(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := rf.MakeLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, trace, status, _ := l.DoLookup(context.Background(), "missing.example")
+	if status != zdns.STATUS_NXDOMAIN {
+		t.Fatalf("expected %s, got %s", zdns.STATUS_NXDOMAIN, status)
+	}
+	if len(trace) != 2 {
+		t.Fatalf("expected the referral and the NXDOMAIN response to be traced, got %+v", trace)
+	}
+	last := trace[1].(TraceStep)
+	if last.Status != zdns.STATUS_NXDOMAIN || last.NameServer != "127.0.0.2:53" {
+		t.Errorf("unexpected last step %+v", last)
+	}
+	if len(last.Exchanges) != 1 || last.Exchanges[0].Rcode != "NXDOMAIN" || last.Exchanges[0].Response == nil {
+		t.Errorf("NXDOMAIN exchange not recorded: %+v", last.Exchanges)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// idleConnTimeout is how long a connection to a DoH server is kept open
+// without queries before it is closed
+const idleConnTimeout = 90 * time.Second
+
+// HTTPSClient sends queries over DNS-over-HTTPS (RFC 8484) in wire format.
+// The name server passed to Exchange is a URL template such as
+// https://dns.example/dns-query{?dns}. The underlying http.Client pools its
+// connections, so a single HTTPSClient should be kept per routine.
+type HTTPSClient struct {
+	client *http.Client
+	method string
+}
+
+func NewHTTPSClient(client *http.Client, method string) *HTTPSClient {
+	c := new(HTTPSClient)
+	c.client = client
+	c.method = strings.ToUpper(method)
+	return c
+}
+
+// NewHTTP2Client returns an http.Client that negotiates HTTP/2 with DoH servers
+func NewHTTP2Client(conf *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   conf,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   idleConnTimeout,
+		},
+	}
+}
+
+func (c *HTTPSClient) Protocol() string {
+	return "https"
+}
+
+// Close shuts down the connections of the client that are not in use
+func (c *HTTPSClient) Close() {
+	c.client.CloseIdleConnections()
+}
+
+// expandTemplate fills in the dns variable of an RFC 6570 template, or
+// removes it when the query is sent in the request body.
+func expandTemplate(template string, query string) string {
+	base := strings.Replace(template, "{?dns}", "", 1)
+	base = strings.Replace(base, "{&dns}", "", 1)
+	if query == "" {
+		return base
+	}
+	if strings.Contains(base, "?") {
+		return base + "&dns=" + query
+	}
+	return base + "?dns=" + query
+}
+
+func (c *HTTPSClient) Exchange(ctx context.Context, m *dns.Msg, template string) (*dns.Msg, Wire, error) {
+	var w Wire
+	// RFC 8484 recommends an ID of 0 so that responses are cache friendly
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, w, err
+	}
+	var req *http.Request
+	switch c.method {
+	case http.MethodGet:
+		url := expandTemplate(template, base64.RawURLEncoding.EncodeToString(packed))
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+	case http.MethodPost:
+		req, err = http.NewRequest(http.MethodPost, expandTemplate(template, ""), bytes.NewReader(packed))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	default:
+		return nil, w, errors.New("unsupported DNS-over-HTTPS method: " + c.method)
+	}
+	if err != nil {
+		return nil, w, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", dnsMessageType)
+
+	w.Query = packed
+	w.Sent = time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, w, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	w.RTT = time.Since(w.Sent)
+	if err != nil {
+		return nil, w, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, w, fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dnsMessageType) {
+		return nil, w, fmt.Errorf("unexpected DNS-over-HTTPS content type %q", ct)
+	}
+	w.Response = body
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, w, err
+	}
+	if r.Id != q.Id {
+		return nil, w, dns.ErrId
+	}
+	r.Id = m.Id
+	return r, w, nil
+}
@@ -0,0 +1,156 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// dohHandler answers every A query with 192.0.2.1
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var packed []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dnsMessageType {
+				t.Errorf("unexpected content type %s", r.Header.Get("Content-Type"))
+			}
+			packed, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(packed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			t.Errorf("expected message ID 0, got %d", q.Id)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		out, _ := resp.Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(out)
+	}
+}
+
+func TestHTTPSLookup(t *testing.T) {
+	ts := httptest.NewUnstartedServer(dohHandler(t))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, method := range []string{"GET", "POST"} {
+		c := NewHTTPSClient(ts.Client(), method)
+		res, status, err := DoLookupWorker(context.Background(), nil, nil, c, nil, dns.TypeA, dns.ClassINET, "example.com", ts.URL+"/dns-query{?dns}", true)
+		if err != nil || status != zdns.STATUS_NOERROR {
+			t.Fatalf("%s: lookup failed: %v %v", method, status, err)
+		}
+		if res.Protocol != "https" {
+			t.Errorf("%s: expected protocol https, got %s", method, res.Protocol)
+		}
+		if len(res.Answers) != 1 || res.Answers[0].(zdns.MiekgAnswer).Answer != "192.0.2.1" {
+			t.Errorf("%s: unexpected answers %v", method, res.Answers)
+		}
+	}
+}
+
+func TestHTTPSClose(t *testing.T) {
+	ts := httptest.NewUnstartedServer(dohHandler(t))
+	var mu sync.Mutex
+	open := make(map[net.Conn]bool)
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open[conn] = true
+		case http.StateClosed, http.StateHijacked:
+			delete(open, conn)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := NewHTTP2Client(ts.Client().Transport.(*http.Transport).TLSClientConfig, time.Second)
+	c := NewHTTPSClient(client, "POST")
+	if _, status, err := DoLookupWorker(context.Background(), nil, nil, c, nil, dns.TypeA, dns.ClassINET, "example.com", ts.URL+"/dns-query", true); err != nil || status != zdns.STATUS_NOERROR {
+		t.Fatalf("lookup failed: %v %v", status, err)
+	}
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(open)
+		mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected Close to shut down idle connections, %d still open", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPSLookupServerError(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	c := NewHTTPSClient(ts.Client(), "POST")
+	_, status, err := DoLookupWorker(context.Background(), nil, nil, c, nil, dns.TypeA, dns.ClassINET, "example.com", ts.URL+"/dns-query", true)
+	if status != zdns.STATUS_ERROR || err == nil {
+		t.Errorf("expected an error, got %v %v", status, err)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	cases := []struct {
+		template, query, expected string
+	}{
+		{"https://dns.example/dns-query{?dns}", "AAAB", "https://dns.example/dns-query?dns=AAAB"},
+		{"https://dns.example/dns-query", "AAAB", "https://dns.example/dns-query?dns=AAAB"},
+		{"https://dns.example/q?ct{&dns}", "AAAB", "https://dns.example/q?ct&dns=AAAB"},
+		{"https://dns.example/dns-query{?dns}", "", "https://dns.example/dns-query"},
+	}
+	for _, c := range cases {
+		if got := expandTemplate(c.template, c.query); got != c.expected {
+			t.Errorf("expandTemplate(%q, %q) = %q, expected %q", c.template, c.query, got, c.expected)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package miekg
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/zmap/go-iptree/blacklist"
 	"github.com/kwang40/zdns"
 	"github.com/kwang40/zdns/cachehash"
+	"github.com/kwang40/zdns/metrics"
 
 )
 
@@ -55,6 +59,80 @@ type SOAAnswer struct {
 	Minttl  uint32 `json:"min_ttl"`
 }
 
+type SRVAnswer struct {
+	Answer   zdns.MiekgAnswer
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+type NAPTRAnswer struct {
+	Answer      zdns.MiekgAnswer
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags"`
+	Service     string `json:"service"`
+	Regexp      string `json:"regexp"`
+	Replacement string `json:"replacement"`
+}
+
+type TLSAAnswer struct {
+	Answer       zdns.MiekgAnswer
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+type SSHFPAnswer struct {
+	Answer      zdns.MiekgAnswer
+	Algorithm   uint8  `json:"algorithm"`
+	Type        uint8  `json:"fingerprint_type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type URIAnswer struct {
+	Answer   zdns.MiekgAnswer
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Target   string `json:"target"`
+}
+
+// LOCAnswer gives the location in degrees (negative south and west) and the
+// altitude, size and precisions in meters
+type LOCAnswer struct {
+	Answer    zdns.MiekgAnswer
+	Version   uint8   `json:"version"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Size      float64 `json:"size"`
+	HorizPre  float64 `json:"horizontal_precision"`
+	VertPre   float64 `json:"vertical_precision"`
+}
+
+type HINFOAnswer struct {
+	Answer zdns.MiekgAnswer
+	CPU    string `json:"cpu"`
+	OS     string `json:"os"`
+}
+
+type RPAnswer struct {
+	Answer zdns.MiekgAnswer
+	Mbox   string `json:"mbox"`
+	Txt    string `json:"txt"`
+}
+
+// UnknownAnswer is the answer of record types that have no answer type of
+// their own. RR is the record in presentation format and RData its RDATA in
+// hex, as in the generic format of RFC 3597.
+type UnknownAnswer struct {
+	Answer zdns.MiekgAnswer
+	RR     string `json:"rr"`
+	RData  string `json:"rdata,omitempty"`
+}
+
 type DNSFlags struct {
 	Response           bool `json:"response"`
 	Opcode             int  `json:"opcode"`
@@ -85,6 +163,8 @@ type TraceStep struct {
 	Depth      int      `json:"depth"`
 	Layer      string   `json:"layer"`
 	Cached     IsCached `json:"cached"`
+	Status     zdns.Status `json:"status"`
+	Exchanges  []Exchange `json:"exchanges,omitempty"`
 }
 
 type TimedAnswer struct {
@@ -96,6 +176,29 @@ type CachedResult struct {
 	Answers map[interface{}]TimedAnswer
 }
 
+// Size estimates the memory taken up by the answers. Each answer is both key
+// and value of the map.
+func (r CachedResult) Size() int64 {
+	var n int64
+	for _, ta := range r.Answers {
+		if a, ok := ta.Answer.(zdns.MiekgAnswer); ok {
+			n += 2 * int64(64+len(a.Name)+len(a.Answer)+len(a.Type)+len(a.Class))
+		}
+	}
+	return n
+}
+
+// NegativeResult is a cached NXDOMAIN or NODATA response (RFC 2308), with
+// the SOA record from its authority section
+type NegativeResult struct {
+	Status zdns.Status `json:"status"`
+	SOA    SOAAnswer   `json:"soa"`
+}
+
+func (r NegativeResult) Size() int64 {
+	return int64(64 + len(r.SOA.Answer.Name) + len(r.SOA.Ns) + len(r.SOA.Mbox))
+}
+
 type IsCached bool
 
 // Helpers
@@ -112,6 +215,9 @@ func (s *Lookup) VerboseLog(depth int, args ...interface{}) {
 }
 
 func dotName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
 	return strings.Join([]string{name, "."}, "")
 }
 
@@ -245,25 +351,144 @@ func ParseAnswer(ans dns.RR) interface{} {
 			Expire:  soa.Expire,
 			Minttl:  soa.Minttl,
 		}
-	} else {
-		return struct {
-			Type     string `json:"type"`
-			RrType   uint16
-			Class    string `json:"class"`
-			RrClass  uint16
-			Unparsed dns.RR `json:"-"`
-		}{
-			Type:     dns.Type(ans.Header().Rrtype).String(),
-			RrType:   ans.Header().Rrtype,
-			Class:    dns.Class(ans.Header().Class).String(),
-			RrClass:  ans.Header().Class,
-			Unparsed: ans,
+	} else if srv, ok := ans.(*dns.SRV); ok {
+		return SRVAnswer{
+			Answer:   answerHeader(srv.Hdr),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+			Port:     srv.Port,
+			Target:   strings.TrimSuffix(srv.Target, "."),
 		}
+	} else if naptr, ok := ans.(*dns.NAPTR); ok {
+		return NAPTRAnswer{
+			Answer:      answerHeader(naptr.Hdr),
+			Order:       naptr.Order,
+			Preference:  naptr.Preference,
+			Flags:       naptr.Flags,
+			Service:     naptr.Service,
+			Regexp:      naptr.Regexp,
+			Replacement: strings.TrimSuffix(naptr.Replacement, "."),
+		}
+	} else if tlsa, ok := ans.(*dns.TLSA); ok {
+		return TLSAAnswer{
+			Answer:       answerHeader(tlsa.Hdr),
+			Usage:        tlsa.Usage,
+			Selector:     tlsa.Selector,
+			MatchingType: tlsa.MatchingType,
+			Certificate:  tlsa.Certificate,
+		}
+	} else if sshfp, ok := ans.(*dns.SSHFP); ok {
+		return SSHFPAnswer{
+			Answer:      answerHeader(sshfp.Hdr),
+			Algorithm:   sshfp.Algorithm,
+			Type:        sshfp.Type,
+			Fingerprint: sshfp.FingerPrint,
+		}
+	} else if uri, ok := ans.(*dns.URI); ok {
+		return URIAnswer{
+			Answer:   answerHeader(uri.Hdr),
+			Priority: uri.Priority,
+			Weight:   uri.Weight,
+			Target:   uri.Target,
+		}
+	} else if loc, ok := ans.(*dns.LOC); ok {
+		return LOCAnswer{
+			Answer:    answerHeader(loc.Hdr),
+			Version:   loc.Version,
+			Latitude:  float64(int64(loc.Latitude)-dns.LOC_EQUATOR) / dns.LOC_DEGREES,
+			Longitude: float64(int64(loc.Longitude)-dns.LOC_PRIMEMERIDIAN) / dns.LOC_DEGREES,
+			Altitude:  float64(loc.Altitude)/100 - dns.LOC_ALTITUDEBASE,
+			Size:      locMeters(loc.Size),
+			HorizPre:  locMeters(loc.HorizPre),
+			VertPre:   locMeters(loc.VertPre),
+		}
+	} else if hinfo, ok := ans.(*dns.HINFO); ok {
+		return HINFOAnswer{
+			Answer: answerHeader(hinfo.Hdr),
+			CPU:    hinfo.Cpu,
+			OS:     hinfo.Os,
+		}
+	} else if rp, ok := ans.(*dns.RP); ok {
+		return RPAnswer{
+			Answer: answerHeader(rp.Hdr),
+			Mbox:   strings.TrimSuffix(rp.Mbox, "."),
+			Txt:    strings.TrimSuffix(rp.Txt, "."),
+		}
+	} else if unknown, ok := ans.(*dns.RFC3597); ok && isSVCB(unknown.Hdr.Rrtype) {
+		// this version of miekg/dns predates SVCB and HTTPS and leaves
+		// their RDATA undecoded
+		if svcb, err := parseSVCB(unknown); err == nil {
+			return svcb
+		}
+		return unknownAnswer(ans)
+	} else {
+		return unknownAnswer(ans)
 	}
 	retv.Name = strings.TrimSuffix(retv.Name, ".")
 	return retv
 }
 
+// answerHeader fills in the fields of an answer that come from the header
+func answerHeader(h dns.RR_Header) zdns.MiekgAnswer {
+	return zdns.MiekgAnswer{
+		Name:    strings.TrimSuffix(h.Name, "."),
+		Ttl:     h.Ttl,
+		Type:    dns.Type(h.Rrtype).String(),
+		RrType:  h.Rrtype,
+		Class:   dns.Class(h.Class).String(),
+		RrClass: h.Class,
+	}
+}
+
+// locMeters decodes the size and precision fields of LOC records, which
+// are centimeters as a mantissa in the upper and exponent in the lower
+// four bits
+func locMeters(v uint8) float64 {
+	cm := float64(v >> 4)
+	for e := v & 0x0f; e > 0; e-- {
+		cm *= 10
+	}
+	return cm / 100
+}
+
+// unknownAnswer is the fallback for record types that ParseAnswer does not
+// model
+func unknownAnswer(ans dns.RR) UnknownAnswer {
+	retv := UnknownAnswer{Answer: answerHeader(*ans.Header()), RR: ans.String()}
+	generic := new(dns.RFC3597)
+	if err := generic.ToRFC3597(ans); err == nil {
+		retv.RData = generic.Rdata
+	}
+	return retv
+}
+
+// ParseType reads a record type given by name (e.g., NSEC3PARAM) or in the
+// generic TYPEnnn form of RFC 3597 (e.g., TYPE65)
+func ParseType(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	if t, ok := dns.StringToType[name]; ok && t != dns.TypeNone {
+		return t, true
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		if t, err := strconv.ParseUint(name[len("TYPE"):], 10, 16); err == nil && t != 0 {
+			return uint16(t), true
+		}
+	}
+	return 0, false
+}
+
+// genericLookup makes a raw lookup module for a record type that has no
+// module of its own
+func genericLookup(name string) zdns.GlobalLookupFactory {
+	dnsType, ok := ParseType(name)
+	if !ok {
+		return nil
+	}
+	f := new(GlobalLookupFactory)
+	f.SetDNSType(dnsType)
+	return f
+}
+
 func TranslateMiekgErrorCode(err int) zdns.Status {
 	return zdns.Status(dns.RcodeToString[err])
 }
@@ -272,13 +497,16 @@ func TranslateMiekgErrorCode(err int) zdns.Status {
 
 type GlobalLookupFactory struct {
 	zdns.BaseGlobalLookupFactory
-	IterativeCache cachehash.CacheHash
-	CacheMutex     *sync.RWMutex
+	IterativeCache cachehash.ShardedCacheHash
 	DNSType        uint16
 	DNSClass       uint16
 	BlacklistPath  string
 	Blacklist      *blacklist.Blacklist
 	BlMu           sync.Mutex
+	SignedCache    cachehash.ShardedCacheHash
+	TrustAnchors   []*dns.DS
+	Limiter        *RateLimiter
+	metricServers  map[string]bool
 }
 
 func (s *GlobalLookupFactory) BlacklistInit() error {
@@ -301,13 +529,101 @@ func (s *GlobalLookupFactory) Initialize(c *zdns.GlobalConf) error {
 	if err != nil {
 		return err
 	}
-	s.IterativeCache.Init(c.CacheSize)
-	s.CacheMutex = &sync.RWMutex{}
+	initCache(&s.IterativeCache, c)
+	if c.CacheFilePath != "" {
+		if err := s.LoadCache(c.CacheFilePath); err != nil {
+			return err
+		}
+	}
 	s.DNSClass = dns.ClassINET
+	if c.ValidateDNSSEC {
+		if err := s.InitDNSSEC(c); err != nil {
+			return err
+		}
+	}
+	if c.RateLimit > 0 || c.PerServerRateLimit > 0 {
+		s.Limiter = NewRateLimiter(c.RateLimit, c.PerServerRateLimit)
+	}
+	// name servers given by the user are where they want iteration to start
+	if c.IterativeResolution && !c.NameServersSpecified && !c.NoRootPriming {
+		if hint, err := PrimeRoots(context.Background(), c); err != nil {
+			log.Warn("unable to prime root servers, using root hints: ", err)
+		} else {
+			log.Info("primed ", len(c.NameServers), " root server addresses from ", hint)
+		}
+	}
+	s.metricServers = make(map[string]bool, len(c.NameServers))
+	for _, ns := range c.NameServers {
+		s.metricServers[destination(ns)] = true
+	}
 
 	return nil
 }
 
+// cacheSweepInterval is how often expired entries are removed from the caches
+const cacheSweepInterval = time.Minute
+
+// initCache sets up cache by the number of entries or, if it is given, the
+// memory that the cache may take up
+func initCache(cache *cachehash.ShardedCacheHash, c *zdns.GlobalConf) {
+	if c.CacheBytes > 0 {
+		cache.InitSize(c.CacheBytes, cachehash.DefaultShards)
+	} else {
+		cache.Init(c.CacheSize, cachehash.DefaultShards)
+	}
+	if c.IterativeResolution {
+		cache.StartSweeper(cacheSweepInterval)
+	}
+}
+
+func (s *GlobalLookupFactory) Finalize() error {
+	s.IterativeCache.Close()
+	s.SignedCache.Close()
+	if s.GlobalConf != nil && s.GlobalConf.CacheFilePath != "" {
+		return s.SaveCache(s.GlobalConf.CacheFilePath)
+	}
+	return nil
+}
+
+// serverLabel is the name_server label of queries sent to nameServer
+func (s *GlobalLookupFactory) serverLabel(nameServer string) string {
+	if host := destination(nameServer); s.metricServers[host] {
+		return host
+	}
+	return metrics.OtherNameServer
+}
+
+type Metadata struct {
+	RateLimit   *RateLimitStats  `json:"rate_limit,omitempty"`
+	Cache       *cachehash.Stats `json:"cache,omitempty"`
+	SignedCache *cachehash.Stats `json:"signed_cache,omitempty"`
+}
+
+// CacheStats returns the statistics of the iterative cache
+func (s *GlobalLookupFactory) CacheStats() cachehash.Stats {
+	return s.IterativeCache.Stats()
+}
+
+func (s *GlobalLookupFactory) Metadata() interface{} {
+	var meta Metadata
+	if s.Limiter != nil {
+		stats := s.Limiter.Stats()
+		meta.RateLimit = &stats
+	}
+	if s.GlobalConf != nil && s.GlobalConf.IterativeResolution {
+		stats := s.CacheStats()
+		meta.Cache = &stats
+		if s.GlobalConf.ValidateDNSSEC {
+			signed := s.SignedCache.Stats()
+			meta.SignedCache = &signed
+		}
+	}
+	if meta == (Metadata{}) {
+		return nil
+	}
+	return meta
+}
+
 func (s *GlobalLookupFactory) SetDNSType(dnsType uint16) {
 	s.DNSType = dnsType
 }
@@ -325,11 +641,26 @@ func (s *GlobalLookupFactory) MakeRoutineFactory(threadID int) (zdns.RoutineLook
 	return r, nil
 }
 
-func makeCacheKey(name string, dnsType uint16) interface{} {
-	return struct {
-		Name    string
-		DnsType uint16
-	}{
+type cacheKey struct {
+	Name     string
+	DnsType  uint16
+	Negative bool
+}
+
+func (k cacheKey) Hash() uint64 {
+	h := zdns.NameHash(k.Name) ^ uint64(k.DnsType)
+	if k.Negative {
+		h ^= 1 << 16
+	}
+	return h
+}
+
+func (k cacheKey) Size() int64 {
+	return int64(len(k.Name))
+}
+
+func makeCacheKey(name string, dnsType uint16) cacheKey {
+	return cacheKey{
 		Name:    strings.ToLower(name),
 		DnsType: dnsType,
 	}
@@ -341,39 +672,47 @@ func (s *GlobalLookupFactory) AddCachedAnswer(answer interface{}, name string, d
 		// we can't cache this entry because we have no idea what to name it
 		return
 	}
+	s.addCachedAnswer(a, name, dnsType, time.Now().Add(time.Duration(ttl)*time.Second), depth, threadID)
+}
+
+func (s *GlobalLookupFactory) addCachedAnswer(answer zdns.MiekgAnswer, name string, dnsType uint16, expiresAt time.Time, depth int, threadID int) {
 	key := makeCacheKey(name, dnsType)
-	expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
-	s.CacheMutex.Lock()
-	// don't bother to move this to the top of the linked list. we're going
-	// to add this record back in momentarily and that will take care of this
-	i, ok := s.IterativeCache.GetNoMove(key)
-	ca, ok := i.(CachedResult)
-	if !ok && i != nil {
-		panic("unable to cast cached result")
-	}
-	if !ok {
-		ca = CachedResult{}
-		ca.Answers = make(map[interface{}]TimedAnswer)
-	}
-	// we have an existing record. Let's add this answer to it.
 	ta := TimedAnswer{
 		Answer:    answer,
 		ExpiresAt: expiresAt}
-	ca.Answers[a] = ta
-	s.VerboseGlobalLog(depth+1, threadID, "Add cached answer ", key, " ", ca)
-	s.IterativeCache.Add(key, ca)
-	s.CacheMutex.Unlock()
+	s.IterativeCache.Update(key, func(i interface{}, found bool) (interface{}, time.Time) {
+		old, ok := i.(CachedResult)
+		if !ok && found {
+			panic("unable to cast cached result")
+		}
+		// cached results are read without holding the lock of their shard,
+		// so rather than adding to the existing map, build a new one that
+		// also drops the answers that have expired. The entry expires with
+		// the last of its answers.
+		now := time.Now()
+		ca := CachedResult{Answers: make(map[interface{}]TimedAnswer, len(old.Answers)+1)}
+		for k, v := range old.Answers {
+			if !v.ExpiresAt.Before(now) {
+				ca.Answers[k] = v
+				if v.ExpiresAt.After(expiresAt) {
+					expiresAt = v.ExpiresAt
+				}
+			}
+		}
+		ca.Answers[answer] = ta
+		s.VerboseGlobalLog(depth+1, threadID, "Add cached answer ", key, " ", ca)
+		return ca, expiresAt
+	})
 }
 
 func (s *GlobalLookupFactory) GetCachedResult(name string, dnsType uint16, isAuthCheck bool, depth int, threadID int) (zdns.MiekgResult, bool) {
 	s.VerboseGlobalLog(depth+1, threadID, "Cache request for: ", name, " (", dnsType, ")")
 	var retv zdns.MiekgResult
 	key := makeCacheKey(name, dnsType)
-	s.CacheMutex.Lock()
 	unres, ok := s.IterativeCache.Get(key)
 	if !ok { // nothing found
 		s.VerboseGlobalLog(depth+2, threadID, "-> no entry found in cache")
-		s.CacheMutex.Unlock()
+		metrics.CacheRequest(false)
 		return retv, false
 	}
 	retv.Authorities = make([]interface{}, 0)
@@ -384,15 +723,13 @@ func (s *GlobalLookupFactory) GetCachedResult(name string, dnsType uint16, isAut
 		panic("bad cache entry")
 	}
 	// great we have a result. let's go through the entries and build
-	// and build a result. In the process, throw away anything that's expired
+	// and build a result. In the process, skip anything that's expired. The
+	// entry is shared with other threads, so it is left as it is; expired
+	// answers are dropped when the next answer is added.
 	now := time.Now()
 	for k, cachedAnswer := range cachedRes.Answers {
 		if cachedAnswer.ExpiresAt.Before(now) {
-			// if we have a write lock, we can perform the necessary actions
-			// and then write this back to the cache. However, if we don't,
-			// we need to start this process over with a write lock
-			s.VerboseGlobalLog(depth+2, threadID, "Expiring cache entry ", k)
-			delete(cachedRes.Answers, k)
+			s.VerboseGlobalLog(depth+2, threadID, "Skipping expired cache entry ", k)
 		} else {
 			// this result is valid. append it to the Result we're going to hand to the user
 			if isAuthCheck {
@@ -402,27 +739,78 @@ func (s *GlobalLookupFactory) GetCachedResult(name string, dnsType uint16, isAut
 			}
 		}
 	}
-	s.CacheMutex.Unlock()
 	// Don't return an empty response.
 	if len(retv.Answers) == 0 && len(retv.Authorities) == 0 && len(retv.Additional) == 0 {
 		s.VerboseGlobalLog(depth+2, threadID, "-> no entry found in cache, after expiration")
+		metrics.CacheRequest(false)
 		var emptyRetv zdns.MiekgResult
 		return emptyRetv, false
 	}
+	metrics.CacheRequest(true)
 
 	s.VerboseGlobalLog(depth+2, threadID, "Cache hit: ", retv)
 	return retv, true
 }
 
+// AddCachedNegative caches that name has no records of dnsType, or does not
+// exist at all, for the TTL of soa capped by its minimum field (RFC 2308)
+func (s *GlobalLookupFactory) AddCachedNegative(name string, dnsType uint16, status zdns.Status, soa *dns.SOA, depth int, threadID int) {
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	if ttl == 0 {
+		return
+	}
+	neg := NegativeResult{Status: status, SOA: ParseAnswer(soa).(SOAAnswer)}
+	s.addCachedNegative(neg, name, dnsType, time.Now().Add(time.Duration(ttl)*time.Second), depth, threadID)
+}
+
+func (s *GlobalLookupFactory) addCachedNegative(neg NegativeResult, name string, dnsType uint16, expiresAt time.Time, depth int, threadID int) {
+	key := makeCacheKey(name, dnsType)
+	key.Negative = true
+	s.VerboseGlobalLog(depth+1, threadID, "Add cached negative answer ", key, " ", neg)
+	s.IterativeCache.AddExpiring(key, neg, expiresAt)
+}
+
+// GetCachedNegative returns a cached NXDOMAIN or NODATA response for name and
+// dnsType. The result holds the SOA record in its authority section, with the
+// TTL that was left when it was cached.
+func (s *GlobalLookupFactory) GetCachedNegative(name string, dnsType uint16, depth int, threadID int) (zdns.MiekgResult, zdns.Status, bool) {
+	var retv zdns.MiekgResult
+	key := makeCacheKey(name, dnsType)
+	key.Negative = true
+	v, ok := s.IterativeCache.Get(key)
+	if !ok {
+		return retv, "", false
+	}
+	neg, ok := v.(NegativeResult)
+	if !ok {
+		panic("bad negative cache entry")
+	}
+	retv.Answers = make([]interface{}, 0)
+	retv.Additional = make([]interface{}, 0)
+	retv.Authorities = []interface{}{neg.SOA}
+	retv.Flags.Authoritative = true
+	if neg.Status == zdns.STATUS_NXDOMAIN {
+		retv.Flags.ErrorCode = dns.RcodeNameError
+	}
+	s.VerboseGlobalLog(depth+2, threadID, "Negative cache hit: ", neg.Status, " ", retv)
+	return retv, neg.Status, true
+}
+
 type RoutineLookupFactory struct {
 	Factory             *GlobalLookupFactory
 	Client              *dns.Client
 	TCPClient           *dns.Client
+	StreamClient        Exchanger
+	EDNS                *dns.OPT
 	Retries             int
 	MaxDepth            int
 	Timeout             time.Duration
-	IterativeTimeout    time.Duration
 	IterativeResolution bool
+	ValidateDNSSEC      bool
+	RawResponse         bool
 	Trace               bool
 	DNSType             uint16
 	DNSClass            uint16
@@ -430,10 +818,12 @@ type RoutineLookupFactory struct {
 }
 
 func (s *RoutineLookupFactory) Initialize(c *zdns.GlobalConf) {
+	// Timeout bounds the first attempt of a single query. The lookup of a
+	// whole name is bounded by the deadline of its context.
 	if c.IterativeResolution {
 		s.Timeout = c.IterationTimeout
 	} else {
-		s.Timeout = c.Timeout
+		s.Timeout = AttemptTimeout(c.Timeout, c.Retries)
 	}
 
 	s.Client = new(dns.Client)
@@ -443,18 +833,39 @@ func (s *RoutineLookupFactory) Initialize(c *zdns.GlobalConf) {
 	s.TCPClient.Net = "tcp"
 	s.TCPClient.Timeout = s.Timeout
 
-	s.IterativeTimeout = c.Timeout
+	switch c.Transport {
+	case zdns.TRANSPORT_TLS:
+		s.StreamClient = NewTLSClient(c.TLSConfig, s.Timeout)
+	case zdns.TRANSPORT_HTTPS:
+		s.StreamClient = NewHTTPSClient(NewHTTP2Client(c.TLSConfig, s.Timeout), c.HTTPSMethod)
+	}
+	if c.EDNS {
+		s.EDNS = MakeOPT(c)
+	}
+
 	s.Retries = c.Retries
 	s.MaxDepth = c.MaxDepth
 	s.IterativeResolution = c.IterativeResolution
+	s.ValidateDNSSEC = c.ValidateDNSSEC
+	s.RawResponse = c.RawResponse
 	s.Trace = c.Trace
 
 	s.DNSClass = c.Class
 }
 
+// Close shuts down the connections held open by the stream client, if any
+func (s *RoutineLookupFactory) Close() {
+	if s.StreamClient != nil {
+		s.StreamClient.Close()
+	}
+}
+
 func (s *RoutineLookupFactory) MakeLookup() (zdns.Lookup, error) {
 	a := Lookup{Factory: s}
-	nameServer := s.Factory.RandomNameServer()
+	nameServer, err := s.Factory.RandomNameServer()
+	if err != nil {
+		return nil, err
+	}
 	a.Initialize(nameServer, s.DNSType, s.DNSClass, s)
 	return &a, nil
 }
@@ -467,7 +878,18 @@ type Lookup struct {
 	DNSClass      uint16
 	Prefix        string
 	NameServer    string
-	IterativeStop time.Time
+	// Targets are the name servers that targeted input gives for the input
+	// name, which replace NameServer for lookups of that name
+	Targets []string
+
+	// the name server that the last attempt of a lookup was sent to
+	lastNameServer string
+
+	// trace of the lookups made by fetchRRset while a result is validated
+	dnssecTrace []interface{}
+	// response to the last query made while iterating, or nil if the query
+	// was answered from the cache. It is what DNSSEC validation checks.
+	response *dns.Msg
 }
 
 func (s *Lookup) Initialize(nameServer string, dnsType uint16, dnsClass uint16, factory *RoutineLookupFactory) error {
@@ -478,56 +900,222 @@ func (s *Lookup) Initialize(nameServer string, dnsType uint16, dnsClass uint16,
 	return nil
 }
 
-func (s *Lookup) doLookup(dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool) (zdns.MiekgResult, zdns.Status, error) {
-	return DoLookupWorker(s.Factory.Client, s.Factory.TCPClient, dnsType, dnsClass, name, nameServer, recursive)
+// SetNameServers makes lookups of the input name query nameServers instead of
+// the one picked by MakeLookup, moving on to the next of them on every retry.
+// For iterative lookups, they are where iteration starts.
+func (s *Lookup) SetNameServers(nameServers []string) {
+	s.Targets = nameServers
+}
+
+// LastNameServer returns the name server that the last attempt of a lookup
+// was sent to
+func (s *Lookup) LastNameServer() string {
+	return s.lastNameServer
+}
+
+// Untargeted returns a copy of the lookup that ignores the name servers of
+// SetNameServers. Modules use it to look up other names than the input
+// name, e.g. the addresses of its name servers, which the servers targeted
+// at the input name usually do not answer for.
+func (s *Lookup) Untargeted() *Lookup {
+	c := *s
+	c.Targets = nil
+	return &c
+}
+
+// nameServers returns the name servers that lookups of the input name go to
+func (s *Lookup) nameServers() []string {
+	if len(s.Targets) > 0 {
+		return s.Targets
+	}
+	return []string{s.NameServer}
+}
+
+// startIterative iterates from the name servers that lookups of the input
+// name go to, moving on to the next of them while they time out
+func (s *Lookup) startIterative(ctx context.Context, dnsType uint16, dnsClass uint16, name string) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
+	servers := s.nameServers()
+	trace := make([]interface{}, 0)
+	for i, ns := range servers {
+		s.lastNameServer = ns
+		result, t, status, err := s.iterativeLookup(ctx, dnsType, dnsClass, name, ns, 1, ".", trace)
+		trace = t
+		switch status {
+		case zdns.STATUS_TIMEOUT, zdns.STATUS_TEMPORARY, zdns.STATUS_ITER_TIMEOUT:
+			if i+1 < len(servers) && ctx.Err() == nil {
+				continue
+			}
+		}
+		return result, trace, status, err
+	}
+	panic("loop must return")
+}
+
+func (s *Lookup) doLookup(ctx context.Context, dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool, history *[]Exchange) (zdns.MiekgResult, *dns.Msg, zdns.Status, error) {
+	sent := 0
+	if history != nil {
+		sent = len(*history)
+	}
+	res, r, status, err := doLookupWorker(ctx, s.Factory.Client, s.Factory.TCPClient, s.Factory.StreamClient, s.Factory.EDNS, dnsType, dnsClass, name, nameServer, recursive, history)
+	if s.Factory.ValidateDNSSEC && r != nil {
+		s.Factory.Factory.RecordSignedResponse(r)
+	}
+	// a response that could not be parsed is always kept for later study
+	if !s.Factory.RawResponse && r != nil {
+		res.Raw = nil
+	}
+	if !s.Factory.RawResponse && history != nil {
+		for i := sent; i < len(*history); i++ {
+			(*history)[i].Query = nil
+			(*history)[i].Response = nil
+		}
+	}
+	return res, r, status, err
+}
+
+// MakeOPT builds the OPT record attached to queries when EDNS0 is enabled
+func MakeOPT(c *zdns.GlobalConf) *dns.OPT {
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(uint16(c.UDPBufferSize))
+	if c.DNSSEC {
+		opt.SetDo()
+	}
+	if c.NSID {
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	}
+	if c.ClientSubnet != nil {
+		opt.Option = append(opt.Option, c.ClientSubnet)
+	}
+	return opt
+}
+
+func parseEDNS(opt *dns.OPT) *zdns.EDNSResult {
+	res := &zdns.EDNSResult{
+		Version:       opt.Version(),
+		UDPSize:       opt.UDPSize(),
+		DO:            opt.Do(),
+		ExtendedRcode: opt.ExtendedRcode(),
+	}
+	for _, o := range opt.Option {
+		switch e := o.(type) {
+		case *dns.EDNS0_NSID:
+			// NSID is carried hex-encoded. Most servers put a readable name in it.
+			if b, err := hex.DecodeString(e.Nsid); err == nil {
+				res.NSID = string(b)
+			} else {
+				res.NSID = e.Nsid
+			}
+		case *dns.EDNS0_SUBNET:
+			res.ClientSubnet = &zdns.EDNSClientSubnet{
+				Family:       e.Family,
+				SourcePrefix: e.SourceNetmask,
+				ScopePrefix:  e.SourceScope,
+				Address:      e.Address.String(),
+			}
+		}
+	}
+	return res
+}
+
+// Expose the inner logic so other tools can use it. If stream is non-nil,
+// the query is sent over it instead of UDP with TCP fallback. If edns is
+// non-nil, it is attached to the query as the OPT record. The exchange is
+// abandoned once ctx is done; if ctx has no deadline, the timeout of the
+// client applies.
+func DoLookupWorker(ctx context.Context, udp *dns.Client, tcp *dns.Client, stream Exchanger, edns *dns.OPT, dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool) (zdns.MiekgResult, zdns.Status, error) {
+	res, _, status, err := doLookupWorker(ctx, udp, tcp, stream, edns, dnsType, dnsClass, name, nameServer, recursive, nil)
+	return res, status, err
 }
 
-// Expose the inner logic so other tools can use it
-func DoLookupWorker(udp *dns.Client, tcp *dns.Client, dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool) (zdns.MiekgResult, zdns.Status, error) {
+// doLookupWorker also hands back the response message, if one was received,
+// and appends every exchange it makes to history unless history is nil
+func doLookupWorker(ctx context.Context, udp *dns.Client, tcp *dns.Client, stream Exchanger, edns *dns.OPT, dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool, history *[]Exchange) (zdns.MiekgResult, *dns.Msg, zdns.Status, error) {
 	res := zdns.MiekgResult{Answers: []interface{}{}, Authorities: []interface{}{}, Additional: []interface{}{}}
 
 	m := new(dns.Msg)
 	m.SetQuestion(dotName(name), dnsType)
 	m.Question[0].Qclass = dnsClass
 	m.RecursionDesired = recursive
+	if edns != nil {
+		m.Extra = append(m.Extra, edns)
+	}
 
+	var r *dns.Msg
+	var w Wire
+	var err error
+	// record notes an exchange in history and the RTT of the response
+	// that is reported
+	record := func() {
+		e := newExchange(res.Protocol, m.Id, w, r, err)
+		res.RTT = e.RTT
+		res.Raw = w.Response
+		if history != nil {
+			*history = append(*history, e)
+		}
+	}
 	useTCP := false
-	res.Protocol = "udp"
-
-	r, _, err := udp.Exchange(m, nameServer)
+	if stream != nil {
+		res.Protocol = stream.Protocol()
+		r, w, err = stream.Exchange(ctx, m, nameServer)
+		// there is no fallback from a stream transport
+		useTCP = true
+	} else {
+		res.Protocol = "udp"
+		r, w, err = exchange(ctx, udp, m, nameServer)
+	}
+	record()
 
 	// See https://github.com/miekg/dns/pull/815 -- if the unpack got far enough to tell that it was
 	// truncated, r.Truncated will be set. If it didn't get that far, then it's just an error.
-	if r != nil && r.Truncated {
+	if r != nil && r.Truncated && !useTCP {
 		if tcp == nil {
-			return res, zdns.STATUS_TRUNCATED, err
+			return res, nil, zdns.STATUS_TRUNCATED, err
 		}
+		metrics.TCPFallbacks.Inc()
 
-		r, _, err = tcp.Exchange(m, nameServer)
-		useTCP = true
 		res.Protocol = "tcp"
+		r, w, err = exchange(ctx, tcp, m, nameServer)
+		record()
+		useTCP = true
 	}
 	if err != nil || r == nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return res, nil, zdns.STATUS_TIMEOUT, nil
+		case context.Canceled:
+			return res, nil, zdns.STATUS_ERROR, ctx.Err()
+		}
 		if nerr, ok := err.(net.Error); ok {
 			if nerr.Timeout() {
-				return res, zdns.STATUS_TIMEOUT, nil
+				return res, nil, zdns.STATUS_TIMEOUT, nil
 			} else if nerr.Temporary() {
-				return res, zdns.STATUS_TEMPORARY, err
+				return res, nil, zdns.STATUS_TEMPORARY, err
 			}
 		}
-		return res, zdns.STATUS_ERROR, err
+		return res, nil, zdns.STATUS_ERROR, err
 	}
 	if r.Rcode == dns.RcodeBadTrunc && !useTCP {
 		if tcp == nil {
-			return res, zdns.STATUS_TRUNCATED, err
+			return res, nil, zdns.STATUS_TRUNCATED, err
 		}
-		r, _, err = tcp.Exchange(m, nameServer)
+		metrics.TCPFallbacks.Inc()
+		res.Protocol = "tcp"
+		r, w, err = exchange(ctx, tcp, m, nameServer)
+		record()
 	}
 	if err != nil || r == nil {
-		return res, zdns.STATUS_ERROR, err
+		return res, nil, zdns.STATUS_ERROR, err
+	}
+	rcode := r.Rcode
+	if opt := r.IsEdns0(); opt != nil {
+		res.EDNS = parseEDNS(opt)
+		// the upper eight bits of a 12-bit rcode live in the OPT record
+		rcode |= opt.ExtendedRcode() << 4
 	}
-	if r.Rcode != dns.RcodeSuccess {
-		return res, TranslateMiekgErrorCode(r.Rcode), nil
+	if rcode != dns.RcodeSuccess {
+		return res, r, TranslateMiekgErrorCode(rcode), nil
 	}
 
 	res.Flags.Response = r.Response
@@ -547,6 +1135,10 @@ func DoLookupWorker(udp *dns.Client, tcp *dns.Client, dnsType uint16, dnsClass u
 		}
 	}
 	for _, ans := range r.Extra {
+		if ans.Header().Rrtype == dns.TypeOPT {
+			// already reported in res.EDNS
+			continue
+		}
 		inner := ParseAnswer(ans)
 		if inner != nil {
 			res.Additional = append(res.Additional, inner)
@@ -558,7 +1150,7 @@ func DoLookupWorker(udp *dns.Client, tcp *dns.Client, dnsType uint16, dnsClass u
 			res.Authorities = append(res.Authorities, inner)
 		}
 	}
-	return res, zdns.STATUS_NOERROR, nil
+	return res, r, zdns.STATUS_NOERROR, nil
 }
 
 func (s *Lookup) SafeAddCachedAnswer(a interface{}, layer string, debugType string, depth int) {
@@ -589,9 +1181,43 @@ func (s *Lookup) cacheUpdate(layer string, result zdns.MiekgResult, depth int) {
 	}
 }
 
-func (s *Lookup) tracedRetryingLookup(dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
+// cacheNegative caches r if it is an NXDOMAIN response, or an authoritative
+// NODATA response, that carries an SOA record from within layer
+func (s *Lookup) cacheNegative(layer string, name string, dnsType uint16, r *dns.Msg, depth int) {
+	var status zdns.Status
+	switch {
+	case r.Rcode == dns.RcodeNameError:
+		status = zdns.STATUS_NXDOMAIN
+	case r.Rcode == dns.RcodeSuccess && r.Authoritative && len(r.Answer) == 0:
+		status = zdns.STATUS_NOERROR
+	default:
+		return
+	}
+	for _, rr := range r.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if ok, _ := nameIsBeneath(soa.Hdr.Name, layer); !ok {
+			log.Info("detected poison negative answer: ", soa.Hdr.Name, ": ", layer, ": ", name)
+			return
+		}
+		zone := strings.TrimSuffix(strings.ToLower(soa.Hdr.Name), ".")
+		if zone == "" {
+			zone = "."
+		}
+		// the SOA record is that of the zone the name would be in
+		if ok, _ := nameIsBeneath(name, zone); !ok {
+			return
+		}
+		s.Factory.Factory.AddCachedNegative(name, dnsType, status, soa, depth, s.Factory.ThreadID)
+		return
+	}
+}
 
-	res, status, err := s.retryingLookup(dnsType, dnsClass, name, nameServer, recursive)
+func (s *Lookup) tracedRetryingLookup(ctx context.Context, dnsType uint16, dnsClass uint16, name string, nameServers []string, recursive bool) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
+
+	res, _, history, status, err := s.retryingLookup(ctx, dnsType, dnsClass, name, nameServers, recursive)
 
 	trace := make([]interface{}, 0)
 
@@ -601,57 +1227,101 @@ func (s *Lookup) tracedRetryingLookup(dnsType uint16, dnsClass uint16, name stri
 		t.DnsType = dnsType
 		t.DnsClass = dnsClass
 		t.Name = name
-		t.NameServer = nameServer
+		t.NameServer = s.lastNameServer
 		t.Layer = name
 		t.Depth = 1
 		t.Cached = false
+		t.Status = status
+		t.Exchanges = history
 		trace = append(trace, t)
 	}
 
 	return res, trace, status, err
 }
 
-func (s *Lookup) retryingLookup(dnsType uint16, dnsClass uint16, name string, nameServer string, recursive bool) (zdns.MiekgResult, zdns.Status, error) {
-	s.VerboseLog(1, "****WIRE LOOKUP***", name, " ", nameServer)
+// retryingLookup also returns the last response received and the exchanges
+// made on the wire if tracing is enabled. Every retry goes to the next of
+// nameServers.
+func (s *Lookup) retryingLookup(ctx context.Context, dnsType uint16, dnsClass uint16, name string, nameServers []string, recursive bool) (zdns.MiekgResult, *dns.Msg, []Exchange, zdns.Status, error) {
+	s.VerboseLog(1, "****WIRE LOOKUP***", name, " ", nameServers)
 
 	if dnsType == dns.TypePTR {
 		var err error
 		name, err = dns.ReverseAddr(name)
 		if err != nil {
 			var r zdns.MiekgResult
-			return r, zdns.STATUS_ILLEGAL_INPUT, err
+			return r, nil, nil, zdns.STATUS_ILLEGAL_INPUT, err
 		}
 		name = name[:len(name)-1]
 	}
 
-	origTimeout := s.Factory.Client.Timeout
+	var history []Exchange
+	var historyPtr *[]Exchange
+	if s.Factory.Trace {
+		historyPtr = &history
+	}
 	for i := 0; i < s.Factory.Retries; i++ {
-		result, status, err := s.doLookup(dnsType, dnsClass, name, nameServer, recursive)
-		if (status != zdns.STATUS_TIMEOUT && status != zdns.STATUS_TEMPORARY) || i+1 == s.Factory.Retries {
-			s.Factory.Client.Timeout = origTimeout
-			s.Factory.TCPClient.Timeout = origTimeout
-			return result, status, err
+		nameServer := nameServers[i%len(nameServers)]
+		s.lastNameServer = nameServer
+		if l := s.Factory.Factory.Limiter; l != nil {
+			if err := l.Wait(ctx, nameServer); err != nil {
+				r := zdns.MiekgResult{Attempts: i}
+				if err == context.Canceled {
+					return r, nil, history, zdns.STATUS_ERROR, err
+				}
+				return r, nil, history, zdns.STATUS_TIMEOUT, nil
+			}
+		}
+		if i > 0 {
+			metrics.Retries.Inc()
+		}
+		metrics.Queries.WithLabelValues(s.Factory.Factory.serverLabel(nameServer)).Inc()
+		// every retry waits twice as long as the previous attempt, but
+		// never past the deadline of the whole lookup
+		attemptCtx, cancel := context.WithTimeout(ctx, s.Factory.Timeout<<uint(i))
+		start := time.Now()
+		sent := len(history)
+		result, msg, status, err := s.doLookup(attemptCtx, dnsType, dnsClass, name, nameServer, recursive, historyPtr)
+		cancel()
+		result.Attempts = i + 1
+		for j := sent; j < len(history); j++ {
+			history[j].Attempt = i + 1
+		}
+		switch status {
+		case zdns.STATUS_TIMEOUT, zdns.STATUS_TEMPORARY, zdns.STATUS_ERROR, zdns.STATUS_TRUNCATED:
+		default:
+			// only queries that were answered have a round trip time
+			metrics.QueryDuration.WithLabelValues(result.Protocol).Observe(time.Since(start).Seconds())
+		}
+		if (status != zdns.STATUS_TIMEOUT && status != zdns.STATUS_TEMPORARY) || i+1 == s.Factory.Retries || ctx.Err() != nil {
+			return result, msg, history, status, err
 		}
-		s.Factory.Client.Timeout = 2 * s.Factory.Client.Timeout
-		s.Factory.TCPClient.Timeout = 2 * s.Factory.TCPClient.Timeout
 	}
 	panic("loop must return")
 }
 
-func (s *Lookup) cachedRetryingLookup(dnsType uint16, dnsClass uint16, name string, nameServer string, layer string, depth int) (zdns.MiekgResult, IsCached, zdns.Status, error) {
+func (s *Lookup) cachedRetryingLookup(ctx context.Context, dnsType uint16, dnsClass uint16, name string, nameServer string, layer string, depth int) (zdns.MiekgResult, []Exchange, IsCached, zdns.Status, error) {
 	var isCached IsCached
 	isCached = false
+	s.response = nil
 	s.VerboseLog(depth+1, "Cached retrying lookup. Name: ", name, ", Layer: ", layer, ", Nameserver: ", nameServer)
-	if s.IterativeStop.Before(time.Now()) {
-		s.VerboseLog(depth+2, "ITERATIVE_TIMEOUT ", name, ", Layer: ", layer, ", Nameserver: ", nameServer)
+	if err := ctx.Err(); err != nil {
 		var r zdns.MiekgResult
-		return r, isCached, zdns.STATUS_ITER_TIMEOUT, nil
+		if err == context.Canceled {
+			return r, nil, isCached, zdns.STATUS_ERROR, err
+		}
+		s.VerboseLog(depth+2, "ITERATIVE_TIMEOUT ", name, ", Layer: ", layer, ", Nameserver: ", nameServer)
+		return r, nil, isCached, zdns.STATUS_ITER_TIMEOUT, nil
 	}
 	// First, we check the answer
 	cachedResult, ok := s.Factory.Factory.GetCachedResult(name, dnsType, false, depth+1, s.Factory.ThreadID)
 	if ok {
 		isCached = true
-		return cachedResult, isCached, zdns.STATUS_NOERROR, nil
+		return cachedResult, nil, isCached, zdns.STATUS_NOERROR, nil
+	}
+	if cachedResult, status, ok := s.Factory.Factory.GetCachedNegative(name, dnsType, depth+1, s.Factory.ThreadID); ok {
+		isCached = true
+		return cachedResult, nil, isCached, status, nil
 	}
 
 	nameServerIP, _, err := net.SplitHostPort(nameServer)
@@ -662,12 +1332,12 @@ func (s *Lookup) cachedRetryingLookup(dnsType uint16, dnsClass uint16, name stri
 			s.Factory.Factory.BlMu.Unlock()
 			s.VerboseLog(depth+2, "Blacklist error!", err)
 			var r zdns.MiekgResult
-			return r, isCached, zdns.STATUS_ERROR, err
+			return r, nil, isCached, zdns.STATUS_ERROR, err
 		} else if blacklisted {
 			s.Factory.Factory.BlMu.Unlock()
 			s.VerboseLog(depth+2, "Hit blacklisted nameserver ", name, ", Layer: ", layer, ", Nameserver: ", nameServer)
 			var r zdns.MiekgResult
-			return r, isCached, zdns.STATUS_BLACKLIST, nil
+			return r, nil, isCached, zdns.STATUS_BLACKLIST, nil
 		}
 		s.Factory.Factory.BlMu.Unlock()
 	}
@@ -680,22 +1350,26 @@ func (s *Lookup) cachedRetryingLookup(dnsType uint16, dnsClass uint16, name stri
 		if authName == "" {
 			s.VerboseLog(depth+2, "Can't parse name to authority properly. name: ", name, ", layer: ", layer)
 			var r zdns.MiekgResult
-			return r, isCached, zdns.STATUS_AUTHFAIL, nil
+			return r, nil, isCached, zdns.STATUS_AUTHFAIL, nil
 		}
 		s.VerboseLog(depth+2, "Cache auth check for ", authName)
 		cachedResult, ok = s.Factory.Factory.GetCachedResult(authName, dns.TypeNS, true, depth+2, s.Factory.ThreadID)
 		if ok {
 			isCached = true
-			return cachedResult, isCached, zdns.STATUS_NOERROR, nil
+			return cachedResult, nil, isCached, zdns.STATUS_NOERROR, nil
 		}
 	}
 
 	s.VerboseLog(depth+2, "Wire lookup for name: ", name, " (", dnsType, ") at nameserver: ", nameServer)
 	// Alright, we're not sure what to do, go to the wire.
-	result, status, err := s.retryingLookup(dnsType, dnsClass, name, nameServer, false)
+	result, msg, history, status, err := s.retryingLookup(ctx, dnsType, dnsClass, name, []string{nameServer}, false)
+	s.response = msg
 
 	s.cacheUpdate(layer, result, depth+2)
-	return result, isCached, status, err
+	if msg != nil {
+		s.cacheNegative(layer, name, dnsType, msg, depth+2)
+	}
+	return result, history, isCached, status, err
 }
 
 func nameIsBeneath(name string, layer string) (bool, string) {
@@ -764,7 +1438,7 @@ func (s *Lookup) checkGlue(server string, depth int, result zdns.MiekgResult) (z
 	return r, zdns.STATUS_SERVFAIL
 }
 
-func (s *Lookup) extractAuthority(authority interface{}, layer string, depth int, result zdns.MiekgResult, trace []interface{}) (string, zdns.Status, string, []interface{}) {
+func (s *Lookup) extractAuthority(ctx context.Context, authority interface{}, layer string, depth int, result zdns.MiekgResult, trace []interface{}) (string, zdns.Status, string, []interface{}) {
 
 	// Is it an answer
 	ans, ok := authority.(zdns.MiekgAnswer)
@@ -786,7 +1460,7 @@ func (s *Lookup) extractAuthority(authority interface{}, layer string, depth int
 	res, status := s.checkGlue(server, depth, result)
 	if status != zdns.STATUS_NOERROR {
 		// Fall through to normal query
-		res, trace, status, _ = s.iterativeLookup(dns.TypeA, dns.ClassINET, server, s.NameServer, depth+1, ".", trace)
+		res, trace, status, _ = s.iterativeLookup(ctx, dns.TypeA, dns.ClassINET, server, s.NameServer, depth+1, ".", trace)
 	}
 	if status == zdns.STATUS_ITER_TIMEOUT {
 		return "", status, "", trace
@@ -848,14 +1522,14 @@ func handleStatus(status *zdns.Status, err error) (*zdns.Status, error) {
 	}
 }
 
-func (s *Lookup) iterateOnAuthorities(dnsType uint16, dnsClass uint16, name string, depth int, result zdns.MiekgResult, layer string, trace []interface{}) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
+func (s *Lookup) iterateOnAuthorities(ctx context.Context, dnsType uint16, dnsClass uint16, name string, depth int, result zdns.MiekgResult, layer string, trace []interface{}) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
 	if len(result.Authorities) == 0 {
 		var r zdns.MiekgResult
 		return r, trace, zdns.STATUS_SERVFAIL, nil
 	}
 	for _, elem := range result.Authorities {
 		s.VerboseLog(depth+1, "Trying Authority: ", elem)
-		ns, ns_status, layer, trace := s.extractAuthority(elem, layer, depth, result, trace)
+		ns, ns_status, layer, trace := s.extractAuthority(ctx, elem, layer, depth, result, trace)
 		s.VerboseLog((depth + 1), "Output from extract authorities: ", ns)
 		if ns_status == zdns.STATUS_ITER_TIMEOUT {
 			s.VerboseLog((depth + 2), "--> Hit iterative timeout: ")
@@ -873,7 +1547,7 @@ func (s *Lookup) iterateOnAuthorities(dnsType uint16, dnsClass uint16, name stri
 				return r, trace, *new_status, err
 			}
 		}
-		r, trace, status, err := s.iterativeLookup(dnsType, dnsClass, name, ns, depth+1, layer, trace)
+		r, trace, status, err := s.iterativeLookup(ctx, dnsType, dnsClass, name, ns, depth+1, layer, trace)
 		if status != zdns.STATUS_NOERROR {
 			new_status, err := handleStatus(&status, err)
 			// default case is a status we don't handle, so we continue
@@ -894,7 +1568,7 @@ func (s *Lookup) iterateOnAuthorities(dnsType uint16, dnsClass uint16, name stri
 	return r, trace, zdns.STATUS_ERROR, errors.New("could not find authoritative name server")
 }
 
-func (s *Lookup) iterativeLookup(dnsType uint16, dnsClass uint16, name string, nameServer string, depth int, layer string, trace []interface{}) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
+func (s *Lookup) iterativeLookup(ctx context.Context, dnsType uint16, dnsClass uint16, name string, nameServer string, depth int, layer string, trace []interface{}) (zdns.MiekgResult, []interface{}, zdns.Status, error) {
 	if log.GetLevel() == log.DebugLevel {
 		//s.VerboseLog((depth), "iterative lookup for ", name, " (", dnsType, ") against ", nameServer, " (", debugReverseLookup(nameServer), ") layer ", layer)
 		s.VerboseLog((depth), "iterative lookup for ", name, " (", dnsType, ") against ", nameServer, " layer ", layer)
@@ -904,8 +1578,10 @@ func (s *Lookup) iterativeLookup(dnsType uint16, dnsClass uint16, name string, n
 		s.VerboseLog((depth + 1), "-> Max recursion depth reached")
 		return r, trace, zdns.STATUS_ERROR, errors.New("Max recursion depth reached")
 	}
-	result, isCached, status, err := s.cachedRetryingLookup(dnsType, dnsClass, name, nameServer, layer, depth)
-	if s.Factory.Trace && status == zdns.STATUS_NOERROR {
+	result, history, isCached, status, err := s.cachedRetryingLookup(ctx, dnsType, dnsClass, name, nameServer, layer, depth)
+	// every step is traced whatever its status, so that the trace (and the
+	// dnstap output made from it) holds every exchange on the wire
+	if s.Factory.Trace {
 		var t TraceStep
 		t.Result = result
 		t.DnsType = dnsType
@@ -915,6 +1591,8 @@ func (s *Lookup) iterativeLookup(dnsType uint16, dnsClass uint16, name string, n
 		t.Layer = layer
 		t.Depth = depth
 		t.Cached = isCached
+		t.Status = status
+		t.Exchanges = history
 		trace = append(trace, t)
 
 	}
@@ -938,83 +1616,91 @@ func (s *Lookup) iterativeLookup(dnsType uint16, dnsClass uint16, name string, n
 		return result, trace, status, err
 	} else if len(result.Authorities) != 0 {
 		s.VerboseLog((depth + 1), "-> Authority found, iterating")
-		return s.iterateOnAuthorities(dnsType, dnsClass, name, depth, result, layer, trace)
+		return s.iterateOnAuthorities(ctx, dnsType, dnsClass, name, depth, result, layer, trace)
 	} else {
 		s.VerboseLog((depth + 1), "-> No Authority found, error")
 		return result, trace, zdns.STATUS_ERROR, errors.New("NOERROR record without any answers or authorities")
 	}
 }
 
-func (s *Lookup) DoMiekgLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoMiekgLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
 	if s.Factory.IterativeResolution {
 		s.VerboseLog(0, "MIEKG-IN: iterative lookup for ", name, " (", s.DNSType, ")")
-		s.IterativeStop = time.Now().Add(time.Duration(s.Factory.IterativeTimeout))
-		result, trace, status, err := s.iterativeLookup(s.DNSType, s.DNSClass, name, s.NameServer, 1, ".", make([]interface{}, 0))
+		result, trace, status, err := s.startIterative(ctx, s.DNSType, s.DNSClass, name)
 		s.VerboseLog(0, "MIEKG-OUT: iterative lookup for ", name, " (", s.DNSType, "): status: ", status, " , err: ", err)
+		if s.Factory.ValidateDNSSEC {
+			result.DNSSEC, trace = s.validateResult(ctx, name, s.DNSType, status, trace)
+		}
 		if s.Factory.Trace {
 			return result, trace, status, err
 		}
 		return result, trace, status, err
 
 	} else {
-		return s.tracedRetryingLookup(s.DNSType, s.DNSClass, name, s.NameServer, true)
+		return s.tracedRetryingLookup(ctx, s.DNSType, s.DNSClass, name, s.nameServers(), true)
 	}
 }
 
-func (s *Lookup) DoMiekgLookupForClass(name string, dnsClass uint16) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoMiekgLookupForClass(ctx context.Context, name string, dnsClass uint16) (interface{}, []interface{}, zdns.Status, error) {
 	if s.Factory.IterativeResolution {
 		s.VerboseLog(0, "MIEKG-IN: iterative lookup for ", name, " (", s.DNSType, ") in class ", dnsClass)
-		s.IterativeStop = time.Now().Add(time.Duration(s.Factory.IterativeTimeout))
-		result, trace, status, err := s.iterativeLookup(s.DNSType, s.DNSClass, name, s.NameServer, 1, ".", make([]interface{}, 0))
+		result, trace, status, err := s.startIterative(ctx, s.DNSType, s.DNSClass, name)
 		s.VerboseLog(0, "MIEKG-OUT: iterative lookup for ", name, " (", s.DNSType, "): status: ", status, " , err: ", err)
+		if s.Factory.ValidateDNSSEC {
+			result.DNSSEC, trace = s.validateResult(ctx, name, s.DNSType, status, trace)
+		}
 		if s.Factory.Trace {
 			return result, trace, status, err
 		}
 		return result, trace, status, err
 
 	} else {
-		return s.tracedRetryingLookup(s.DNSType, s.DNSClass, name, s.NameServer, true)
+		return s.tracedRetryingLookup(ctx, s.DNSType, s.DNSClass, name, s.nameServers(), true)
 	}
 }
 
-func (s *Lookup) DoTypedMiekgLookup(name string, dnsType uint16) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoTypedMiekgLookup(ctx context.Context, name string, dnsType uint16) (interface{}, []interface{}, zdns.Status, error) {
 	if s.Factory == nil {
 		panic("factory not defined")
 	}
 	if s.Factory.IterativeResolution {
 		s.VerboseLog(0, "MIEKG-IN: iterative lookup for ", name, " (", dnsType, ")")
-		s.IterativeStop = time.Now().Add(time.Duration(s.Factory.IterativeTimeout))
-		result, trace, status, err := s.iterativeLookup(dnsType, s.DNSClass, name, s.NameServer, 1, ".", make([]interface{}, 0))
+		result, trace, status, err := s.startIterative(ctx, dnsType, s.DNSClass, name)
 		s.VerboseLog(0, "MIEKG-OUT: iterative lookup for ", name, " (", dnsType, "): status: ", status, " , err: ", err)
+		if s.Factory.ValidateDNSSEC {
+			result.DNSSEC, trace = s.validateResult(ctx, name, dnsType, status, trace)
+		}
 		if s.Factory.Trace {
 			return result, trace, status, err
 		}
 		return result, trace, status, err
 	} else {
-		return s.tracedRetryingLookup(dnsType, s.DNSClass, name, s.NameServer, true)
+		return s.tracedRetryingLookup(ctx, dnsType, s.DNSClass, name, s.nameServers(), true)
 	}
 }
 
-func (s *Lookup) DoTypedMiekgLookupInClass(name string, dnsType uint16, dnsClass uint16) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoTypedMiekgLookupInClass(ctx context.Context, name string, dnsType uint16, dnsClass uint16) (interface{}, []interface{}, zdns.Status, error) {
 	if s.Factory == nil {
 		panic("factory not defined")
 	}
 	if s.Factory.IterativeResolution {
 		s.VerboseLog(0, "MIEKG-IN: iterative lookup for ", name, " (", dnsType, ") in class ", dnsClass)
-		s.IterativeStop = time.Now().Add(time.Duration(s.Factory.IterativeTimeout))
-		result, trace, status, err := s.iterativeLookup(dnsType, dnsClass, name, s.NameServer, 1, ".", make([]interface{}, 0))
+		result, trace, status, err := s.startIterative(ctx, dnsType, dnsClass, name)
 		s.VerboseLog(0, "MIEKG-OUT: iterative lookup for ", name, " (", dnsType, "): status: ", status, " , err: ", err)
+		if s.Factory.ValidateDNSSEC {
+			result.DNSSEC, trace = s.validateResult(ctx, name, dnsType, status, trace)
+		}
 		if s.Factory.Trace {
 			return result, trace, status, err
 		}
 		return result, trace, status, err
 	} else {
-		return s.tracedRetryingLookup(dnsType, dnsClass, name, s.NameServer, true)
+		return s.tracedRetryingLookup(ctx, dnsType, dnsClass, name, s.nameServers(), true)
 	}
 }
 
-func (s *Lookup) DoTxtLookup(name string) (string, []interface{}, zdns.Status, error) {
-	res, trace, status, err := s.DoMiekgLookup(name)
+func (s *Lookup) DoTxtLookup(ctx context.Context, name string) (string, []interface{}, zdns.Status, error) {
+	res, trace, status, err := s.DoMiekgLookup(ctx, name)
 	if status != zdns.STATUS_NOERROR {
 		return "", trace, status, err
 	}
@@ -1030,8 +1716,8 @@ func (s *Lookup) DoTxtLookup(name string) (string, []interface{}, zdns.Status, e
 }
 
 // allow miekg to be used as a ZDNS module
-func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
-	return s.DoMiekgLookup(name)
+func (s *Lookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
+	return s.DoMiekgLookup(ctx, name)
 }
 
 func (s *GlobalLookupFactory) Help() string {
@@ -1100,4 +1786,47 @@ func init() {
 	spf.SetDNSType(dns.TypeSPF)
 	zdns.RegisterLookup("SPF", spf)
 
+	srv := new(GlobalLookupFactory)
+	srv.SetDNSType(dns.TypeSRV)
+	zdns.RegisterLookup("SRV", srv)
+
+	naptr := new(GlobalLookupFactory)
+	naptr.SetDNSType(dns.TypeNAPTR)
+	zdns.RegisterLookup("NAPTR", naptr)
+
+	tlsa := new(GlobalLookupFactory)
+	tlsa.SetDNSType(dns.TypeTLSA)
+	zdns.RegisterLookup("TLSA", tlsa)
+
+	sshfp := new(GlobalLookupFactory)
+	sshfp.SetDNSType(dns.TypeSSHFP)
+	zdns.RegisterLookup("SSHFP", sshfp)
+
+	svcb := new(GlobalLookupFactory)
+	svcb.SetDNSType(TypeSVCB)
+	zdns.RegisterLookup("SVCB", svcb)
+
+	https := new(GlobalLookupFactory)
+	https.SetDNSType(TypeHTTPS)
+	zdns.RegisterLookup("HTTPS", https)
+
+	uri := new(GlobalLookupFactory)
+	uri.SetDNSType(dns.TypeURI)
+	zdns.RegisterLookup("URI", uri)
+
+	loc := new(GlobalLookupFactory)
+	loc.SetDNSType(dns.TypeLOC)
+	zdns.RegisterLookup("LOC", loc)
+
+	hinfo := new(GlobalLookupFactory)
+	hinfo.SetDNSType(dns.TypeHINFO)
+	zdns.RegisterLookup("HINFO", hinfo)
+
+	rp := new(GlobalLookupFactory)
+	rp.SetDNSType(dns.TypeRP)
+	zdns.RegisterLookup("RP", rp)
+
+	// any other record type can be looked up by name or number
+	zdns.RegisterLookupMaker(genericLookup)
+
 }
@@ -0,0 +1,188 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// number of per-server buckets kept before idle ones are dropped
+const maxIdleBuckets = 10000
+
+// TokenBucket spaces out events to rate per second, allowing a burst of
+// one. Callers reserve a token and sleep until it becomes available, so
+// waiting callers are served in the order they arrived.
+type TokenBucket struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	b := new(TokenBucket)
+	b.interval = time.Duration(float64(time.Second) / rate)
+	return b
+}
+
+// reserve claims the next token and returns when it becomes available
+func (b *TokenBucket) reserve(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	at := b.next
+	if at.Before(now) {
+		at = now
+	}
+	b.next = at.Add(b.interval)
+	return at
+}
+
+// cancel gives back a token reserved for at, if no later one was handed out
+func (b *TokenBucket) cancel(at time.Time) {
+	b.mu.Lock()
+	if b.next.Equal(at.Add(b.interval)) {
+		b.next = at
+	}
+	b.mu.Unlock()
+}
+
+// idle reports whether the bucket is full again
+func (b *TokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.next.After(now)
+}
+
+// Wait blocks until a token is available and returns how long it waited.
+// It fails right away with context.DeadlineExceeded if the token would only
+// become available after the deadline of ctx.
+func (b *TokenBucket) Wait(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	at := b.reserve(now)
+	wait := at.Sub(now)
+	if wait <= 0 {
+		return 0, nil
+	}
+	if d, ok := ctx.Deadline(); ok && d.Before(at) {
+		b.cancel(at)
+		return 0, context.DeadlineExceeded
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return wait, nil
+	case <-ctx.Done():
+		b.cancel(at)
+		return time.Since(now), ctx.Err()
+	}
+}
+
+// RateLimitStats are reported in the metadata file
+type RateLimitStats struct {
+	Queries        int64   `json:"queries"`
+	DelayedQueries int64   `json:"delayed_queries"`
+	WaitTime       float64 `json:"wait_time"`
+}
+
+// RateLimiter caps the rate of queries sent overall and to any single
+// destination. Either limit may be zero to disable it.
+type RateLimiter struct {
+	global    *TokenBucket
+	perServer float64
+	mu        sync.Mutex
+	servers   map[string]*TokenBucket
+
+	queries int64
+	delayed int64
+	waited  int64
+}
+
+func NewRateLimiter(global float64, perServer float64) *RateLimiter {
+	l := new(RateLimiter)
+	if global > 0 {
+		l.global = NewTokenBucket(global)
+	}
+	l.perServer = perServer
+	l.servers = make(map[string]*TokenBucket)
+	return l
+}
+
+// destination returns the host a name server address refers to, whether
+// it is a host:port pair or a DNS-over-HTTPS URL
+func destination(nameServer string) string {
+	if u, err := url.Parse(nameServer); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(nameServer); err == nil {
+		return host
+	}
+	return nameServer
+}
+
+func (l *RateLimiter) serverBucket(nameServer string) *TokenBucket {
+	host := destination(nameServer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.servers[host]
+	if !ok {
+		if len(l.servers) >= maxIdleBuckets {
+			// a full bucket behaves exactly like a new one
+			now := time.Now()
+			for h, o := range l.servers {
+				if o.idle(now) {
+					delete(l.servers, h)
+				}
+			}
+		}
+		b = NewTokenBucket(l.perServer)
+		l.servers[host] = b
+	}
+	return b
+}
+
+// Wait blocks until a query may be sent to nameServer
+func (l *RateLimiter) Wait(ctx context.Context, nameServer string) error {
+	var total time.Duration
+	var err error
+	if l.global != nil {
+		var wait time.Duration
+		wait, err = l.global.Wait(ctx)
+		total += wait
+	}
+	if err == nil && l.perServer > 0 {
+		var wait time.Duration
+		wait, err = l.serverBucket(nameServer).Wait(ctx)
+		total += wait
+	}
+	atomic.AddInt64(&l.queries, 1)
+	if total > 0 {
+		atomic.AddInt64(&l.delayed, 1)
+		atomic.AddInt64(&l.waited, int64(total))
+	}
+	return err
+}
+
+func (l *RateLimiter) Stats() RateLimitStats {
+	return RateLimitStats{
+		Queries:        atomic.LoadInt64(&l.queries),
+		DelayedQueries: atomic.LoadInt64(&l.delayed),
+		WaitTime:       time.Duration(atomic.LoadInt64(&l.waited)).Seconds(),
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSpacing(t *testing.T) {
+	l := NewRateLimiter(0, 100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background(), "192.0.2.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first query goes out immediately, the other four 10ms apart
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 queries at 100 qps took only %v", elapsed)
+	}
+	// a different server has a bucket of its own
+	before := time.Now()
+	l.Wait(context.Background(), "192.0.2.2:53")
+	if waited := time.Since(before); waited > 5*time.Millisecond {
+		t.Errorf("first query to a new server waited %v", waited)
+	}
+	stats := l.Stats()
+	if stats.Queries != 6 || stats.DelayedQueries != 4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRateLimiterDeadline(t *testing.T) {
+	l := NewRateLimiter(1, 0)
+	l.Wait(context.Background(), "192.0.2.1:53")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, "192.0.2.1:53"); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	// the token given back is available to the next caller
+	if at := l.global.reserve(time.Now()); time.Until(at) > 1500*time.Millisecond {
+		t.Errorf("token was not given back")
+	}
+}
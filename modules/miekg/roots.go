@@ -0,0 +1,138 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// primingAttempts is how many root servers are asked for the addresses of
+// the root servers before priming gives up
+const primingAttempts = 3
+
+// PrimeRoots asks the root servers in c.NameServers for the name servers of
+// the root zone (RFC 8109) and replaces c.NameServers with the addresses
+// given for them, so that iteration starts from the current root servers
+// rather than from the root hints. The addresses keep the port of the server
+// that answered, which matters for test roots on other ports. It returns the
+// server that answered.
+func PrimeRoots(ctx context.Context, c *zdns.GlobalConf) (string, error) {
+	udp := &dns.Client{Timeout: c.IterationTimeout}
+	tcp := &dns.Client{Net: "tcp", Timeout: c.IterationTimeout}
+	// the addresses of all root servers do not fit into 512 bytes
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(4096)
+	err := errors.New("no root servers to prime")
+	for i, n := range rand.Perm(len(c.NameServers)) {
+		if i == primingAttempts {
+			break
+		}
+		hint := c.NameServers[n]
+		attemptCtx, cancel := context.WithTimeout(ctx, c.IterationTimeout)
+		_, r, status, lookupErr := doLookupWorker(attemptCtx, udp, tcp, nil, opt, dns.TypeNS, dns.ClassINET, ".", hint, false, nil)
+		cancel()
+		if status != zdns.STATUS_NOERROR {
+			err = errors.New("priming query to " + hint + " failed: " + string(status))
+			if lookupErr != nil {
+				err = errors.New(err.Error() + ": " + lookupErr.Error())
+			}
+			continue
+		}
+		_, port, _ := net.SplitHostPort(hint)
+		servers := rootAddresses(r, port, c.RootIPv6)
+		if len(servers) == 0 {
+			err = errors.New(hint + " did not give any root server addresses")
+			continue
+		}
+		c.NameServers = servers
+		return hint, nil
+	}
+	return "", err
+}
+
+// rootAddresses returns the addresses of the root name servers in the answer
+// to a priming query
+func rootAddresses(r *dns.Msg, port string, ipv6 bool) []string {
+	var roots []string
+	for _, rr := range r.Answer {
+		if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == "." {
+			roots = append(roots, strings.ToLower(ns.Ns))
+		}
+	}
+	addrs := make(map[string][]string)
+	for _, rr := range r.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		switch glue := rr.(type) {
+		case *dns.A:
+			addrs[name] = append(addrs[name], net.JoinHostPort(glue.A.String(), port))
+		case *dns.AAAA:
+			if ipv6 {
+				addrs[name] = append(addrs[name], net.JoinHostPort(glue.AAAA.String(), port))
+			}
+		}
+	}
+	var servers []string
+	for _, ns := range roots {
+		servers = append(servers, addrs[ns]...)
+		delete(addrs, ns)
+	}
+	return servers
+}
+
+// readTrustAnchors reads DS records, or DNSKEY records that are turned into
+// DS records, of the root zone from a file in zone file format
+func readTrustAnchors(path string) ([]*dns.DS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("unable to open trust anchors: " + err.Error())
+	}
+	defer f.Close()
+	var anchors []*dns.DS
+	var parseErr error
+	for t := range dns.ParseZone(f, ".", path) {
+		if t.Error != nil {
+			if parseErr == nil {
+				parseErr = t.Error
+			}
+			continue
+		}
+		if t.RR.Header().Name != "." {
+			continue
+		}
+		switch rr := t.RR.(type) {
+		case *dns.DS:
+			anchors = append(anchors, rr)
+		case *dns.DNSKEY:
+			if ds := rr.ToDS(dns.SHA256); ds != nil {
+				anchors = append(anchors, ds)
+			}
+		}
+	}
+	if parseErr != nil {
+		return nil, errors.New("unable to read trust anchors: " + parseErr.Error())
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no DS or DNSKEY records of the root zone in " + path)
+	}
+	return anchors, nil
+}
@@ -0,0 +1,100 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+const rootHints = `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+`
+
+func TestParseRootHints(t *testing.T) {
+	servers, err := zdns.ParseRootHints(strings.NewReader(rootHints), "named.root", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"198.41.0.4:53", "170.247.170.2:53"}; !reflect.DeepEqual(servers, expected) {
+		t.Errorf("expected %v, got %v", expected, servers)
+	}
+	servers, err = zdns.ParseRootHints(strings.NewReader(rootHints), "named.root", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 4 || servers[1] != "[2001:503:ba3e::2:30]:53" {
+		t.Errorf("IPv6 roots missing from %v", servers)
+	}
+}
+
+// primingHandler is a root server that lists two root servers, one of them
+// itself, on 127.0.0.1 and ::1
+func primingHandler(w dns.ResponseWriter, q *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Authoritative = true
+	for _, ns := range []string{"a.root.test.", "b.root.test."} {
+		resp.Answer = append(resp.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 518400},
+			Ns:  ns,
+		})
+	}
+	resp.Extra = append(resp.Extra,
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 518400}, A: net.ParseIP("127.0.0.1")},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "a.root.test.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 518400}, AAAA: net.ParseIP("::1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 518400}, A: net.ParseIP("127.0.0.2")},
+	)
+	w.WriteMsg(resp)
+}
+
+func TestPrimeRoots(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(primingHandler)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	hint := pc.LocalAddr().String()
+	_, port, _ := net.SplitHostPort(hint)
+	for _, ipv6 := range []bool{false, true} {
+		conf := &zdns.GlobalConf{NameServers: []string{hint}, IterationTimeout: time.Second, RootIPv6: ipv6}
+		answered, err := PrimeRoots(context.Background(), conf)
+		if err != nil || answered != hint {
+			t.Fatalf("priming failed: %v", err)
+		}
+		expected := []string{"127.0.0.1:" + port, "127.0.0.2:" + port}
+		if ipv6 {
+			expected = []string{"127.0.0.1:" + port, "[::1]:" + port, "127.0.0.2:" + port}
+		}
+		if !reflect.DeepEqual(conf.NameServers, expected) {
+			t.Errorf("expected %v, got %v", expected, conf.NameServers)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kwang40/zdns"
+	log "github.com/sirupsen/logrus"
+)
+
+// A snapshot of the iterative cache is a file with a JSON object per line,
+// each holding a cached answer or negative answer. Answers include the
+// delegations and glue seen while iterating, so that a scan that starts from
+// a snapshot does not have to walk down from the root again. Expiry is kept
+// as an absolute time, and what has expired by the time the snapshot is
+// loaded is left out.
+
+// snapshotEntry is a line of a cache snapshot
+type snapshotEntry struct {
+	Name      string            `json:"name"`
+	Type      uint16            `json:"type"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	Answer    *zdns.MiekgAnswer `json:"answer,omitempty"`
+	Negative  *NegativeResult   `json:"negative,omitempty"`
+}
+
+// SaveCache writes the answers in the iterative cache to path. The snapshot
+// is written next to path first and then moved there, so an earlier snapshot
+// is only replaced by a complete one.
+func (s *GlobalLookupFactory) SaveCache(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.New("unable to save cache: " + err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	entries := 0
+	s.IterativeCache.Each(func(k interface{}, v interface{}, expiresAt time.Time) {
+		key, ok := k.(cacheKey)
+		if !ok || err != nil {
+			return
+		}
+		switch value := v.(type) {
+		case CachedResult:
+			for _, ta := range value.Answers {
+				a, ok := ta.Answer.(zdns.MiekgAnswer)
+				if !ok || !ta.ExpiresAt.After(time.Now()) {
+					continue
+				}
+				if err = enc.Encode(snapshotEntry{Name: key.Name, Type: key.DnsType, ExpiresAt: ta.ExpiresAt, Answer: &a}); err != nil {
+					return
+				}
+				entries++
+			}
+		case NegativeResult:
+			if err = enc.Encode(snapshotEntry{Name: key.Name, Type: key.DnsType, ExpiresAt: expiresAt, Negative: &value}); err != nil {
+				return
+			}
+			entries++
+		}
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return errors.New("unable to save cache: " + err.Error())
+	}
+	log.Info("saved ", entries, " cached answers to ", path)
+	return nil
+}
+
+// LoadCache adds the answers in the snapshot at path that have not expired
+// to the iterative cache. A snapshot that does not exist yet is not an
+// error, so that the first of a series of scans can save one.
+func (s *GlobalLookupFactory) LoadCache(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.New("unable to load cache: " + err.Error())
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	now := time.Now()
+	entries := 0
+	for dec.More() {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return errors.New("unable to load cache: " + err.Error())
+		}
+		if !e.ExpiresAt.After(now) {
+			continue
+		}
+		switch {
+		case e.Answer != nil:
+			s.addCachedAnswer(*e.Answer, e.Name, e.Type, e.ExpiresAt, 0, 0)
+		case e.Negative != nil:
+			s.addCachedNegative(*e.Negative, e.Name, e.Type, e.ExpiresAt, 0, 0)
+		default:
+			continue
+		}
+		entries++
+	}
+	log.Info("loaded ", entries, " cached answers from ", path)
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// SVCB and HTTPS records (RFC 9460)
+const (
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+)
+
+// names of the SvcParamKeys, as used in presentation format
+var svcParamKeys = map[uint16]string{
+	0: "mandatory",
+	1: "alpn",
+	2: "no-default-alpn",
+	3: "port",
+	4: "ipv4hint",
+	5: "ech",
+	6: "ipv6hint",
+	7: "dohpath",
+	8: "ohttp",
+}
+
+// SVCBAnswer is used for both SVCB and HTTPS records. Params is keyed by the
+// names of the SvcParamKeys, or keyNNNNN for unknown keys, whose values are
+// given in hex.
+type SVCBAnswer struct {
+	Answer   zdns.MiekgAnswer
+	Priority uint16                 `json:"priority"`
+	Target   string                 `json:"target"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+}
+
+func isSVCB(rrtype uint16) bool {
+	return rrtype == TypeSVCB || rrtype == TypeHTTPS
+}
+
+func svcParamKey(key uint16) string {
+	if name, ok := svcParamKeys[key]; ok {
+		return name
+	}
+	return "key" + strconv.Itoa(int(key))
+}
+
+// parseSVCB decodes the RDATA of an SVCB or HTTPS record that was left in
+// its generic form
+func parseSVCB(rr *dns.RFC3597) (SVCBAnswer, error) {
+	retv := SVCBAnswer{Answer: answerHeader(rr.Hdr)}
+	if rr.Hdr.Rrtype == TypeSVCB {
+		retv.Answer.Type = "SVCB"
+	} else {
+		retv.Answer.Type = "HTTPS"
+	}
+	rdata, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return retv, err
+	}
+	if len(rdata) < 3 {
+		return retv, errors.New("SVCB record too short")
+	}
+	retv.Priority = binary.BigEndian.Uint16(rdata)
+	target, off, err := dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return retv, err
+	}
+	if target != "." {
+		target = strings.TrimSuffix(target, ".")
+	}
+	retv.Target = target
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return retv, errors.New("truncated SvcParam")
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+length > len(rdata) {
+			return retv, errors.New("truncated SvcParam value")
+		}
+		value, err := parseSvcParam(key, rdata[off:off+length])
+		if err != nil {
+			return retv, errors.New(svcParamKey(key) + ": " + err.Error())
+		}
+		if retv.Params == nil {
+			retv.Params = make(map[string]interface{})
+		}
+		retv.Params[svcParamKey(key)] = value
+		off += length
+	}
+	return retv, nil
+}
+
+func parseSvcParam(key uint16, value []byte) (interface{}, error) {
+	switch key {
+	case 0: // mandatory
+		if len(value)%2 != 0 {
+			return nil, errors.New("odd length")
+		}
+		var keys []string
+		for i := 0; i < len(value); i += 2 {
+			keys = append(keys, svcParamKey(binary.BigEndian.Uint16(value[i:])))
+		}
+		return keys, nil
+	case 1: // alpn
+		var ids []string
+		for i := 0; i < len(value); {
+			l := int(value[i])
+			if i+1+l > len(value) {
+				return nil, errors.New("truncated protocol id")
+			}
+			ids = append(ids, string(value[i+1:i+1+l]))
+			i += 1 + l
+		}
+		return ids, nil
+	case 2, 8: // no-default-alpn, ohttp
+		if len(value) != 0 {
+			return nil, errors.New("unexpected value")
+		}
+		return true, nil
+	case 3: // port
+		if len(value) != 2 {
+			return nil, errors.New("bad length")
+		}
+		return binary.BigEndian.Uint16(value), nil
+	case 4, 6: // ipv4hint, ipv6hint
+		size := net.IPv4len
+		if key == 6 {
+			size = net.IPv6len
+		}
+		if len(value) == 0 || len(value)%size != 0 {
+			return nil, errors.New("bad length")
+		}
+		var ips []string
+		for i := 0; i < len(value); i += size {
+			ips = append(ips, net.IP(value[i:i+size]).String())
+		}
+		return ips, nil
+	case 5: // ech
+		return base64.StdEncoding.EncodeToString(value), nil
+	case 7: // dohpath
+		return string(value), nil
+	}
+	return hex.EncodeToString(value), nil
+}
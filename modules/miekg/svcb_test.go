@@ -0,0 +1,97 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHTTPS(t *testing.T) {
+	// example.com. HTTPS 1 . alpn=h2,h3 port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 key65000=abcd
+	rr := &dns.RFC3597{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+		Rdata: "0001" + "00" +
+			"0001" + "0006" + "026832" + "026833" +
+			"0003" + "0002" + "20fb" +
+			"0004" + "0004" + "c0000201" +
+			"0006" + "0010" + "20010db8000000000000000000000001" +
+			"fde8" + "0002" + "abcd",
+	}
+	ans, ok := ParseAnswer(rr).(SVCBAnswer)
+	if !ok {
+		t.Fatalf("expected an SVCBAnswer, got %T", ParseAnswer(rr))
+	}
+	if ans.Answer.Type != "HTTPS" || ans.Answer.Name != "example.com" || ans.Priority != 1 || ans.Target != "." {
+		t.Errorf("unexpected answer %+v", ans)
+	}
+	expected := map[string]interface{}{
+		"alpn":     []string{"h2", "h3"},
+		"port":     uint16(8443),
+		"ipv4hint": []string{"192.0.2.1"},
+		"ipv6hint": []string{"2001:db8::1"},
+		"key65000": "abcd",
+	}
+	if !reflect.DeepEqual(ans.Params, expected) {
+		t.Errorf("unexpected params %v", ans.Params)
+	}
+
+	// a truncated parameter leaves the record unparsed
+	rr.Rdata = "0001" + "00" + "0003" + "0004" + "20fb"
+	if _, ok := ParseAnswer(rr).(SVCBAnswer); ok {
+		t.Error("malformed record was parsed")
+	}
+}
+
+func TestParseLOC(t *testing.T) {
+	rr, err := dns.NewRR("example.com. LOC 52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000m 10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans := ParseAnswer(rr).(LOCAnswer)
+	if math.Abs(ans.Latitude-52.373056) > 1e-6 || math.Abs(ans.Longitude-4.892222) > 1e-6 {
+		t.Errorf("unexpected position %v %v", ans.Latitude, ans.Longitude)
+	}
+	if ans.Altitude != -2 || ans.Size != 0 || ans.HorizPre != 10000 || ans.VertPre != 10 {
+		t.Errorf("unexpected answer %+v", ans)
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	rr := &dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 300},
+		Hash: 1, Iterations: 10, SaltLength: 2, Salt: "abcd",
+	}
+	ans, ok := ParseAnswer(rr).(UnknownAnswer)
+	if !ok {
+		t.Fatalf("expected an UnknownAnswer, got %T", ParseAnswer(rr))
+	}
+	if ans.Answer.Type != "NSEC3PARAM" || ans.RR != rr.String() || ans.RData != "0100000a02abcd" {
+		t.Errorf("unexpected answer %+v", ans)
+	}
+	for name, expected := range map[string]uint16{"nsec3param": dns.TypeNSEC3PARAM, "TYPE65": 65, "type65535": 65535} {
+		if dnsType, ok := ParseType(name); !ok || dnsType != expected {
+			t.Errorf("%s: expected type %d, got %d", name, expected, dnsType)
+		}
+	}
+	for _, name := range []string{"TYPE0", "TYPE65536", "NOSUCHTYPE"} {
+		if _, ok := ParseType(name); ok {
+			t.Errorf("%s was accepted as a type", name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger is implemented by stream transports that carry a query to a
+// name server without the UDP-to-TCP truncation fallback used for port 53.
+// Exchange gives up once ctx is done. Besides the parsed response, it returns
+// what went over the wire. Close shuts down the connections the transport
+// keeps open between queries.
+type Exchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg, nameServer string) (*dns.Msg, Wire, error)
+	Protocol() string
+	Close()
+}
+
+// TLSClient sends queries over DNS-over-TLS (RFC 7858). It keeps one open
+// connection per name server so that a routine only pays for the TLS
+// handshake once. A TLSClient is not safe for concurrent use; each routine
+// factory owns its own.
+type TLSClient struct {
+	conf    *tls.Config
+	timeout time.Duration
+	conns   map[string]*dns.Conn
+}
+
+func NewTLSClient(conf *tls.Config, timeout time.Duration) *TLSClient {
+	c := new(TLSClient)
+	c.conf = conf
+	if c.conf == nil {
+		c.conf = new(tls.Config)
+	}
+	c.timeout = timeout
+	c.conns = make(map[string]*dns.Conn)
+	return c
+}
+
+func (c *TLSClient) Protocol() string {
+	return "tls"
+}
+
+func (c *TLSClient) Exchange(ctx context.Context, m *dns.Msg, nameServer string) (*dns.Msg, Wire, error) {
+	co, reused := c.conns[nameServer]
+	if !reused {
+		var err error
+		co, err = c.dial(ctx, nameServer)
+		if err != nil {
+			return nil, Wire{}, err
+		}
+		c.conns[nameServer] = co
+	}
+	r, w, err := c.exchangeConn(ctx, co, m)
+	if err != nil {
+		co.Close()
+		delete(c.conns, nameServer)
+		// the server may have closed an idle connection since we last
+		// used it. Retry once on a fresh connection before giving up.
+		if reused && ctx.Err() == nil {
+			return c.Exchange(ctx, m, nameServer)
+		}
+	}
+	return r, w, err
+}
+
+// dial connects to nameServer and completes the TLS handshake, giving up once
+// ctx is done
+func (c *TLSClient) dial(ctx context.Context, nameServer string) (*dns.Conn, error) {
+	d := net.Dialer{Deadline: deadline(ctx, c.timeout)}
+	conn, err := d.DialContext(ctx, "tcp", nameServer)
+	if err != nil {
+		return nil, err
+	}
+	conf := c.conf
+	if conf.ServerName == "" {
+		// verify the certificate against the address, as tls.Dial does
+		host, _, err := net.SplitHostPort(nameServer)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tconn := tls.Client(conn, conf)
+	stop := CloseWhenDone(ctx, conn)
+	defer stop()
+	conn.SetDeadline(d.Deadline)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tconn}, nil
+}
+
+func (c *TLSClient) exchangeConn(ctx context.Context, co *dns.Conn, m *dns.Msg) (*dns.Msg, Wire, error) {
+	stop := CloseWhenDone(ctx, co)
+	defer stop()
+	co.SetDeadline(deadline(ctx, c.timeout))
+	return roundTrip(co, m)
+}
+
+// Close shuts down every connection held open by the client.
+func (c *TLSClient) Close() {
+	for ns, co := range c.conns {
+		co.Close()
+		delete(c.conns, ns)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package miekg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kwang40/zdns"
+	"github.com/miekg/dns"
+)
+
+// selfSigned returns a server and a client configuration that trust a fresh
+// certificate for 127.0.0.1
+func selfSigned(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+// startDoT serves handler over DNS-over-TLS on a local port
+func startDoT(t *testing.T, handler dns.HandlerFunc) (string, *countingListener, *tls.Config) {
+	serverConf, clientConf := selfSigned(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{Listener: ln}
+	srv := &dns.Server{Listener: l, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return ln.Addr().String(), l, clientConf
+}
+
+func answerA(w dns.ResponseWriter, q *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	w.WriteMsg(resp)
+}
+
+func TestTLSLookup(t *testing.T) {
+	addr, l, conf := startDoT(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		answerA(w, q)
+	})
+	c := NewTLSClient(conf, time.Second)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		res, status, err := DoLookupWorker(context.Background(), nil, nil, c, nil, dns.TypeA, dns.ClassINET, "example.com", addr, true)
+		if err != nil || status != zdns.STATUS_NOERROR {
+			t.Fatalf("lookup %d failed: %v %v", i, status, err)
+		}
+		if res.Protocol != "tls" {
+			t.Errorf("expected protocol tls, got %s", res.Protocol)
+		}
+		if len(res.Answers) != 1 || res.Answers[0].(zdns.MiekgAnswer).Answer != "192.0.2.1" {
+			t.Errorf("unexpected answers: %v", res.Answers)
+		}
+	}
+	if n := atomic.LoadInt32(&l.accepted); n != 1 {
+		t.Errorf("expected the connection to be reused, got %d connections", n)
+	}
+	c.Close()
+	if len(c.conns) != 0 {
+		t.Errorf("expected Close to drop every connection, %d left", len(c.conns))
+	}
+}
+
+func TestTLSReconnect(t *testing.T) {
+	// the server hangs up after every answer, as servers do with idle
+	// connections, so the second query goes out on a stale connection
+	addr, l, conf := startDoT(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		answerA(w, q)
+		w.Close()
+	})
+	c := NewTLSClient(conf, time.Second)
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		_, status, err := DoLookupWorker(context.Background(), nil, nil, c, nil, dns.TypeA, dns.ClassINET, "example.com", addr, true)
+		if err != nil || status != zdns.STATUS_NOERROR {
+			t.Fatalf("lookup %d failed: %v %v", i, status, err)
+		}
+	}
+	if n := atomic.LoadInt32(&l.accepted); n != 2 {
+		t.Errorf("expected a single reconnect, got %d connections", n)
+	}
+}
+
+func TestTLSDialCancelled(t *testing.T) {
+	// the server accepts connections but never completes a handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	_, conf := selfSigned(t)
+	c := NewTLSClient(conf, time.Minute)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, _, err := c.Exchange(ctx, m, ln.Addr().String()); err == nil {
+		t.Fatal("expected the exchange to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the handshake was abandoned after %v, not with its context", elapsed)
+	}
+}
@@ -15,9 +15,10 @@
 package mxlookup
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"strings"
-	"sync"
 
 	"github.com/miekg/dns"
 	"github.com/kwang40/zdns"
@@ -46,6 +47,14 @@ type Result struct {
 	Servers []MXRecord `json:"exchanges"`
 }
 
+func (r Result) Records() []zdns.Record {
+	var records []zdns.Record
+	for _, s := range r.Servers {
+		records = append(records, zdns.NewRecord("exchanges", s))
+	}
+	return records
+}
+
 // Per Connection Lookup ======================================================
 //
 type Lookup struct {
@@ -57,19 +66,20 @@ func dotName(name string) string {
 	return strings.Join([]string{name, "."}, "")
 }
 
-func (s *Lookup) LookupIPs(name string) (CachedAddresses, []interface{}) {
-	s.Factory.Factory.CHmu.Lock()
+func (s *Lookup) LookupIPs(ctx context.Context, name string) (CachedAddresses, []interface{}) {
 	// XXX this should be changed to a miekglookup
 	res, found := s.Factory.Factory.CacheHash.Get(name)
-	s.Factory.Factory.CHmu.Unlock()
 	if found {
 		return res.(CachedAddresses), make([]interface{}, 0)
 	}
 	var retv CachedAddresses
 	trace := make([]interface{}, 0)
+	// the addresses are shared by every input name through the cache, so
+	// they are never looked up from name servers targeted at one of them
+	l := s.Untargeted()
 	// ipv4
 	if s.Factory.Factory.IPv4Lookup || !s.Factory.Factory.IPv6Lookup {
-		res, secondTrace, status, _ := s.DoTypedMiekgLookup(name, dns.TypeA)
+		res, secondTrace, status, _ := l.DoTypedMiekgLookup(ctx, name, dns.TypeA)
 		trace = append(trace, secondTrace...)
 		if status == zdns.STATUS_NOERROR {
 			cast, _ := res.(miekg.Result)
@@ -84,7 +94,7 @@ func (s *Lookup) LookupIPs(name string) (CachedAddresses, []interface{}) {
 	}
 	// ipv6
 	if s.Factory.Factory.IPv6Lookup {
-		res, secondTrace, status, _ := s.DoTypedMiekgLookup(name, dns.TypeAAAA)
+		res, secondTrace, status, _ := l.DoTypedMiekgLookup(ctx, name, dns.TypeAAAA)
 		trace = append(trace, secondTrace...)
 		if status == zdns.STATUS_NOERROR {
 			cast, _ := res.(miekg.Result)
@@ -97,15 +107,13 @@ func (s *Lookup) LookupIPs(name string) (CachedAddresses, []interface{}) {
 			}
 		}
 	}
-	s.Factory.Factory.CHmu.Lock()
 	s.Factory.Factory.CacheHash.Add(name, retv)
-	s.Factory.Factory.CHmu.Unlock()
 	return retv, trace
 }
 
-func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
 	retv := Result{Servers: []MXRecord{}}
-	res, trace, status, err := s.DoTypedMiekgLookup(name, dns.TypeMX)
+	res, trace, status, err := s.DoTypedMiekgLookup(ctx, name, dns.TypeMX)
 	if status != zdns.STATUS_NOERROR {
 		return retv, trace, status, err
 	}
@@ -117,7 +125,7 @@ func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status,
 		if mxAns, ok := ans.(miekg.MXAnswer); ok {
 			name = strings.TrimSuffix(mxAns.Answer.Answer, ".")
 			rec := MXRecord{TTL: mxAns.Answer.Ttl, Type: mxAns.Answer.Type, Class: mxAns.Answer.Class, Name: name, Preference: mxAns.Preference}
-			ips, secondTrace := s.LookupIPs(name)
+			ips, secondTrace := s.LookupIPs(ctx, name)
 			rec.IPv4Addresses = ips.IPv4Addresses
 			rec.IPv6Addresses = ips.IPv6Addresses
 			retv.Servers = append(retv.Servers, rec)
@@ -136,7 +144,10 @@ type RoutineLookupFactory struct {
 
 func (s *RoutineLookupFactory) MakeLookup() (zdns.Lookup, error) {
 	a := Lookup{Factory: s}
-	nameServer := s.Factory.RandomNameServer()
+	nameServer, err := s.Factory.RandomNameServer()
+	if err != nil {
+		return nil, err
+	}
 	a.Initialize(nameServer, dns.TypeMX, dns.ClassINET, &s.RoutineLookupFactory)
 	return &a, nil
 }
@@ -148,8 +159,7 @@ type GlobalLookupFactory struct {
 	IPv4Lookup  bool
 	IPv6Lookup  bool
 	MXCacheSize int
-	CacheHash   *cachehash.CacheHash
-	CHmu        sync.Mutex
+	CacheHash   *cachehash.ShardedCacheHash
 }
 
 func (s *GlobalLookupFactory) AddFlags(f *flag.FlagSet) {
@@ -161,8 +171,8 @@ func (s *GlobalLookupFactory) AddFlags(f *flag.FlagSet) {
 func (s *GlobalLookupFactory) Initialize(c *zdns.GlobalConf) error {
 	s.GlobalLookupFactory.Initialize(c)
 	s.GlobalConf = c
-	s.CacheHash = new(cachehash.CacheHash)
-	s.CacheHash.Init(s.MXCacheSize)
+	s.CacheHash = new(cachehash.ShardedCacheHash)
+	s.CacheHash.Init(s.MXCacheSize, cachehash.DefaultShards)
 	return nil
 }
 
@@ -172,6 +182,50 @@ func (s *GlobalLookupFactory) Help() string {
 	return ""
 }
 
+// AvroSchema is the schema of Result
+func (s *GlobalLookupFactory) AvroSchema() string {
+	return `{
+		"type": "record",
+		"name": "Result",
+		"namespace": "zdns.mxlookup",
+		"fields": [
+			{"name": "exchanges", "type": {"type": "array", "items": {
+				"type": "record",
+				"name": "MXRecord",
+				"fields": [
+					{"name": "name", "type": "string"},
+					{"name": "type", "type": "string"},
+					{"name": "class", "type": "string"},
+					{"name": "preference", "type": "int"},
+					{"name": "ipv4_addresses", "type": {"type": "array", "items": "string"}},
+					{"name": "ipv6_addresses", "type": {"type": "array", "items": "string"}},
+					{"name": "ttl", "type": "long"}
+				]
+			}}}
+		]
+	}`
+}
+
+func (s *GlobalLookupFactory) AvroRecord(data interface{}) (interface{}, error) {
+	res, ok := data.(Result)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", data)
+	}
+	exchanges := make([]interface{}, 0, len(res.Servers))
+	for _, mx := range res.Servers {
+		exchanges = append(exchanges, map[string]interface{}{
+			"name":           mx.Name,
+			"type":           mx.Type,
+			"class":          mx.Class,
+			"preference":     int(mx.Preference),
+			"ipv4_addresses": mx.IPv4Addresses,
+			"ipv6_addresses": mx.IPv6Addresses,
+			"ttl":            int64(mx.TTL),
+		})
+	}
+	return map[string]interface{}{"exchanges": exchanges}, nil
+}
+
 func (s *GlobalLookupFactory) MakeRoutineFactory(threadID int) (zdns.RoutineLookupFactory, error) {
 	r := new(RoutineLookupFactory)
 	r.Initialize(s.GlobalConf)
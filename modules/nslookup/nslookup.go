@@ -15,7 +15,9 @@
 package nslookup
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -37,6 +39,14 @@ type Result struct {
 	Servers []NSRecord `json:"servers,omitempty"`
 }
 
+func (r Result) Records() []zdns.Record {
+	var records []zdns.Record
+	for _, s := range r.Servers {
+		records = append(records, zdns.NewRecord("servers", s))
+	}
+	return records
+}
+
 // Per Connection Lookup ======================================================
 //
 type Lookup struct {
@@ -48,9 +58,11 @@ func dotName(name string) string {
 	return strings.Join([]string{name, "."}, "")
 }
 
-func (s *Lookup) lookupIPs(name string, dnsType uint16) ([]string, []interface{}) {
+func (s *Lookup) lookupIPs(ctx context.Context, name string, dnsType uint16) ([]string, []interface{}) {
 	var addresses []string
-	res, trace, status, _ := s.DoTypedMiekgLookup(name, dnsType)
+	// name servers targeted at the input name need not know the addresses
+	// of its name servers
+	res, trace, status, _ := s.Untargeted().DoTypedMiekgLookup(ctx, name, dnsType)
 	if status == zdns.STATUS_NOERROR {
 		cast, _ := res.(zdns.MiekgResult)
 		for _, innerRes := range cast.Answers {
@@ -61,9 +73,9 @@ func (s *Lookup) lookupIPs(name string, dnsType uint16) ([]string, []interface{}
 	return addresses, trace
 }
 
-func (s *Lookup) DoNSLookup(name string, lookupIPv4 bool, lookupIPv6 bool) (Result, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoNSLookup(ctx context.Context, name string, lookupIPv4 bool, lookupIPv6 bool) (Result, []interface{}, zdns.Status, error) {
 	var retv Result
-	res, trace, status, err := s.DoTypedMiekgLookup(name, dns.TypeNS)
+	res, trace, status, err := s.DoTypedMiekgLookup(ctx, name, dns.TypeNS)
 	if status != zdns.STATUS_NOERROR || err != nil {
 		return retv, trace, status, nil
 	}
@@ -96,7 +108,7 @@ func (s *Lookup) DoNSLookup(name string, lookupIPv4 bool, lookupIPv6 bool) (Resu
 		rec.TTL = a.Ttl
 		if lookupIPv4 || !lookupIPv6 {
 			var secondTrace []interface{}
-			rec.IPv4Addresses, secondTrace = s.lookupIPs(rec.Name, dns.TypeA)
+			rec.IPv4Addresses, secondTrace = s.lookupIPs(ctx, rec.Name, dns.TypeA)
 			trace = append(trace, secondTrace...)
 		} else if ip, ok := ipv4s[rec.Name]; ok {
 			rec.IPv4Addresses = []string{ip}
@@ -105,7 +117,7 @@ func (s *Lookup) DoNSLookup(name string, lookupIPv4 bool, lookupIPv6 bool) (Resu
 		}
 		if lookupIPv6 {
 			var secondTrace []interface{}
-			rec.IPv6Addresses, secondTrace = s.lookupIPs(rec.Name, dns.TypeAAAA)
+			rec.IPv6Addresses, secondTrace = s.lookupIPs(ctx, rec.Name, dns.TypeAAAA)
 			trace = append(trace, secondTrace...)
 		} else if ip, ok := ipv6s[rec.Name]; ok {
 			rec.IPv6Addresses = []string{ip}
@@ -122,8 +134,8 @@ func (s *Lookup) DoNSLookup(name string, lookupIPv4 bool, lookupIPv6 bool) (Resu
 
 }
 
-func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
-	return s.DoNSLookup(name, s.Factory.Factory.IPv4Lookup, s.Factory.Factory.IPv6Lookup)
+func (s *Lookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
+	return s.DoNSLookup(ctx, name, s.Factory.Factory.IPv4Lookup, s.Factory.Factory.IPv6Lookup)
 }
 
 // Per GoRoutine Factory ======================================================
@@ -135,7 +147,10 @@ type RoutineLookupFactory struct {
 
 func (s *RoutineLookupFactory) MakeLookup() (zdns.Lookup, error) {
 	a := Lookup{Factory: s}
-	nameServer := s.Factory.RandomNameServer()
+	nameServer, err := s.Factory.RandomNameServer()
+	if err != nil {
+		return nil, err
+	}
 	a.Initialize(nameServer, dns.TypeA, dns.ClassINET, &s.RoutineLookupFactory)
 	return &a, nil
 }
@@ -159,6 +174,46 @@ func (s *GlobalLookupFactory) Help() string {
 	return ""
 }
 
+// AvroSchema is the schema of Result
+func (s *GlobalLookupFactory) AvroSchema() string {
+	return `{
+		"type": "record",
+		"name": "Result",
+		"namespace": "zdns.nslookup",
+		"fields": [
+			{"name": "servers", "type": {"type": "array", "items": {
+				"type": "record",
+				"name": "NSRecord",
+				"fields": [
+					{"name": "name", "type": "string"},
+					{"name": "type", "type": "string"},
+					{"name": "ipv4_addresses", "type": {"type": "array", "items": "string"}},
+					{"name": "ipv6_addresses", "type": {"type": "array", "items": "string"}},
+					{"name": "ttl", "type": "long"}
+				]
+			}}}
+		]
+	}`
+}
+
+func (s *GlobalLookupFactory) AvroRecord(data interface{}) (interface{}, error) {
+	res, ok := data.(Result)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", data)
+	}
+	servers := make([]interface{}, 0, len(res.Servers))
+	for _, ns := range res.Servers {
+		servers = append(servers, map[string]interface{}{
+			"name":           ns.Name,
+			"type":           ns.Type,
+			"ipv4_addresses": ns.IPv4Addresses,
+			"ipv6_addresses": ns.IPv6Addresses,
+			"ttl":            int64(ns.TTL),
+		})
+	}
+	return map[string]interface{}{"servers": servers}, nil
+}
+
 func (s *GlobalLookupFactory) MakeRoutineFactory(threadID int) (zdns.RoutineLookupFactory, error) {
 	r := new(RoutineLookupFactory)
 	r.Initialize(s.GlobalConf)
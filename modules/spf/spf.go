@@ -15,6 +15,8 @@
 package spf
 
 import (
+	"context"
+	"fmt"
 	"github.com/miekg/dns"
 	"github.com/kwang40/zdns"
 	"github.com/kwang40/zdns/modules/miekg"
@@ -25,6 +27,13 @@ type Result struct {
 	Spf string `json:"spf,omitempty"`
 }
 
+func (r Result) Records() []zdns.Record {
+	if r.Spf == "" {
+		return nil
+	}
+	return []zdns.Record{{Section: "spf", Type: "TXT", Answer: r.Spf}}
+}
+
 // Per Connection Lookup ======================================================
 //
 type Lookup struct {
@@ -32,9 +41,9 @@ type Lookup struct {
 	miekg.Lookup
 }
 
-func (s *Lookup) DoLookup(name string) (interface{}, []interface{}, zdns.Status, error) {
+func (s *Lookup) DoLookup(ctx context.Context, name string) (interface{}, []interface{}, zdns.Status, error) {
 	var res Result
-	innerRes, trace, status, err := s.DoTxtLookup(name)
+	innerRes, trace, status, err := s.DoTxtLookup(ctx, name)
 	if status != zdns.STATUS_NOERROR {
 		return res, trace, status, err
 	}
@@ -51,7 +60,10 @@ type RoutineLookupFactory struct {
 
 func (s *RoutineLookupFactory) MakeLookup() (zdns.Lookup, error) {
 	a := Lookup{Factory: s}
-	nameServer := s.Factory.RandomNameServer()
+	nameServer, err := s.Factory.RandomNameServer()
+	if err != nil {
+		return nil, err
+	}
 	a.Initialize(nameServer, dns.TypeTXT, dns.ClassINET, &s.RoutineLookupFactory)
 	a.Prefix = "v=spf"
 	return &a, nil
@@ -63,6 +75,26 @@ type GlobalLookupFactory struct {
 	miekg.GlobalLookupFactory
 }
 
+// AvroSchema is the schema of Result
+func (s *GlobalLookupFactory) AvroSchema() string {
+	return `{
+		"type": "record",
+		"name": "Result",
+		"namespace": "zdns.spf",
+		"fields": [
+			{"name": "spf", "type": "string"}
+		]
+	}`
+}
+
+func (s *GlobalLookupFactory) AvroRecord(data interface{}) (interface{}, error) {
+	res, ok := data.(Result)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %T", data)
+	}
+	return map[string]interface{}{"spf": res.Spf}, nil
+}
+
 func (s *GlobalLookupFactory) MakeRoutineFactory(threadID int) (zdns.RoutineLookupFactory, error) {
 	r := new(RoutineLookupFactory)
 	r.Initialize(s.GlobalConf)
@@ -0,0 +1,240 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Resolver runs the lookups of one module from Go code. For example:
+//
+//	conf := zdns.GlobalConf{NameServers: []string{"8.8.8.8:53"}}
+//	r, err := zdns.NewResolver(&conf, "A")
+//	...
+//	res := r.Lookup(ctx, "censys.io")
+//
+// Lookup modules register themselves from their init functions, so the
+// packages under modules/ that are needed must be imported for their side
+// effects, as zdns/main.go does.
+type Resolver struct {
+	conf    *GlobalConf
+	factory GlobalLookupFactory
+
+	// routine factories are kept between lookups so that the connections
+	// they hold are reused, and closed along with the resolver
+	mu     sync.Mutex
+	idle   []RoutineLookupFactory
+	made   int
+	closed bool
+}
+
+// NewModule returns a fresh instance of the lookup module registered as
+// name (or made for it, as for record types without a module of their
+// own), configured by parsing args against the flags of the module (e.g.
+// "--ipv4-lookup" for MXLOOKUP).
+func NewModule(name string, args ...string) (GlobalLookupFactory, error) {
+	registered := GetLookup(strings.ToUpper(name))
+	if registered == nil {
+		return nil, errors.New("unknown lookup module " + name + ". Valid modules: " + ValidlookupsString() + ", or any record type by name or as TYPEnnn")
+	}
+	// modules are registered as pointers to pre-configured structs, which
+	// are copied so that every resolver has a module of its own
+	v := reflect.ValueOf(registered)
+	if v.Kind() != reflect.Ptr {
+		return nil, errors.New("lookup module " + name + " is not registered as a pointer")
+	}
+	fresh := reflect.New(v.Elem().Type())
+	fresh.Elem().Set(v.Elem())
+	factory := fresh.Interface().(GlobalLookupFactory)
+	// parsing also sets the defaults of flags that are not given
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	factory.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, errors.New("unused module arguments: " + strings.Join(flags.Args(), " "))
+	}
+	return factory, nil
+}
+
+// NewResolver prepares conf and initializes a new instance of the named
+// module with it. args are module flags, as accepted by NewModule.
+func NewResolver(conf *GlobalConf, module string, args ...string) (*Resolver, error) {
+	factory, err := NewModule(module, args...)
+	if err != nil {
+		return nil, err
+	}
+	conf.Module = strings.ToUpper(module)
+	return NewResolverForModule(conf, factory)
+}
+
+// NewResolverForModule prepares conf and initializes factory with it
+func NewResolverForModule(conf *GlobalConf, factory GlobalLookupFactory) (*Resolver, error) {
+	if err := conf.Prepare(); err != nil {
+		return nil, err
+	}
+	if conf.TargetedInput && factory.ZonefileInput() {
+		return nil, errors.New("lookup module reads zone files and cannot use targeted input")
+	}
+	if err := factory.Initialize(conf); err != nil {
+		return nil, errors.New("unable to initialize lookup module: " + err.Error())
+	}
+	return &Resolver{conf: conf, factory: factory}, nil
+}
+
+func (r *Resolver) Conf() *GlobalConf {
+	return r.conf
+}
+
+func (r *Resolver) Module() GlobalLookupFactory {
+	return r.factory
+}
+
+// Lookup resolves a single name, or a line in the input format given by
+// the configuration (e.g. an Alexa rank and name).
+func (r *Resolver) Lookup(ctx context.Context, name string) Result {
+	f, err := r.routineFactory()
+	if err != nil {
+		return errorResult(name, err)
+	}
+	defer r.release(f)
+	return r.lookup(ctx, f, name)
+}
+
+// routineFactory returns an idle routine factory, or makes a new one if all
+// of them are in use
+func (r *Resolver) routineFactory() (RoutineLookupFactory, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		f := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return f, nil
+	}
+	threadID := r.made
+	r.made++
+	r.mu.Unlock()
+	return r.factory.MakeRoutineFactory(threadID)
+}
+
+// release returns f to the idle routine factories, or closes it if the
+// resolver has been closed in the meantime
+func (r *Resolver) release(f RoutineLookupFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		closeRoutineFactory(f)
+		return
+	}
+	r.idle = append(r.idle, f)
+}
+
+func errorResult(name string, err error) Result {
+	return Result{Name: name, Status: string(STATUS_ERROR), Error: err.Error()}
+}
+
+func (r *Resolver) lookup(ctx context.Context, f RoutineLookupFactory, name string) Result {
+	if r.factory.ZonefileInput() {
+		return errorResult(name, errors.New("lookup module reads zone files and cannot look up names"))
+	}
+	l, err := f.MakeLookup()
+	if err != nil {
+		return errorResult(name, err)
+	}
+	res, _, _ := lookupInput(ctx, r.factory, r.conf, l, name)
+	return res
+}
+
+// Resolve looks up every name received from names on Threads goroutines and
+// sends the results to the returned channel, in no particular order. The
+// channel is closed once names is closed and every lookup has finished, or
+// once ctx is done. Names of other shards than conf.Shard are skipped.
+func (r *Resolver) Resolve(ctx context.Context, names <-chan string) <-chan Result {
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	wg.Add(r.conf.Threads)
+	for i := 0; i < r.conf.Threads; i++ {
+		go func() {
+			defer wg.Done()
+			f, err := r.routineFactory()
+			if err == nil {
+				defer r.release(f)
+			}
+			for {
+				var name string
+				var ok bool
+				select {
+				case name, ok = <-names:
+				case <-ctx.Done():
+					return
+				}
+				if !ok {
+					return
+				}
+				if !inShard(r.conf, name) {
+					continue
+				}
+				var res Result
+				if err != nil {
+					res = errorResult(name, err)
+				} else {
+					res = r.lookup(ctx, f, name)
+				}
+				if res.Status == string(STATUS_NO_OUTPUT) {
+					continue
+				}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Scan runs a scan with the input and output handlers named in the
+// configuration, as the zdns command does. See DoLookups for stop and ctx.
+func (r *Resolver) Scan(ctx context.Context, stop <-chan struct{}) error {
+	return DoLookups(ctx, stop, &r.factory, r.conf)
+}
+
+// Close closes the connections of the idle routine factories and releases
+// the resources held by the module. Routine factories still in use by
+// Resolve are closed once their goroutines finish.
+func (r *Resolver) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	idle := r.idle
+	r.idle = nil
+	r.mu.Unlock()
+	for _, f := range idle {
+		closeRoutineFactory(f)
+	}
+	return r.factory.Finalize()
+}
@@ -0,0 +1,275 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kwang40/zdns"
+	_ "github.com/kwang40/zdns/modules/miekg"
+	"github.com/miekg/dns"
+)
+
+// startServer runs a UDP name server that answers every A query with
+// 192.0.2.1 and returns its address
+func startServer(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestResolver(t *testing.T) {
+	addr, shutdown := startServer(t)
+	defer shutdown()
+
+	conf := zdns.GlobalConf{NameServers: []string{addr}, Threads: 2}
+	r, err := zdns.NewResolver(&conf, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	res := r.Lookup(context.Background(), "example.com")
+	if res.Status != string(zdns.STATUS_NOERROR) {
+		t.Fatalf("lookup failed: %s %s", res.Status, res.Error)
+	}
+	if answers := res.Data.(zdns.MiekgResult).Answers; len(answers) != 1 {
+		t.Errorf("expected one answer, got %v", answers)
+	}
+
+	names := make(chan string)
+	go func() {
+		for _, n := range []string{"a.example", "b.example", "c.example"} {
+			names <- n
+		}
+		close(names)
+	}()
+	seen := make(map[string]bool)
+	for res := range r.Resolve(context.Background(), names) {
+		if res.Status != string(zdns.STATUS_NOERROR) {
+			t.Errorf("%s: %s %s", res.Name, res.Status, res.Error)
+		}
+		seen[res.Name] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected three results, got %v", seen)
+	}
+}
+
+func TestResolverErrors(t *testing.T) {
+	conf := zdns.GlobalConf{NameServers: []string{"127.0.0.1:53"}}
+	if _, err := zdns.NewResolver(&conf, "NOSUCHMODULE"); err == nil {
+		t.Error("expected an error for an unknown module")
+	}
+	conf = zdns.GlobalConf{NameServers: []string{"127.0.0.1:53"}, Transport: "carrier-pigeon"}
+	if _, err := zdns.NewResolver(&conf, "A"); err == nil {
+		t.Error("expected an error for an unknown transport")
+	}
+}
+
+func TestResolverIllegalInput(t *testing.T) {
+	conf := zdns.GlobalConf{NameServers: []string{"127.0.0.1:53"}, AlexaFormat: true}
+	r, err := zdns.NewResolver(&conf, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"example.com", "first,example.com"} {
+		if res := r.Lookup(context.Background(), line); res.Status != string(zdns.STATUS_ILLEGAL_INPUT) {
+			t.Errorf("%s: expected %s, got %s", line, zdns.STATUS_ILLEGAL_INPUT, res.Status)
+		}
+	}
+}
+
+func TestResolverTargetedInput(t *testing.T) {
+	addr, shutdown := startServer(t)
+	defer shutdown()
+
+	// nothing listens on the default name server, so only lookups sent to
+	// the targeted one succeed
+	conf := zdns.GlobalConf{NameServers: []string{"127.0.0.1:1"}, TargetedInput: true, Retries: 1}
+	r, err := zdns.NewResolver(&conf, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	res := r.Lookup(context.Background(), `{"domain": "example.com", "nameservers": ["`+addr+`"]}`)
+	if res.Status != string(zdns.STATUS_NOERROR) {
+		t.Fatalf("lookup failed: %s %s", res.Status, res.Error)
+	}
+	if res.Name != "example.com" || res.Nameserver != addr {
+		t.Errorf("unexpected name %s or name server %s", res.Name, res.Nameserver)
+	}
+	if res := r.Lookup(context.Background(), "example.com"); res.Status != string(zdns.STATUS_ILLEGAL_INPUT) {
+		t.Errorf("expected %s for a line that is not JSON, got %s", zdns.STATUS_ILLEGAL_INPUT, res.Status)
+	}
+}
+
+func TestResolverTargetedRetries(t *testing.T) {
+	addr, shutdown := startServer(t)
+	defer shutdown()
+	// a name server that never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conf := zdns.GlobalConf{NameServers: []string{"127.0.0.1:1"}, TargetedInput: true, Retries: 2, Timeout: 3 * time.Second}
+	r, err := zdns.NewResolver(&conf, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// whichever server the lookup starts at, the retry goes to the other
+	line := `{"domain": "example.com", "nameservers": ["` + silent.LocalAddr().String() + `", "` + addr + `"]}`
+	for i := 0; i < 4; i++ {
+		res := r.Lookup(context.Background(), line)
+		if res.Status != string(zdns.STATUS_NOERROR) {
+			t.Fatalf("lookup failed: %s %s", res.Status, res.Error)
+		}
+		if res.Nameserver != addr {
+			t.Errorf("expected the answer from %s, got it from %s", addr, res.Nameserver)
+		}
+	}
+}
+
+func TestResolverShards(t *testing.T) {
+	addr, shutdown := startServer(t)
+	defer shutdown()
+
+	var names []string
+	for i := 0; i < 30; i++ {
+		names = append(names, fmt.Sprintf("name%d.example", i))
+	}
+	seen := make(map[string]int)
+	for shard := 0; shard < 3; shard++ {
+		conf := zdns.GlobalConf{NameServers: []string{addr}, Threads: 2, Shard: shard, Shards: 3}
+		r, err := zdns.NewResolver(&conf, "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := make(chan string)
+		go func() {
+			for _, n := range names {
+				in <- n
+			}
+			close(in)
+		}()
+		n := 0
+		for res := range r.Resolve(context.Background(), in) {
+			seen[res.Name]++
+			n++
+		}
+		r.Close()
+		if n == 0 || n == len(names) {
+			t.Errorf("shard %d looked up %d of %d names", shard, n, len(names))
+		}
+	}
+	for _, n := range names {
+		if seen[n] != 1 {
+			t.Errorf("%s was looked up %d times", n, seen[n])
+		}
+	}
+}
+
+// countingModule counts the routine factories made by the module it wraps,
+// and how many of them were closed
+type countingModule struct {
+	zdns.GlobalLookupFactory
+	made, closed int32
+}
+
+type countingRoutine struct {
+	zdns.RoutineLookupFactory
+	m *countingModule
+}
+
+func (c *countingRoutine) Close() {
+	atomic.AddInt32(&c.m.closed, 1)
+	if rc, ok := c.RoutineLookupFactory.(zdns.RoutineCloser); ok {
+		rc.Close()
+	}
+}
+
+func (m *countingModule) MakeRoutineFactory(threadID int) (zdns.RoutineLookupFactory, error) {
+	f, err := m.GlobalLookupFactory.MakeRoutineFactory(threadID)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&m.made, 1)
+	return &countingRoutine{RoutineLookupFactory: f, m: m}, nil
+}
+
+func TestResolverReusesRoutineFactories(t *testing.T) {
+	addr, shutdown := startServer(t)
+	defer shutdown()
+
+	module, err := zdns.NewModule("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &countingModule{GlobalLookupFactory: module}
+	conf := zdns.GlobalConf{NameServers: []string{addr}, Threads: 2, Module: "A"}
+	r, err := zdns.NewResolverForModule(&conf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if res := r.Lookup(context.Background(), "example.com"); res.Status != string(zdns.STATUS_NOERROR) {
+			t.Fatalf("lookup failed: %s %s", res.Status, res.Error)
+		}
+	}
+	names := make(chan string)
+	go func() {
+		for i := 0; i < 10; i++ {
+			names <- fmt.Sprintf("name%d.example", i)
+		}
+		close(names)
+	}()
+	for range r.Resolve(context.Background(), names) {
+	}
+	if made := atomic.LoadInt32(&m.made); made > 2 {
+		t.Errorf("expected at most 2 routine factories, %d were made", made)
+	}
+	if closed := atomic.LoadInt32(&m.closed); closed != 0 {
+		t.Errorf("expected no routine factory to be closed before Close, %d were", closed)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if made, closed := atomic.LoadInt32(&m.made), atomic.LoadInt32(&m.closed); made != closed {
+		t.Errorf("made %d routine factories but closed %d", made, closed)
+	}
+}
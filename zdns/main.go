@@ -15,10 +15,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -30,6 +33,8 @@ import (
 	_ "github.com/kwang40/zdns/modules/mxlookup"
 	_ "github.com/kwang40/zdns/modules/nslookup"
 	_ "github.com/kwang40/zdns/modules/spf"
+	_ "github.com/kwang40/zdns/encoders/avro"
+	_ "github.com/kwang40/zdns/iohandlers/dnstap"
 	_ "github.com/kwang40/zdns/iohandlers/file"
 )
 
@@ -41,22 +46,53 @@ func main() {
 	flags.IntVar(&gc.GoMaxProcs, "go-processes", 0, "number of OS processes (GOMAXPROCS)")
 	flags.StringVar(&gc.NamePrefix, "prefix", "", "name to be prepended to what's passed in (e.g., www.)")
 	flags.BoolVar(&gc.AlexaFormat, "alexa", false, "is input file from Alexa Top Million download")
+	flags.BoolVar(&gc.TargetedInput, "targeted-input", false, "input lines are JSON objects with a domain and the name servers to query for it")
 	flags.BoolVar(&gc.IterativeResolution, "iterative", false, "Perform own iteration instead of relying on recursive resolver")
 	flags.BoolVar(&gc.Trace, "trace", false, "Output a trace of individual steps for each resolution")
+	flags.BoolVar(&gc.RawResponse, "raw-response", false, "include each response as received, base64 encoded, in the raw field of results and trace steps")
 	flags.StringVar(&gc.InputFilePath, "input-file", "-", "names to read")
-	flags.StringVar(&gc.OutputFilePath, "output-file", "-", "where should JSON output be saved")
+	flags.StringVar(&gc.OutputFilePath, "output-file", "-", "where should output be saved")
+	flags.StringVar(&gc.InputCompression, "input-compression", "", "compression of the input: none, gzip, zstd or xz (default: from the file extension)")
+	flags.StringVar(&gc.OutputCompression, "output-compression", "", "compression of the output: none, gzip, zstd or xz (default: from the file extension)")
+	flags.StringVar(&gc.OutputRotateSizeString, "output-rotate-size", "", "start a new output file once this much (e.g. 1GB) has been written to the current one")
+	flags.DurationVar(&gc.OutputRotateInterval, "output-rotate-interval", 0, "start a new output file at every multiple of this interval (e.g. 1h)")
+	flags.IntVar(&gc.OutputShards, "output-shards", 0, "split output across this many files by a hash of the name")
 	flags.StringVar(&gc.RedisServerUrl, "redis-url", "", "URL for redis server that stores one-to-many IP:domain mapping")
 	flags.StringVar(&gc.RedisServerPass, "redis-pass", "", "Password for redis server")
 	flags.IntVar(&gc.RedisServerDB, "redis-db", 0, "DB for redis server")
 	flags.StringVar(&gc.MetadataFilePath, "metadata-file", "", "where should JSON metadata be saved")
 	flags.StringVar(&gc.LogFilePath, "log-file", "", "where should JSON logs be saved")
+	flags.StringVar(&gc.MetricsListenAddr, "metrics-listen", "", "address (e.g. :9100) to serve Prometheus metrics on at /metrics while the scan runs")
+	flags.StringVar(&gc.CheckpointFilePath, "checkpoint-file", "", "where to record which input lines have been processed")
+	flags.IntVar(&gc.Shard, "shard", 0, "which shard of the input to look up, from 0 to --shards - 1")
+	flags.IntVar(&gc.Shards, "shards", 1, "split the input into this many shards by a hash of the name, e.g. to scan it from several machines")
+	flags.BoolVar(&gc.Resume, "resume", false, "skip the input lines recorded in --checkpoint-file and append to the output file")
 	flags.IntVar(&gc.Verbosity, "verbosity", 3, "log verbosity: 1 (lowest)--5 (highest)")
 	flags.IntVar(&gc.Retries, "retries", 1, "how many times should zdns retry query if timeout or temporary failure")
+	flags.Float64Var(&gc.RateLimit, "rate-limit", 0, "maximum queries per second sent in total (0 for no limit)")
+	flags.Float64Var(&gc.PerServerRateLimit, "per-server-rate-limit", 0, "maximum queries per second sent to any single name server IP (0 for no limit)")
 	flags.IntVar(&gc.MaxDepth, "max-depth", 10, "how deep should we recurse when performing iterative lookups")
-	flags.IntVar(&gc.CacheSize, "cache-size", 10000, "how many items can be stored in internal recursive cache")
+	flags.StringVar(&gc.CacheFilePath, "cache-file", "", "load the iterative cache from this file at startup, and save it there when done")
+	flags.StringVar(&gc.CacheSizeString, "cache-size", "10000", "how many items can be stored in internal recursive cache, or how much memory (e.g. 512MB) it may take up")
 	flags.StringVar(&gc.InputHandler, "input-handler", "file", "handler to input names")
 	flags.StringVar(&gc.OutputHandler, "output-handler", "file", "handler to output names")
-	servers_string := flags.String("name-servers", "", "comma-delimited list of DNS servers to use")
+	flags.StringVar(&gc.OutputFormat, "output-format", zdns.FORMAT_JSON, "format of the results written by the output handler: json, csv or avro")
+	flags.StringVar(&gc.Transport, "transport", zdns.TRANSPORT_UDP, "transport for queries: udp (with tcp fallback), tls (DNS-over-TLS, port 853) or https (DNS-over-HTTPS)")
+	flags.StringVar(&gc.HTTPSMethod, "https-method", "GET", "HTTP method for DNS-over-HTTPS queries: GET or POST")
+	flags.StringVar(&gc.TLSServerName, "tls-server-name", "", "server name (SNI) to send and verify for DNS-over-TLS and DNS-over-HTTPS")
+	flags.StringVar(&gc.TLSCAFile, "tls-ca-file", "", "PEM file of CAs used to verify DNS-over-TLS and DNS-over-HTTPS servers (default: system roots)")
+	flags.BoolVar(&gc.TLSInsecureSkipVerify, "tls-skip-verify", false, "do not verify DNS-over-TLS and DNS-over-HTTPS server certificates")
+	flags.BoolVar(&gc.EDNS, "edns0", false, "attach an EDNS0 OPT record to queries (implied by --dnssec, --nsid and --client-subnet)")
+	flags.IntVar(&gc.UDPBufferSize, "udp-buffer-size", 4096, "UDP payload size advertised in the EDNS0 OPT record")
+	flags.BoolVar(&gc.DNSSEC, "dnssec", false, "set the DNSSEC OK (DO) bit to request DNSSEC records")
+	flags.BoolVar(&gc.NSID, "nsid", false, "request the name server identifier (NSID, RFC 5001)")
+	flags.BoolVar(&gc.ValidateDNSSEC, "validate-dnssec", false, "validate the chain of trust of iterative lookups against the root trust anchor (implies --dnssec, requires --iterative)")
+	flags.StringVar(&gc.RootHintsFilePath, "root-hints", "", "root hints file (e.g. named.root) listing the root servers that iterative lookups start from")
+	flags.BoolVar(&gc.RootIPv6, "root-ipv6", false, "also use the IPv6 addresses of the root servers")
+	flags.BoolVar(&gc.NoRootPriming, "no-root-priming", false, "do not ask the root servers for their current addresses before iterative lookups start")
+	flags.StringVar(&gc.TrustAnchorsFilePath, "trust-anchors", "", "file of DS or DNSKEY records of the root zone to validate DNSSEC against, instead of the IANA root trust anchors")
+	flags.StringVar(&gc.ClientSubnetString, "client-subnet", "", "send an EDNS Client Subnet option (RFC 7871) for this CIDR, e.g. 192.0.2.0/24")
+	servers_string := flags.String("name-servers", "", "comma-delimited list of DNS servers to use (URL templates for --transport=https)")
 	config_file := flags.String("conf-file", "/etc/resolv.conf", "config file for DNS servers")
 	timeout := flags.Int("timeout", 15, "timeout for resolving an individual name")
 	iterationTimeout := flags.Int("iteration-timeout", 4, "timeout for resolving a single iteration in an iterative query")
@@ -72,7 +108,7 @@ func main() {
 	factory := zdns.GetLookup(gc.Module)
 	if factory == nil {
 		flags.Parse(os.Args[1:])
-		log.Fatal("Invalid lookup module specified. Valid modules: ", zdns.ValidlookupsString())
+		log.Fatal("Invalid lookup module specified. Valid modules: ", zdns.ValidlookupsString(), ", or any record type by name or as TYPEnnn")
 	}
 	factory.AddFlags(flags)
 	flags.Parse(os.Args[2:])
@@ -133,24 +169,10 @@ func main() {
 		log.Fatal("Unknown record class specified. Valid valued are INET (default), CSNET, CHAOS, HESIOD, NONE, ANY")
 
 	}
-	if *servers_string == "" {
-		// if we're doing recursive resolution, figure out default OS name servers
-		// otherwise, use the set of 13 root name servers
-		if gc.IterativeResolution {
-			gc.NameServers = zdns.RootServers[:]
-		} else {
-			ns, err := zdns.GetDNSServers(*config_file)
-			if err != nil {
-				log.Fatal("Unable to fetch correct name servers:", err.Error())
-			}
-			gc.NameServers = ns
-		}
-		gc.NameServersSpecified = false
-		log.Info("no name servers specified. will use: ", strings.Join(gc.NameServers, ", "))
-	} else {
+	if *servers_string != "" {
 		gc.NameServers = strings.Split(*servers_string, ",")
-		gc.NameServersSpecified = true
 	}
+	gc.ResolvConfPath = *config_file
 	if *nanoSeconds {
 		gc.TimeFormat = time.RFC3339Nano
 	} else {
@@ -178,17 +200,41 @@ func main() {
 		log.Fatal("Specified module does not allow reading from stdin")
 	}
 
-	// allow the factory to initialize itself
-	if err := factory.Initialize(&gc); err != nil {
-		log.Fatal("Factory was unable to initialize:", err.Error())
+	resolver, err := zdns.NewResolverForModule(&gc, factory)
+	if err != nil {
+		log.Fatal("Unable to set up lookups: ", err.Error())
 	}
-	// run it.
-	if err := zdns.DoLookups(&factory, &gc); err != nil {
-		log.Fatal("Unable to run lookups:", err.Error())
+	if !gc.NameServersSpecified {
+		log.Info("no name servers specified. will use: ", strings.Join(gc.NameServers, ", "))
 	}
-	// allow the factory to initialize itself
-	if err := factory.Finalize(); err != nil {
-		log.Fatal("Factory was unable to finalize:", err.Error())
+	// the first SIGINT or SIGTERM lets lookups in flight finish and flushes
+	// their output, the second one aborts them
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("Stopping: waiting for lookups in flight. Signal again to abort them.")
+		close(stop)
+		<-signals
+		log.Info("Aborting lookups in flight")
+		cancel()
+	}()
+	// run it.
+	// the module is finalized even if the scan failed, so that what it
+	// saves on the way out (e.g. the cache snapshot) is not lost
+	scanErr := resolver.Scan(ctx, stop)
+	closeErr := resolver.Close()
+	if closeErr != nil {
+		log.Error("Factory was unable to finalize:", closeErr.Error())
+	}
+	if scanErr != nil {
+		log.Fatal("Unable to run lookups:", scanErr.Error())
+	}
+	if closeErr != nil {
+		os.Exit(1)
 	}
 
 }